@@ -1,265 +1,1477 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type APIServer struct {
 	listenAddress string
 	store         Storage // Storage interface for interacting with data store.
+	cfg           *Config
+	webhooks      *WebhookDispatcher
+	tokens        *TokenKeys
+	emails        EmailSender
+	clock         Clock
 }
 
-func NewAPIServer(address string, store Storage) *APIServer {
+func NewAPIServer(address string, store Storage, cfg *Config) *APIServer {
 	return &APIServer{
-		listenAddress: address, // Initializing APIServer with provided address and store.
+		listenAddress: address, // Initializing APIServer with provided address, store and config.
 		store:         store,
+		cfg:           cfg,
+		webhooks:      NewWebhookDispatcher(store, cfg),
+		tokens:        cfg.TokenKeys,
+		emails:        newEmailSender(cfg),
+		clock:         cfg.Clock,
 	}
 }
 
-// WriteJSON writes JSON response to the client.
+// newHTTPServer returns a server of handler on address with the configured
+// timeouts, unlike http.ListenAndServe which has none.
+func (s *APIServer) newHTTPServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+	}
+}
+
+// WriteJSON writes JSON response to the client, as a JSON:API document if
+// the request asked for one and v has a JSON:API form.
 func WriteJSON(w http.ResponseWriter, status int, v interface{}) error {
+	if _, ok := w.(*jsonAPIWriter); ok {
+		doc, ok, err := toJSONAPI(status, v)
+		if err != nil {
+			return err
+		}
+		if ok {
+			w.Header().Set("Content-Type", jsonAPIMediaType)
+			w.WriteHeader(status)
+			return json.NewEncoder(w).Encode(doc)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json") // Setting response header to indicate JSON content.
 	w.WriteHeader(status)                              // Setting the response status code.
 	return json.NewEncoder(w).Encode(v)                // Encoding provided data as JSON and writing to response.
 }
 
-func (s *APIServer) Run() {
-	router := mux.NewRouter() // Creating a new router instance using gorilla/mux.
+// routes returns the handler of every route of the API with its middleware.
+// Browsers of other origins are let in by the CORS policy of each route.
+func (s *APIServer) routes() http.Handler {
+	router := mux.NewRouter() // Creating a new router instance using gorilla/mux.
+	router.Use(withRequestID, withMetrics, withGzip, s.withBodyLogging, withRecovery, s.withRateLimit, s.withJSONContentType, withJSONAPI)
+
+	// Serving metrics unauthenticated, unless on a separate admin listener.
+	if s.cfg.MetricsAddress == "" {
+		router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	}
+
+	// Unknown routes and methods get JSON errors like everything else.
+	router.NotFoundHandler = http.HandlerFunc(handleRouteNotFound)
+	router.MethodNotAllowedHandler = methodNotAllowedHandler(router)
+
+	// Registering handlers for specific routes.
+	router.HandleFunc("/openapi.json", handleOpenAPISpec).Methods("GET")
+	router.HandleFunc("/docs", handleDocs).Methods("GET")
+	router.HandleFunc("/version", handleVersion).Methods("GET")
+	router.HandleFunc("/login", s.makeHTTPHandler(s.handleLogin)).Methods("POST")
+	router.HandleFunc("/account", s.withAdminAuth(s.makeHTTPHandler(s.handleGetAccount))).Methods("GET")
+	router.HandleFunc("/account", s.withAccountCreationLimit(s.makeHTTPHandler(s.handleCreateAccount))).Methods("POST")
+	router.HandleFunc("/accounts", s.withJWTAuth(s.makeHTTPHandler(s.handleGetAccountsByIds))).Methods("GET")
+	router.HandleFunc("/accounts/batch", s.withAdminAuth(s.makeHTTPHandler(s.handleCreateAccountsBatch))).Methods("POST")
+	router.HandleFunc("/accounts/import", s.withAdminAuth(s.makeHTTPHandler(s.handleImportAccounts))).Methods("POST").Name(importAccountsRoute)
+	router.HandleFunc("/accounts/cleanup", s.withAdminAuth(s.makeHTTPHandler(s.handleCleanupAccounts))).Methods("POST")
+	router.HandleFunc("/account/search", s.withAdminAuth(s.makeHTTPHandler(s.handleSearchAccounts))).Methods("GET")
+	router.HandleFunc("/account/{id}", s.withJWTAuth(s.makeHTTPHandler(s.handleGetAccountById))).Methods("GET")
+	router.HandleFunc("/account/{id}", s.withJWTAuth(s.makeHTTPHandler(s.handleHeadAccountById))).Methods("HEAD")
+	router.HandleFunc("/account/{id}", s.withJWTAuth(s.makeHTTPHandler(s.handleDeleteAccount))).Methods("DELETE")
+	router.HandleFunc("/account/{id}", s.withJWTAuth(s.makeHTTPHandler(s.handleUpdateAccount))).Methods("PATCH")
+	router.HandleFunc("/account/{id}", s.withJWTAuth(s.makeHTTPHandler(s.handleReplaceAccount))).Methods("PUT")
+	router.HandleFunc("/account/number/{number}", s.withJWTAuth(s.makeHTTPHandler(s.handleGetAccountByNumber))).Methods("GET")
+	router.HandleFunc("/account/{id}/deposit", s.withAdminAuth(s.makeHTTPHandler(s.handleDeposit))).Methods("POST")
+	router.HandleFunc("/account/{id}/withdraw", s.withJWTAuth(s.makeHTTPHandler(s.handleWithdraw))).Methods("POST")
+	router.HandleFunc("/account/{id}/transactions", s.withJWTAuth(s.makeHTTPHandler(s.handleGetTransactions))).Methods("GET")
+	router.HandleFunc("/account/{id}/transactions/{transactionID}", s.withJWTAuth(s.makeHTTPHandler(s.handleGetTransaction))).Methods("GET")
+	router.HandleFunc("/account/{id}/export", s.withJWTAuth(s.makeHTTPHandler(s.handleExportAccount))).Methods("GET")
+	router.HandleFunc("/account/{id}/categories", s.withJWTAuth(s.makeHTTPHandler(s.handleGetCategoryTotals))).Methods("GET")
+	router.HandleFunc("/account/{id}/summary", s.withJWTAuth(s.makeHTTPHandler(s.handleGetSummary))).Methods("GET")
+	router.HandleFunc("/account/{id}/statement", s.withJWTAuth(s.makeHTTPHandler(s.handleStatement))).Methods("GET")
+	router.HandleFunc("/account/{id}/statement/email", s.withJWTAuth(s.makeHTTPHandler(s.handleEmailStatement))).Methods("POST")
+	router.HandleFunc("/account/{id}/statement/email", s.withJWTAuth(s.makeHTTPHandler(s.handleGetStatementEmails))).Methods("GET")
+	router.HandleFunc("/account/{id}/scheduled-transfers", s.withJWTAuth(s.makeHTTPHandler(s.handleCreateScheduledTransfer))).Methods("POST")
+	router.HandleFunc("/account/{id}/close", s.withJWTAuth(s.makeHTTPHandler(s.handleCloseAccount))).Methods("POST")
+	router.HandleFunc("/account/{id}/change-password", s.withJWTAuth(s.makeHTTPHandler(s.handleChangePassword))).Methods("POST")
+	router.HandleFunc("/account/{id}/logout-all", s.withJWTAuth(s.makeHTTPHandler(s.handleLogoutAll))).Methods("POST")
+	router.HandleFunc("/account/{id}/freeze", s.withAdminAuth(s.makeHTTPHandler(s.handleFreezeAccount))).Methods("POST")
+	router.HandleFunc("/account/{id}/transfer-ownership", s.withAdminAuth(s.makeHTTPHandler(s.handleTransferOwnership))).Methods("POST")
+	router.HandleFunc("/account/{id}/unfreeze", s.withAdminAuth(s.makeHTTPHandler(s.handleUnfreezeAccount))).Methods("POST")
+	router.HandleFunc("/account/{id}/2fa/enable", s.withJWTAuth(s.makeHTTPHandler(s.handleEnableTwoFactor))).Methods("POST")
+	router.HandleFunc("/account/{id}/2fa/verify", s.withJWTAuth(s.makeHTTPHandler(s.handleVerifyTwoFactor))).Methods("POST")
+	router.HandleFunc("/whoami", s.withJWTAuth(s.makeHTTPHandler(s.handleWhoami))).Methods("GET")
+	router.HandleFunc("/customers/{customerID}/accounts", s.withJWTAuth(s.makeHTTPHandler(s.handleGetCustomerAccounts))).Methods("GET")
+	router.HandleFunc("/customers/{customerID}/accounts", s.withJWTAuth(s.makeHTTPHandler(s.handleCreateWallet))).Methods("POST")
+	router.HandleFunc("/me", s.withJWTAuth(s.makeHTTPHandler(s.handleMe))).Methods("GET")
+	router.HandleFunc("/verify", s.makeHTTPHandler(s.handleVerifyEmail)).Methods("GET")
+	router.HandleFunc("/resend-verification", s.withJWTAuth(s.makeHTTPHandler(s.handleResendVerification))).Methods("POST")
+	router.HandleFunc("/webhooks", s.withJWTAuth(s.makeHTTPHandler(s.handleCreateWebhook))).Methods("POST")
+	router.HandleFunc("/transfer", s.withJWTAuth(s.makeHTTPHandler(s.handleTransfer))).Methods("POST")
+	router.HandleFunc("/transfer/fees", s.makeHTTPHandler(s.handleGetFees)).Methods("GET")
+	router.HandleFunc("/transfers", s.withAdminAuth(s.makeHTTPHandler(s.handleGetLedgerTransfers))).Methods("GET")
+	router.HandleFunc("/transfers/batch", s.withJWTAuth(s.makeHTTPHandler(s.handleTransferBatch))).Methods("POST")
+	router.HandleFunc("/transfer/{transferID}/confirm", s.withJWTAuth(s.makeHTTPHandler(s.handleConfirmTransfer))).Methods("POST")
+	router.HandleFunc("/transfer/{transactionID}/reverse", s.withJWTAuth(s.makeHTTPHandler(s.handleReverseTransfer))).Methods("POST")
+
+	return withCORS(router, newCORSPolicies(s.cfg))
+}
+
+// Run serves the API until the server fails or the process receives SIGINT or
+// SIGTERM, in which case in-flight requests are given ShutdownTimeout to
+// complete.
+func (s *APIServer) Run() error {
+	// Serving metrics unauthenticated on a separate admin listener when configured.
+	if s.cfg.MetricsAddress != "" {
+		go func() {
+			log.Println("Serving metrics on address", s.cfg.MetricsAddress)
+			log.Println(s.newHTTPServer(s.cfg.MetricsAddress, promhttp.Handler()).ListenAndServe())
+		}()
+	}
+
+	// Running the background jobs until the server stops, and waiting for
+	// them before returning so that none of them outlives the store.
+	jobs, stopJobs := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer stopJobs()
+	runJob := func(job func(context.Context)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			job(jobs)
+		}()
+	}
+
+	// Executing due scheduled transfers in the background.
+	runJob(s.runScheduler)
+
+	// Accruing interest on savings accounts in the background.
+	runJob(s.runInterestAccrual)
+
+	// Delivering webhook events in the background.
+	runJob(s.webhooks.Run)
+
+	// Emailing the statements asked for in the background.
+	runJob(s.runStatementEmails)
+
+	server := s.newHTTPServer(s.listenAddress, s.routes())
+	server.TLSConfig = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	// Starting the server with the provided address and router, over TLS when
+	// a certificate is configured.
+	serveErr := make(chan error, 1)
+	go func() {
+		if s.cfg.TLSCertFile != "" {
+			log.Println("Listening with TLS on address", s.listenAddress)
+			serveErr <- server.ListenAndServeTLS(s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+		} else {
+			log.Println("Listening without TLS on address", s.listenAddress)
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case sig := <-stop:
+		log.Printf("Received %s, shutting down", sig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancel()
+
+	return server.Shutdown(ctx)
+}
+
+// handleTransfer moves money from the authenticated account to another account.
+func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
+	transferReq := &TransferRequest{}
+	if err := decodeAndValidate(w, r, transferReq); err != nil {
+		return err
+	}
+	if err := s.checkCategory(transferReq.Category); err != nil {
+		return err
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+	if err := requireVerifiedEmail(account); err != nil {
+		return err
+	}
+
+	// Resolving the destination first gives a clean not found error.
+	var toAccount *Account
+	if transferReq.ToAccountID != 0 {
+		toAccount, err = s.store.GetAccountById(transferReq.ToAccountID)
+	} else {
+		toAccount, err = s.store.GetAccountByNumber(transferReq.ToAccount)
+	}
+	if err != nil {
+		return err
+	}
+	transferReq.ToAccount = toAccount.Number
+
+	// A dry run goes through every check but changes nothing.
+	if r.URL.Query().Get("dry_run") == "true" {
+		preview, err := s.store.PreviewTransfer(account.ID, transferReq.ToAccount, transferReq.Amount)
+		if err != nil {
+			return err
+		}
+		threshold := s.cfg.TransferApprovalThreshold
+		preview.RequiresConfirmation = threshold > 0 && transferReq.Amount >= threshold
+		return WriteJSON(w, http.StatusOK, preview)
+	}
+
+	// Large transfers wait for the sender's confirmation.
+	if threshold := s.cfg.TransferApprovalThreshold; threshold > 0 && transferReq.Amount >= threshold {
+		pt, err := s.store.CreatePendingTransfer(account.ID, transferReq.ToAccount, transferReq.Amount, transferReq.TransactionLabels, s.cfg.PendingTransferTTL)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusAccepted, pt)
+	}
+
+	fee, err := s.store.Transfer(account.ID, transferReq.ToAccount, transferReq.Amount, transferReq.TransactionLabels)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, TransferResponse{
+		ToAccount: transferReq.ToAccount,
+		Amount:    transferReq.Amount,
+		Fee:       fee,
+	})
+}
+
+// handleTransferBatch handles POST requests for paying many accounts from the
+// authenticated account at once, e.g. a payroll. The batch is executed in full
+// or not at all; the error names the index of the first failing item. Items
+// reaching the approval threshold must be sent on their own, to be confirmed.
+func (s *APIServer) handleTransferBatch(w http.ResponseWriter, r *http.Request) error {
+	var items []*BatchTransferItem
+	if err := decodeJSON(w, r, &items); err != nil {
+		return err
+	}
+
+	if len(items) == 0 || len(items) > maxBatchSize {
+		return fmt.Errorf("a batch must hold between 1 and %d transfers", maxBatchSize)
+	}
+
+	for i, item := range items {
+		if item == nil {
+			return &BatchItemError{Index: i, Err: ErrBatchItemRequired}
+		}
+		if err := validateRequest(item); err != nil {
+			return &BatchItemError{Index: i, Err: err}
+		}
+		if threshold := s.cfg.TransferApprovalThreshold; threshold > 0 && item.Amount >= threshold {
+			return &BatchItemError{Index: i, Err: fmt.Errorf("transfers of %s or more need confirmation and can't be batched", threshold)}
+		}
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+	if err := requireVerifiedEmail(account); err != nil {
+		return err
+	}
+
+	results, err := s.store.TransferBatch(account.ID, items)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, results)
+}
+
+// handleConfirmTransfer handles POST requests for executing a pending transfer
+// of the authenticated account.
+func (s *APIServer) handleConfirmTransfer(w http.ResponseWriter, r *http.Request) error {
+	id, err := getTransferID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+	if err := requireVerifiedEmail(account); err != nil {
+		return err
+	}
+
+	pt, err := s.store.ConfirmTransfer(id, account.ID)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, pt)
+}
+
+// handleReverseTransfer handles POST requests for undoing a transfer, named by
+// the id of its transfer_out ledger entry. Only the sender or an admin may
+// reverse it.
+func (s *APIServer) handleReverseTransfer(w http.ResponseWriter, r *http.Request) error {
+	id, err := getTransactionID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	original, err := s.store.GetTransactionById(id)
+	if err != nil {
+		return err
+	}
+
+	if original.AccountID != account.ID && !account.IsAdmin {
+		return ErrPermissionDenied
+	}
+
+	reversal, err := s.store.ReverseTransfer(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, reversal)
+}
+
+// defaultTransfersWindow is how far back the transfers of the ledger are
+// listed when no since is given.
+const defaultTransfersWindow = 24 * time.Hour
+
+// handleGetLedgerTransfers handles GET requests for the transfers between any
+// accounts, newest first, using cursor pagination. since, an RFC 3339 time,
+// defaults to a day ago, and min_amount singles out large transfers. Admin
+// only.
+func (s *APIServer) handleGetLedgerTransfers(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+	filter := LedgerTransferFilter{Since: s.clock.Now().Add(-defaultTransfersWindow)}
+
+	if str := query.Get("since"); str != "" {
+		since, err := time.Parse(time.RFC3339, str)
+		if err != nil {
+			return fmt.Errorf("invalid since: %s", str)
+		}
+		filter.Since = since
+	}
+
+	if str := query.Get("min_amount"); str != "" {
+		amount, err := parseMoney(str)
+		if err != nil || amount < 0 {
+			return fmt.Errorf("invalid min_amount: %s", str)
+		}
+		filter.MinAmount = amount
+	}
+
+	if str := query.Get("cursor"); str != "" {
+		var err error
+		filter.Before, err = strconv.Atoi(str)
+		if err != nil || filter.Before < 1 {
+			return fmt.Errorf("invalid cursor: %s", str)
+		}
+	}
+
+	limit, _, err := getPagination(r)
+	if err != nil {
+		return err
+	}
+
+	// Fetching one extra transfer tells whether there is a next page.
+	transfers, err := s.store.GetLedgerTransfers(r.Context(), filter, limit+1)
+	if err != nil {
+		return err
+	}
+
+	page := LedgerTransferPage{Transfers: transfers}
+	if len(transfers) > limit {
+		page.Transfers = transfers[:limit]
+		page.NextCursor = &page.Transfers[limit-1].ID
+	}
+
+	links := []string{pageLink(r, "first", map[string]string{"cursor": ""})}
+	if page.NextCursor != nil {
+		links = append(links, pageLink(r, "next", map[string]string{"cursor": strconv.Itoa(*page.NextCursor)}))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+
+	return WriteJSON(w, http.StatusOK, page)
+}
+
+// handleDeposit handles POST requests for adding money to an account, such as
+// cash paid in at a branch. The money comes from outside the ledger, so only
+// admins may deposit.
+func (s *APIServer) handleDeposit(w http.ResponseWriter, r *http.Request) error {
+	depositReq := &DepositRequest{}
+	if err := decodeAndValidate(w, r, depositReq); err != nil {
+		return err
+	}
+
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.store.Deposit(id, depositReq.Amount)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, toAccountResponse(account))
+}
+
+// handleWithdraw handles POST requests for taking money out of an account.
+func (s *APIServer) handleWithdraw(w http.ResponseWriter, r *http.Request) error {
+	withdrawReq := &WithdrawRequest{}
+	if err := decodeAndValidate(w, r, withdrawReq); err != nil {
+		return err
+	}
+	if err := s.checkCategory(withdrawReq.Category); err != nil {
+		return err
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+	if err := requireVerifiedEmail(account); err != nil {
+		return err
+	}
+
+	account, err = s.store.Withdraw(account.ID, withdrawReq.Amount, withdrawReq.TransactionLabels)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, toAccountResponse(account))
+}
+
+// ErrInvalidCredentials is returned for every failed login, whatever the reason,
+// so that callers can't probe which numbers or emails exist.
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrAccountLocked is matched by every AccountLockedError.
+var ErrAccountLocked = errors.New("account locked")
+
+// AccountLockedError reports a login refused because of too many failed
+// attempts.
+type AccountLockedError struct {
+	Until time.Time
+}
+
+func (e *AccountLockedError) Error() string {
+	return fmt.Sprintf("too many failed logins, account locked until %s", e.Until.UTC().Format(time.RFC3339))
+}
+
+func (e *AccountLockedError) Is(target error) bool {
+	return target == ErrAccountLocked
+}
+
+func (e *AccountLockedError) Details() map[string]interface{} {
+	return map[string]interface{}{"locked_until": NewTimestamp(e.Until)}
+}
+
+// accountLocked sets Retry-After and returns the error for a lock ending at until.
+func (s *APIServer) accountLocked(w http.ResponseWriter, until time.Time) error {
+	seconds := int(math.Ceil(until.Sub(s.clock.Now()).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	return &AccountLockedError{Until: until}
+}
+
+func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
+	var req LoginRequest
+	if err := decodeAndValidate(w, r, &req); err != nil {
+		return err
+	}
+
+	var (
+		account *Account
+		err     error
+	)
+
+	switch {
+	case req.Email != "":
+		account, err = s.store.GetAccountByEmail(req.Email)
+	case req.Number != 0:
+		account, err = s.store.GetAccountByNumber(req.Number)
+	default:
+		return fmt.Errorf("number or email is required")
+	}
+
+	if errors.Is(err, ErrAccountNotFound) {
+		return ErrInvalidCredentials
+	}
+	if err != nil {
+		return err
+	}
+
+	lockedUntil, err := s.store.GetLoginLock(account.ID)
+	if err != nil {
+		return err
+	}
+	if !lockedUntil.IsZero() {
+		return s.accountLocked(w, lockedUntil)
+	}
+
+	if !account.ValidPassword(req.Password) {
+		return s.loginFailed(w, account)
+	}
+
+	if err := s.checkTOTP(account, req.TOTPCode); errors.Is(err, ErrInvalidCredentials) {
+		return s.loginFailed(w, account)
+	} else if err != nil {
+		return err
+	}
+
+	if err := s.store.ResetLoginFailures(account.ID); err != nil {
+		return err
+	}
+
+	token, err := createJWTToken(account, s.tokens)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, LoginResponse{Number: account.Number, Token: token})
+}
+
+// loginFailed counts a wrong password or TOTP code against the account,
+// locking it once there were too many.
+func (s *APIServer) loginFailed(w http.ResponseWriter, account *Account) error {
+	lockedUntil, err := s.store.RecordLoginFailure(account.ID, s.cfg.LoginMaxFailures, s.cfg.LoginLockout)
+	if err != nil {
+		return err
+	}
+	if !lockedUntil.IsZero() {
+		return s.accountLocked(w, lockedUntil)
+	}
+	return ErrInvalidCredentials
+}
+
+// handleGetAccountById handles GET requests for retrieving an account. withJWTAuth
+// has already loaded it, since only the owner may read it. Clients polling the
+// account can send its ETag in If-None-Match to get a 304 while it's unchanged.
+func (s *APIServer) handleGetAccountById(w http.ResponseWriter, r *http.Request) error {
+	account, err := getAccountFromContext(r)
+
+	if err != nil {
+		return err
+	}
+
+	resp := toAccountResponse(account)
+	if current, err := writeAccountValidators(w, r, resp); current || err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleHeadAccountById handles HEAD requests for checking that an account
+// exists without transferring it. The ownership rules are those of GET, so
+// withJWTAuth has already answered for accounts that aren't the caller's.
+// The ETag is that of GET.
+func (s *APIServer) handleHeadAccountById(w http.ResponseWriter, r *http.Request) error {
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	if current, err := writeAccountValidators(w, r, toAccountResponse(account)); current || err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// maxBulkIds bounds the ids of one bulk fetch of accounts.
+const maxBulkIds = 100
+
+// handleGetAccountsByIds handles GET requests for several accounts at once,
+// given as ?ids=1,2,3. Accounts the caller may not read are left out like
+// those that don't exist, rather than failing the request: admins may read
+// any account, and holders those of their customer. The accounts come in the
+// order of ids, without repeats.
+func (s *APIServer) handleGetAccountsByIds(w http.ResponseWriter, r *http.Request) error {
+	caller, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	str := r.URL.Query().Get("ids")
+	if str == "" {
+		return errors.New("ids is required")
+	}
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, part := range strings.Split(str, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || id < 1 {
+			return fmt.Errorf("invalid account ID: %s", part)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxBulkIds {
+		return fmt.Errorf("at most %d ids may be fetched at once", maxBulkIds)
+	}
+
+	accounts, err := s.store.GetAccountsByIds(r.Context(), ids)
+	if err != nil {
+		return err
+	}
+
+	byID := make(map[int64]*Account, len(accounts))
+	for _, account := range accounts {
+		if caller.IsAdmin || account.CustomerID == caller.CustomerID {
+			byID[int64(account.ID)] = account
+		}
+	}
+
+	resp := []*AccountResponse{}
+	for _, id := range ids {
+		if account, ok := byID[id]; ok {
+			resp = append(resp, toAccountResponse(account))
+		}
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleWhoami returns the account the request's token belongs to.
+func (s *APIServer) handleWhoami(w http.ResponseWriter, r *http.Request) error {
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, toAccountResponse(account))
+}
+
+// handleMe handles GET requests for the account of the request's token, for
+// clients that only kept the token.
+func (s *APIServer) handleMe(w http.ResponseWriter, r *http.Request) error {
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, toAccountResponse(account))
+}
+
+// handleGetAccountByNumber handles GET requests for looking up who holds an
+// account number, without revealing anything else about the account.
+func (s *APIServer) handleGetAccountByNumber(w http.ResponseWriter, r *http.Request) error {
+	numberStr := mux.Vars(r)["number"]
+	number, err := strconv.ParseInt(numberStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid account number: %s", numberStr)
+	}
+
+	account, err := s.store.GetAccountByNumber(number)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, AccountHolder{
+		Number:    account.Number,
+		FirstName: account.FirstName,
+		LastName:  account.LastName,
+	})
+}
+
+// handleGetAccount handles GET requests for retrieving all accounts. Admin only.
+func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) error {
+	opts, err := getAccountListOptions(r)
+
+	if err != nil {
+		return err
+	}
+
+	accounts, err := s.store.GetAccounts(r.Context(), opts)
+
+	if err != nil {
+		return err
+	}
+
+	total, err := s.store.CountAccounts(r.Context(), opts)
+
+	if err != nil {
+		return err
+	}
+
+	setOffsetLinks(w, r, opts.Limit, opts.Offset, total)
+
+	return WriteJSON(w, http.StatusOK, toAccountResponses(accounts))
+}
+
+// minSearchLength is the shortest accepted account search query.
+const minSearchLength = 2
+
+// handleSearchAccounts handles GET requests for finding accounts by part of
+// the holder's first or last name.
+func (s *APIServer) handleSearchAccounts(w http.ResponseWriter, r *http.Request) error {
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if len([]rune(q)) < minSearchLength {
+		return fmt.Errorf("q must be at least %d characters", minSearchLength)
+	}
+
+	limit, offset, err := getPagination(r)
+	if err != nil {
+		return err
+	}
+
+	results, err := s.store.SearchAccounts(r.Context(), q, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, results)
+}
+
+// handleCreateAccount handles POST requests for creating an account. Anyone
+// may sign up, so the account opens empty: an opening deposit would come from
+// nowhere. Admins fund new accounts through the batch and import endpoints.
+func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
+	createAccountRequest := &CreateAccountRequest{}
+
+	if err := decodeAndValidate(w, r, createAccountRequest); err != nil {
+		return err
+	}
+	if err := s.cfg.PasswordPolicy.validateField("password", createAccountRequest.Password); err != nil {
+		return err
+	}
+	if createAccountRequest.InitialDeposit != 0 {
+		return &ValidationError{Fields: []FieldError{{
+			Field:   "initial_deposit",
+			Message: "may only be set by an admin",
+		}}}
+	}
+
+	account, err := s.newAccountFromRequest(createAccountRequest)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.CreateAccount(account); err != nil {
+		return err
+	}
+	s.startEmailVerification(account)
 
-	// Registering handlers for specific routes.
-	router.HandleFunc("/login", makeHTTPHandler(s.handleLogin))
-	router.HandleFunc("/account", withJWTAuth(makeHTTPHandler(s.handleAccount), s.store))
-	router.HandleFunc("/account/{id}", withJWTAuth(makeHTTPHandler(s.handleAccountById), s.store))
-	router.HandleFunc("/transfer", withJWTAuth(makeHTTPHandler(s.handleTransfer), s.store))
-	log.Println("Listening on address", s.listenAddress)
+	tokenString, err := createJWTToken(account, s.tokens)
+
+	if err != nil {
+		return err
+	}
 
-	// Starting the HTTP server with the provided address and router.
-	http.ListenAndServe(s.listenAddress, router)
+	return WriteJSON(w, http.StatusOK, CreateAccountResponse{
+		Account: toAccountResponse(account),
+		Token:   tokenString,
+	})
 }
 
-func (s *APIServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
-	transferReq := &TransferRequest{}
-	if err := json.NewDecoder(r.Body).Decode(transferReq); err != nil {
+// maxBatchSize bounds the number of items of one batch request.
+const maxBatchSize = 100
+
+// handleCreateAccountsBatch handles POST requests for creating many accounts
+// at once. The batch is created in full or not at all; the error names the
+// index of the first failing item.
+func (s *APIServer) handleCreateAccountsBatch(w http.ResponseWriter, r *http.Request) error {
+	var reqs []*CreateAccountRequest
+	if err := decodeJSON(w, r, &reqs); err != nil {
 		return err
 	}
-	defer r.Body.Close()
 
-	return WriteJSON(w, http.StatusOK, transferReq)
+	if len(reqs) == 0 || len(reqs) > maxBatchSize {
+		return fmt.Errorf("a batch must hold between 1 and %d accounts", maxBatchSize)
+	}
+
+	accounts := make([]*Account, len(reqs))
+	for i, req := range reqs {
+		if req == nil {
+			return &BatchItemError{Index: i, Err: ErrBatchItemRequired}
+		}
+		if err := validateRequest(req); err != nil {
+			return &BatchItemError{Index: i, Err: err}
+		}
+		if err := s.cfg.PasswordPolicy.validateField("password", req.Password); err != nil {
+			return &BatchItemError{Index: i, Err: err}
+		}
+
+		account, err := s.newAccountFromRequest(req)
+		if err != nil {
+			return &BatchItemError{Index: i, Err: err}
+		}
+		accounts[i] = account
+	}
+
+	if err := s.store.CreateAccounts(accounts); err != nil {
+		return err
+	}
+	for _, account := range accounts {
+		s.startEmailVerification(account)
+	}
+
+	return WriteJSON(w, http.StatusOK, toAccountResponses(accounts))
 }
 
-func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
-	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+// handleCleanupAccounts handles POST requests for closing every dormant account
+// with nothing in it. Closed accounts stay in the database. Admin only.
+func (s *APIServer) handleCleanupAccounts(w http.ResponseWriter, r *http.Request) error {
+	req := &CleanupAccountsRequest{}
+	if r.ContentLength != 0 {
+		if err := decodeAndValidate(w, r, req); err != nil {
+			return err
+		}
+	}
+	if req.DormantDays == 0 {
+		req.DormantDays = s.cfg.DormantDays
+	}
+
+	admin, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	inactiveSince := s.clock.Now().AddDate(0, 0, -req.DormantDays)
+	closed, err := s.store.CloseDormantAccounts(inactiveSince, req.DryRun, admin.ID)
+	if err != nil {
 		return err
 	}
-	defer r.Body.Close()
 
-	return WriteJSON(w, http.StatusOK, req)
+	return WriteJSON(w, http.StatusOK, CleanupAccountsResponse{
+		Closed:      closed,
+		DormantDays: req.DormantDays,
+		DryRun:      req.DryRun,
+	})
 }
 
-// handleAccount handles requests for account operations.
-func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-		return s.handleGetAccount(w)
+// newAccountFromRequest builds the account described by a validated request.
+func (s *APIServer) newAccountFromRequest(req *CreateAccountRequest) (*Account, error) {
+	account, err := NewAccount(req.FirstName, req.LastName, req.Email, req.Password, s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	if req.Type != "" {
+		account.Type = req.Type
+	}
+
+	if min := s.cfg.MinOpeningDeposits[account.Type]; req.InitialDeposit < min {
+		return nil, &ValidationError{Fields: []FieldError{{
+			Field:   "initial_deposit",
+			Message: fmt.Sprintf("must be at least %s for %s accounts", min, account.Type),
+		}}}
 	}
 
-	if r.Method == "POST" {
-		return s.handleCreateAccount(w, r)
+	if req.Currency != "" {
+		account.Currency = req.Currency
 	}
+	account.Balance = req.InitialDeposit
 
-	return fmt.Errorf("unsupported method: %s", r.Method)
+	return account, nil
 }
 
-func (s *APIServer) handleAccountById(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-		return s.handleGetAccountById(w, r)
+// handleDeleteAccount handles DELETE requests for deleting an account.
+func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+
+	if err != nil {
+		return err
 	}
 
-	if r.Method == "DELETE" {
-		return s.handleDeleteAccount(w, r)
+	if err := s.store.DeleteAccount(id); err != nil {
+		return err
 	}
+	return WriteJSON(w, http.StatusOK, nil)
+}
 
-	if r.Method == "PATCH" {
-		return s.handleUpdateAccount(w, r)
+func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
+	updateAccountRequest := &UpdateAccountRequest{}
+	if err := decodeAndValidate(w, r, updateAccountRequest); err != nil {
+		return err
 	}
+	return s.updateAccount(w, r, updateAccountRequest)
+}
 
-	return fmt.Errorf("unsupported method: %s", r.Method)
+// handleReplaceAccount handles PUT requests for replacing all the mutable
+// fields of an account at once.
+func (s *APIServer) handleReplaceAccount(w http.ResponseWriter, r *http.Request) error {
+	req := &ReplaceAccountRequest{}
+	if err := decodeAndValidate(w, r, req); err != nil {
+		return err
+	}
+	return s.updateAccount(w, r, &UpdateAccountRequest{
+		FirstName: &req.FirstName,
+		LastName:  &req.LastName,
+		Email:     &req.Email,
+		Type:      &req.Type,
+		Version:   req.Version,
+	})
 }
 
-// handleGetAccount handles GET requests for retrieving an account.
-func (s *APIServer) handleGetAccountById(w http.ResponseWriter, r *http.Request) error {
+// updateAccount applies a validated update to the account of the route and
+// responds with the result.
+func (s *APIServer) updateAccount(w http.ResponseWriter, r *http.Request, updateAccountRequest *UpdateAccountRequest) error {
 	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+	if err := s.store.UpdateAccount(id, updateAccountRequest); err != nil {
+		return err
+	}
+	account, err := s.store.Primary().GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	// A new email address must be verified again.
+	if updateAccountRequest.Email != nil {
+		s.startEmailVerification(account)
+	}
+	return WriteJSON(w, http.StatusOK, toAccountResponse(account))
+}
+
+// handleCloseAccount handles POST requests for closing an account, returning
+// its final statement.
+func (s *APIServer) handleCloseAccount(w http.ResponseWriter, r *http.Request) error {
+	req := &CloseAccountRequest{}
+	if r.ContentLength != 0 {
+		if err := decodeJSON(w, r, req); err != nil {
+			return err
+		}
+	}
 
+	id, err := getId(r)
 	if err != nil {
 		return err
 	}
 
-	account, err := s.store.GetAccountById(id)
+	account, err := s.store.CloseAccount(id, req.SweepTo)
+	if err != nil {
+		return err
+	}
 
+	// The sweep was just written; the replica may not have it yet.
+	statement := []*Transaction{}
+	err = s.store.Primary().ForEachTransaction(r.Context(), id, TransactionFilter{}, func(t *Transaction) error {
+		statement = append(statement, t)
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, account) // Writing a JSON response with a dummy Account.
+	return WriteJSON(w, http.StatusOK, CloseAccountResponse{
+		Account:   toAccountResponse(account),
+		Statement: statement,
+	})
 }
 
-// handleGetAccounts handles GET requests for retrieving all accounts.
-func (s *APIServer) handleGetAccount(w http.ResponseWriter) error {
-	accounts, err := s.store.GetAccounts()
+// handleChangePassword handles POST requests for replacing the password of the
+// authenticated account, and of the other accounts of its customer, which
+// share it. Wrong old passwords count as failed logins. Every existing token
+// of the customer is invalidated, and a new one is returned for the caller.
+func (s *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	req := &ChangePasswordRequest{}
+	if err := decodeAndValidate(w, r, req); err != nil {
+		return err
+	}
+	if err := s.cfg.PasswordPolicy.validateField("new_password", req.NewPassword); err != nil {
+		return err
+	}
 
+	account, err := getAccountFromContext(r)
 	if err != nil {
 		return err
 	}
 
-	return WriteJSON(w, http.StatusOK, accounts)
-}
+	lockedUntil, err := s.store.GetLoginLock(account.ID)
+	if err != nil {
+		return err
+	}
+	if !lockedUntil.IsZero() {
+		return s.accountLocked(w, lockedUntil)
+	}
 
-// handleCreateAccount handles POST requests for creating an account.
-func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
-	createAccountRequest := &CreateAccountRequest{}
+	if !account.ValidPassword(req.OldPassword) {
+		return s.loginFailed(w, account)
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(createAccountRequest); err != nil {
+	if req.NewPassword == req.OldPassword {
+		return fmt.Errorf("new_password must differ from old_password")
+	}
+
+	encpw, err := hashPassword(req.NewPassword, s.cfg.BcryptCost)
+	if err != nil {
 		return err
 	}
 
-	account := NewAccount(createAccountRequest.FirstName, createAccountRequest.LastName)
+	account, err = s.store.ChangePassword(account.ID, encpw)
+	if err != nil {
+		return err
+	}
 
-	if err := s.store.CreateAccount(account); err != nil {
+	token, err := createJWTToken(account, s.tokens)
+	if err != nil {
 		return err
 	}
 
-	tokenString, err := createJWTToken(account)
+	return WriteJSON(w, http.StatusOK, LoginResponse{Number: account.Number, Token: token})
+}
 
+// handleLogoutAll handles POST requests for invalidating every token issued for
+// the authenticated account and the other accounts of its customer, including
+// the one making the request.
+func (s *APIServer) handleLogoutAll(w http.ResponseWriter, r *http.Request) error {
+	account, err := getAccountFromContext(r)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Token: ", tokenString)
+	if err := s.store.RevokeTokens(account.ID); err != nil {
+		return err
+	}
 
-	return WriteJSON(w, http.StatusOK, account)
+	return WriteJSON(w, http.StatusOK, nil)
 }
 
-// handleDeleteAccount handles DELETE requests for deleting an account.
-func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request) error {
+// handleFreezeAccount handles POST requests for blocking all activity on an account. Admin only.
+func (s *APIServer) handleFreezeAccount(w http.ResponseWriter, r *http.Request) error {
 	id, err := getId(r)
-
 	if err != nil {
 		return err
 	}
 
-	if err := s.store.DeleteAccount(id); err != nil {
+	account, err := s.store.UpdateAccountStatus(id, AccountStatusActive, AccountStatusFrozen)
+	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, nil)
+
+	return WriteJSON(w, http.StatusOK, toAccountResponse(account))
 }
 
-func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
-	updateAccountRequest := &UpdateAccountRequest{}
-	if err := json.NewDecoder(r.Body).Decode(updateAccountRequest); err != nil {
+// handleTransferOwnership handles POST requests for handing an account over to
+// a new holder, e.g. when settling an estate. Admin only.
+func (s *APIServer) handleTransferOwnership(w http.ResponseWriter, r *http.Request) error {
+	req := &TransferOwnershipRequest{}
+	if err := decodeAndValidate(w, r, req); err != nil {
+		return err
+	}
+	if err := s.cfg.PasswordPolicy.validateField("password", req.Password); err != nil {
 		return err
 	}
+
 	id, err := getId(r)
 	if err != nil {
 		return err
 	}
-	if err := s.store.UpdateAccount(id, updateAccountRequest); err != nil {
+
+	admin, err := getAccountFromContext(r)
+	if err != nil {
 		return err
 	}
-	return WriteJSON(w, http.StatusOK, nil)
+
+	encpw, err := hashPassword(req.Password, s.cfg.BcryptCost)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.store.TransferOwnership(id, req, encpw, admin.ID)
+	if err != nil {
+		return err
+	}
+	s.startEmailVerification(account)
+
+	return WriteJSON(w, http.StatusOK, toAccountResponse(account))
+}
+
+// handleUnfreezeAccount handles POST requests for lifting a freeze. Admin only.
+func (s *APIServer) handleUnfreezeAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.store.UpdateAccountStatus(id, AccountStatusFrozen, AccountStatusActive)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, toAccountResponse(account))
 }
 
-func createJWTToken(account *Account) (string, error) {
+func createJWTToken(account *Account, keys *TokenKeys) (string, error) {
 	claims := jwt.MapClaims{
 		"acountNumber": account.Number,
-		"exp":          time.Now().Add(time.Hour * 72).Unix(),
+		"customerId":   account.CustomerID,
+		"isAdmin":      account.IsAdmin,
+		"tokenVersion": account.TokenVersion,
+		"exp":          keys.Now().Add(keys.TTL()).Unix(),
 	}
 
-	secret := os.Getenv("JWT_SECRET")
+	return keys.Sign(claims)
+}
+
+// ErrPermissionDenied is returned when the caller may not access a resource.
+var ErrPermissionDenied = errors.New("permission denied")
 
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+func permissionDenied(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, ErrPermissionDenied)
 }
 
-func permissionDenied(w http.ResponseWriter) {
-	WriteJSON(w, http.StatusForbidden, ApiError{Error: "permission denied"})
+// tokenExpired tells the client its token is no longer valid and should be refreshed.
+func tokenExpired(w http.ResponseWriter, r *http.Request) {
+	apiErr := ApiError{Error: ErrorBody{Code: CodeTokenExpired, Message: "token expired"}}
+	localizeError(w, r, &apiErr)
+	WriteJSON(w, http.StatusUnauthorized, apiErr)
 }
 
-func withJWTAuth(fn http.HandlerFunc, s Storage) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// authenticate validates the request's token and returns its claims. On failure
+// the appropriate error response has already been written and ok is false.
+func (s *APIServer) authenticate(w http.ResponseWriter, r *http.Request) (claims jwt.MapClaims, ok bool) {
+	tokenString := r.Header.Get("Authorization")
 
-		tokenString := r.Header.Get("Authorization")
+	token, err := validateJWTToken(tokenString, s.tokens)
 
-		token, err := validateJWTToken(tokenString)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		tokenExpired(w, r)
+		return nil, false
+	}
 
-		if err != nil {
-			permissionDenied(w)
-			return
-		}
+	if err != nil || !token.Valid {
+		permissionDenied(w, r)
+		return nil, false
+	}
 
-		if !token.Valid {
-			permissionDenied(w)
+	claims, ok = token.Claims.(jwt.MapClaims)
+	if !ok {
+		permissionDenied(w, r)
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// withJWTAuth resolves the account from the token's account number claim. On
+// routes with an {id} variable, the id must belong to an account of the same
+// customer, which the handler then gets instead.
+func (s *APIServer) withJWTAuth(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, _, ok := s.authenticateAccount(w, r)
+		if !ok {
 			return
 		}
 
-		userID, err := getId(r)
+		if _, hasId := mux.Vars(r)["id"]; hasId {
+			userID, err := getId(r)
 
-		if err != nil {
-			permissionDenied(w)
-			return
+			if err != nil {
+				permissionDenied(w, r)
+				return
+			}
+
+			if userID != account.ID {
+				wallet, err := s.store.GetAccountById(userID)
+				if err != nil || wallet.CustomerID != account.CustomerID {
+					permissionDenied(w, r)
+					return
+				}
+				account = wallet
+			}
 		}
 
-		account, err := s.GetAccountById(userID)
+		fn(w, r.WithContext(context.WithValue(r.Context(), accountContextKey{}, account)))
+	}
+}
 
-		if err != nil {
-			permissionDenied(w)
+// authenticateAccount resolves the account the request's token was issued to.
+// Tokens carrying an older token version than the account's, or another
+// customer than the account's, are rejected. The token of a deleted account
+// gets a 404, since the token itself is genuine. On failure the error
+// response has already been written and ok is false.
+func (s *APIServer) authenticateAccount(w http.ResponseWriter, r *http.Request) (account *Account, claims jwt.MapClaims, ok bool) {
+	claims, ok = s.authenticate(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+
+	number, ok := accountNumberClaim(claims)
+	if !ok {
+		permissionDenied(w, r)
+		return nil, nil, false
+	}
+
+	account, err := s.store.GetAccountByNumber(number)
+
+	if err != nil {
+		writeError(w, r, err)
+		return nil, nil, false
+	}
+
+	if version, ok := intClaim(claims, "tokenVersion"); !ok || version != int64(account.TokenVersion) {
+		permissionDenied(w, r)
+		return nil, nil, false
+	}
+
+	if customerID, ok := intClaim(claims, "customerId"); !ok || customerID != int64(account.CustomerID) {
+		permissionDenied(w, r)
+		return nil, nil, false
+	}
+
+	return account, claims, true
+}
+
+// accountContextKey is the context key under which withJWTAuth stores the
+// authenticated account. Being unexported, it can't collide with other keys.
+type accountContextKey struct{}
+
+// getAccountFromContext returns the account authenticated by withJWTAuth or
+// withAdminAuth.
+func getAccountFromContext(r *http.Request) (*Account, error) {
+	account, ok := r.Context().Value(accountContextKey{}).(*Account)
+	if !ok {
+		return nil, errors.New("no authenticated account")
+	}
+	return account, nil
+}
+
+// accountNumberClaim reads the account number from verified token claims.
+func accountNumberClaim(claims jwt.MapClaims) (int64, bool) {
+	return intClaim(claims, "acountNumber")
+}
+
+// intClaim reads an integer claim. JSON numbers decode as float64, so
+// anything else, or a fractional value, means the token wasn't issued by us.
+func intClaim(claims jwt.MapClaims, name string) (int64, bool) {
+	f, ok := claims[name].(float64)
+	if !ok || f != math.Trunc(f) {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+// withAdminAuth only lets requests through whose token carries the admin claim.
+func (s *APIServer) withAdminAuth(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		account, claims, ok := s.authenticateAccount(w, r)
+		if !ok {
 			return
 		}
 
-		claims := token.Claims.(jwt.MapClaims)
-
-		if account.Number != int64(claims["acountNumber"].(float64)) {
-			permissionDenied(w)
+		if isAdmin, _ := claims["isAdmin"].(bool); !isAdmin {
+			permissionDenied(w, r)
+			return
 		}
 
-		fn(w, r)
+		fn(w, r.WithContext(context.WithValue(r.Context(), accountContextKey{}, account)))
 	}
 }
 
-func validateJWTToken(token string) (*jwt.Token, error) {
-	secret := os.Getenv("JWT_SECRET")
-	return jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secret), nil
-	})
+func validateJWTToken(token string, keys *TokenKeys) (*jwt.Token, error) {
+	return keys.Parse(token)
+}
 
+// maxBodyBytes caps the size of request bodies read by decodeJSON.
+const maxBodyBytes = 1 << 20
+
+// decodeJSON strictly decodes the request body into v: the body may be at most
+// maxBodyBytes long and must not contain fields v doesn't know about.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	defer r.Body.Close()
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return err
+		}
+		if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+			return fmt.Errorf("unknown field %s", field)
+		}
+		return err
+	}
+	return nil
 }
 
 // apiFunc is a function signature for API handlers.
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
-type ApiError struct {
-	Error string `json:"error"`
-}
-
 // makeHTTPHandler wraps an API handler function with error handling.
-func makeHTTPHandler(fn apiFunc) http.HandlerFunc {
+func (s *APIServer) makeHTTPHandler(fn apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Invoking the provided handler function and handling any error.
 		if err := fn(w, r); err != nil {
-			// If an error occurs, writing an error response with HTTP status Bad Request.
-			WriteJSON(w, http.StatusBadRequest, ApiError{Error: err.Error()})
+			// A client that went away gets no response at all. The cancelled
+			// context already aborted its queries, which is likely the error.
+			if r.Context().Err() != nil {
+				log.Printf("request %s cancelled serving %s %s: %v", getRequestID(r), r.Method, r.URL.Path, err)
+				return
+			}
+
+			// If an error occurs, writing an error response with the matching HTTP status and code.
+			status, apiErr := errorResponse(err)
+
+			// Internal errors are always logged, and in production only
+			// the log keeps their details.
+			if status == http.StatusInternalServerError {
+				log.Printf("error serving %s %s (request %s): %v", r.Method, r.URL.Path, getRequestID(r), err)
+				if s.cfg.Env == EnvProduction {
+					apiErr = ApiError{Error: ErrorBody{Code: CodeInternal, Message: "internal server error"}}
+				}
+			}
+
+			localizeError(w, r, &apiErr)
+			WriteJSON(w, status, apiErr)
+		}
+	}
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
+// getAccountListOptions reads the filter, sort and pagination query parameters
+// of the accounts list endpoint.
+func getAccountListOptions(r *http.Request) (AccountListOptions, error) {
+	query := r.URL.Query()
+
+	opts := AccountListOptions{
+		LastName: query.Get("last_name"),
+		Sort:     query.Get("sort"),
+		Order:    query.Get("order"),
+	}
+
+	if opts.Sort == "" {
+		opts.Sort = "id"
+	}
+
+	if _, ok := sortableAccountColumns[opts.Sort]; !ok {
+		return opts, fmt.Errorf("invalid sort: %s", opts.Sort)
+	}
+
+	if opts.Order == "" {
+		opts.Order = "asc"
+	}
+
+	if opts.Order != "asc" && opts.Order != "desc" {
+		return opts, fmt.Errorf("invalid order: %s", opts.Order)
+	}
+
+	limit, offset, err := getPagination(r)
+	if err != nil {
+		return opts, err
+	}
+	opts.Limit, opts.Offset = limit, offset
+
+	return opts, nil
+}
+
+// setOffsetLinks sets the RFC 8288 Link header of a page of a list paginated
+// by limit and offset, with first, prev, next and last relations as
+// applicable, and X-Total-Count to the number of items in the list.
+func setOffsetLinks(w http.ResponseWriter, r *http.Request, limit, offset, total int) {
+	last := 0
+	if total > 0 {
+		last = (total - 1) / limit * limit
+	}
+
+	links := []string{pageLink(r, "first", map[string]string{"offset": "0"})}
+	if offset > 0 {
+		prev := max(min(offset-limit, last), 0)
+		links = append(links, pageLink(r, "prev", map[string]string{"offset": strconv.Itoa(prev)}))
+	}
+	if offset+limit < total {
+		links = append(links, pageLink(r, "next", map[string]string{"offset": strconv.Itoa(offset + limit)}))
+	}
+	links = append(links, pageLink(r, "last", map[string]string{"offset": strconv.Itoa(last)}))
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+}
+
+// pageLink formats one Link header value pointing at the current request
+// with the query parameters in params replaced. An empty value removes the
+// parameter.
+func pageLink(r *http.Request, rel string, params map[string]string) string {
+	query := r.URL.Query()
+	for key, value := range params {
+		if value == "" {
+			query.Del(key)
+		} else {
+			query.Set(key, value)
+		}
+	}
+
+	u := url.URL{Path: r.URL.Path, RawQuery: query.Encode()}
+	return fmt.Sprintf("<%s>; rel=\"%s\"", u.String(), rel)
+}
+
+// getPagination reads the limit and offset query parameters, applying defaults.
+func getPagination(r *http.Request) (limit, offset int, err error) {
+	query := r.URL.Query()
+
+	limit = defaultPageSize
+	if str := query.Get("limit"); str != "" {
+		limit, err = strconv.Atoi(str)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, fmt.Errorf("invalid limit: %s", str)
 		}
 	}
+
+	if str := query.Get("offset"); str != "" {
+		offset, err = strconv.Atoi(str)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid offset: %s", str)
+		}
+	}
+
+	return limit, offset, nil
 }
 
 func getId(r *http.Request) (int, error) {
@@ -270,3 +1482,24 @@ func getId(r *http.Request) (int, error) {
 	}
 	return id, nil
 }
+
+// getTransactionID reads the {transactionID} route variable.
+func getTransactionID(r *http.Request) (int, error) {
+	idStr := mux.Vars(r)["transactionID"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid transaction ID: %s", idStr)
+	}
+	return id, nil
+}
+
+// getTransferID reads the {transferID} route variable. Transfer routes can't
+// use {id}, which withJWTAuth reserves for the caller's own account id.
+func getTransferID(r *http.Request) (int, error) {
+	idStr := mux.Vars(r)["transferID"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid transfer ID: %s", idStr)
+	}
+	return id, nil
+}
@@ -0,0 +1,74 @@
+//go:build integration
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTransferOwnershipInvalidatesOldTokens(t *testing.T) {
+	store := newTestStore(t)
+	cfg := testConfig(t)
+	cfg.BcryptCost = bcrypt.MinCost
+	s := NewAPIServer("", store, cfg)
+
+	router := mux.NewRouter()
+	router.HandleFunc("/me", s.withJWTAuth(s.makeHTTPHandler(s.handleMe))).Methods("GET")
+	router.HandleFunc("/account/{id}/transfer-ownership", s.withAdminAuth(s.makeHTTPHandler(s.handleTransferOwnership))).Methods("POST")
+
+	admin, err := NewAccount("Bank", "Admin", "", "Passw0rd!", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin.IsAdmin = true
+	if err := store.CreateAccount(admin); err != nil {
+		t.Fatal(err)
+	}
+	adminToken, err := createJWTToken(admin, cfg.TokenKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	account := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+	oldToken, err := createJWTToken(account, cfg.TokenKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(router, http.MethodGet, "/me", oldToken, nil); rec.Code != http.StatusOK {
+		t.Fatalf("before the transfer: got %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	body := `{"first_name":"Byron","last_name":"King","email":"byron@example.com","password":"N3wHolder!"}`
+	rec := serve(router, http.MethodPost, "/account/"+strconv.Itoa(account.ID)+"/transfer-ownership", adminToken, strings.NewReader(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("transfer-ownership: got %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	rec = serve(router, http.MethodGet, "/me", oldToken, nil)
+	if body := decodeError(t, rec); rec.Code != http.StatusForbidden || body.Code != CodePermissionDenied {
+		t.Errorf("old token after the transfer: got %d %s, want 403 permission denied", rec.Code, rec.Body)
+	}
+
+	// The new holder logs in to the same account, balance and all.
+	transferred, err := store.GetAccountById(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transferred.Number != account.Number || transferred.Balance != 100_00 || transferred.FirstName != "Byron" {
+		t.Errorf("after the transfer: %s %s number %d holding %s, want Byron's account number %d holding 100.00",
+			transferred.FirstName, transferred.LastName, transferred.Number, transferred.Balance, account.Number)
+	}
+	newToken, err := createJWTToken(transferred, cfg.TokenKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := serve(router, http.MethodGet, "/me", newToken, nil); rec.Code != http.StatusOK {
+		t.Errorf("new token: got %d %s, want 200", rec.Code, rec.Body)
+	}
+}
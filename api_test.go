@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+// accountsStore serves a fixed set of accounts.
+type accountsStore struct {
+	Storage
+	accounts []*Account
+}
+
+func (s *accountsStore) GetAccountByNumber(number int64) (*Account, error) {
+	for _, account := range s.accounts {
+		if account.Number == number {
+			return account, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: number %d", ErrAccountNotFound, number)
+}
+
+func (s *accountsStore) GetAccountById(id int) (*Account, error) {
+	for _, account := range s.accounts {
+		if account.ID == id {
+			return account, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+}
+
+// serve sends a request to handler, with token as its Authorization header
+// unless it is empty.
+func serve(handler http.Handler, method, target, token string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeError decodes the error response recorded by rec.
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) ErrorBody {
+	t.Helper()
+
+	var body ApiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("decoding the error response %q: %v", rec.Body, err)
+	}
+	return body.Error
+}
+
+func TestExpiredTokenIsUnauthorized(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 31, 9, 30, 0, 0, time.UTC))
+	cfg := testConfig(t)
+	setClock(cfg, clock)
+	account := &Account{ID: 1, CustomerID: 1, Number: 79927398713, TokenVersion: 1}
+	s := NewAPIServer("", &accountsStore{accounts: []*Account{account}}, cfg)
+	me := s.withJWTAuth(s.makeHTTPHandler(s.handleMe))
+
+	token, err := createJWTToken(account, cfg.TokenKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(cfg.TokenKeys.TTL() - time.Second)
+	if rec := serve(me, http.MethodGet, "/me", token, nil); rec.Code != http.StatusOK {
+		t.Fatalf("token about to expire: got %d %s, want 200", rec.Code, rec.Body)
+	}
+
+	clock.Advance(2 * time.Second)
+	rec := serve(me, http.MethodGet, "/me", token, nil)
+	if body := decodeError(t, rec); rec.Code != http.StatusUnauthorized || body.Code != CodeTokenExpired || body.Message != "token expired" {
+		t.Errorf("expired token: got %d %s, want 401 token expired", rec.Code, rec.Body)
+	}
+}
+
+func TestLockRetryAfterFollowsTheClock(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 31, 9, 30, 0, 0, time.UTC))
+	cfg := testConfig(t)
+	setClock(cfg, clock)
+	s := NewAPIServer("", &accountsStore{}, cfg)
+
+	rec := httptest.NewRecorder()
+	s.accountLocked(rec, clock.Now().Add(90*time.Second))
+	if got := rec.Header().Get("Retry-After"); got != "90" {
+		t.Errorf("Retry-After %q, want 90", got)
+	}
+}
+
+func TestForgedTokenIsForbidden(t *testing.T) {
+	cfg := testConfig(t)
+	account := &Account{ID: 1, CustomerID: 1, Number: 79927398713, TokenVersion: 1}
+	s := NewAPIServer("", &accountsStore{accounts: []*Account{account}}, cfg)
+	me := s.withJWTAuth(s.makeHTTPHandler(s.handleMe))
+
+	forger := *cfg.TokenKeys
+	forger.signKey = []byte(strings.Repeat("f", minJWTSecretLength))
+	forged, err := createJWTToken(account, &forger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.MapClaims{
+		"acountNumber": account.Number,
+		"customerId":   account.CustomerID,
+		"tokenVersion": account.TokenVersion,
+		"exp":          time.Now().Add(time.Hour).Unix(),
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := map[string]string{
+		"other secret": forged,
+		"alg none":     unsigned,
+		"garbage":      "not-a-token",
+	}
+	for name, token := range tokens {
+		rec := serve(me, http.MethodGet, "/me", token, nil)
+		if body := decodeError(t, rec); rec.Code != http.StatusForbidden || body.Code != CodePermissionDenied {
+			t.Errorf("%s: got %d %s, want 403 permission denied", name, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestTokenWithBadClaimsIsForbidden(t *testing.T) {
+	cfg := testConfig(t)
+	account := &Account{ID: 1, CustomerID: 1, Number: 79927398713, TokenVersion: 1}
+	s := NewAPIServer("", &accountsStore{accounts: []*Account{account}}, cfg)
+	me := s.withJWTAuth(s.makeHTTPHandler(s.handleMe))
+
+	// Validly signed tokens with claims we wouldn't issue.
+	tests := map[string]jwt.MapClaims{
+		"no account number":         {"customerId": 1, "tokenVersion": 1},
+		"string account number":     {"acountNumber": "79927398713", "customerId": 1, "tokenVersion": 1},
+		"fractional account number": {"acountNumber": 79927398713.5, "customerId": 1, "tokenVersion": 1},
+		"no customer":               {"acountNumber": account.Number, "tokenVersion": 1},
+		"string customer":           {"acountNumber": account.Number, "customerId": "1", "tokenVersion": 1},
+		"no token version":          {"acountNumber": account.Number, "customerId": 1},
+		"object token version":      {"acountNumber": account.Number, "customerId": 1, "tokenVersion": map[string]int{"v": 1}},
+	}
+	for name, claims := range tests {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		token, err := cfg.TokenKeys.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rec := serve(me, http.MethodGet, "/me", token, nil)
+		if body := decodeError(t, rec); rec.Code != http.StatusForbidden || body.Code != CodePermissionDenied {
+			t.Errorf("%s: got %d %s, want 403 permission denied", name, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestIntClaim(t *testing.T) {
+	claims := jwt.MapClaims{"whole": float64(42), "fraction": 4.2, "string": "42", "bool": true}
+
+	if got, ok := intClaim(claims, "whole"); !ok || got != 42 {
+		t.Errorf("intClaim(whole) = %d, %v, want 42", got, ok)
+	}
+	for _, name := range []string{"fraction", "string", "bool", "missing"} {
+		if got, ok := intClaim(claims, name); ok {
+			t.Errorf("intClaim(%s) = %d, want no value", name, got)
+		}
+	}
+}
+
+func TestClientTimestampsAreRejected(t *testing.T) {
+	s := NewAPIServer("", nil, testConfig(t))
+	create := s.makeHTTPHandler(s.handleCreateAccount)
+	update := s.makeHTTPHandler(s.handleUpdateAccount)
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		method  string
+		body    string
+	}{
+		{"create with created_at", create, http.MethodPost,
+			`{"first_name":"Ada","last_name":"Lovelace","email":"ada@example.com","password":"Passw0rd!","created_at":"2000-01-01T00:00:00.000Z"}`},
+		{"create with updated_at", create, http.MethodPost,
+			`{"first_name":"Ada","last_name":"Lovelace","email":"ada@example.com","password":"Passw0rd!","updated_at":"2000-01-01T00:00:00.000Z"}`},
+		{"update with created_at", update, http.MethodPatch,
+			`{"first_name":"Ada","version":1,"created_at":"2000-01-01T00:00:00.000Z"}`},
+		{"update with updated_at", update, http.MethodPatch,
+			`{"first_name":"Ada","version":1,"updated_at":"2000-01-01T00:00:00.000Z"}`},
+	}
+	for _, tt := range tests {
+		rec := serve(tt.handler, tt.method, "/account/1", "", strings.NewReader(tt.body))
+		if body := decodeError(t, rec); rec.Code != http.StatusBadRequest || !strings.Contains(body.Message, "unknown field") {
+			t.Errorf("%s: got %d %s, want 400 unknown field", tt.name, rec.Code, rec.Body)
+		}
+	}
+}
+
+// staleStore fails every update as if the account changed in the meantime.
+type staleStore struct {
+	Storage
+}
+
+func (s *staleStore) UpdateAccount(id int, req *UpdateAccountRequest) error {
+	return ErrStaleUpdate
+}
+
+func TestStaleUpdateIsConflict(t *testing.T) {
+	s := NewAPIServer("", &staleStore{}, testConfig(t))
+	update := mux.NewRouter()
+	update.Handle("/account/{id}", s.makeHTTPHandler(s.handleUpdateAccount))
+
+	rec := serve(update, http.MethodPatch, "/account/1", "", strings.NewReader(`{"first_name":"Ada","version":1}`))
+	if body := decodeError(t, rec); rec.Code != http.StatusConflict || body.Code != CodeStaleUpdate {
+		t.Errorf("got %d %s, want 409 stale update", rec.Code, rec.Body)
+	}
+}
+
+// updateStore records the update it was asked for.
+type updateStore struct {
+	Storage
+	req *UpdateAccountRequest
+}
+
+func (s *updateStore) UpdateAccount(id int, req *UpdateAccountRequest) error {
+	s.req = req
+	return nil
+}
+
+func (s *updateStore) Primary() Storage { return s }
+
+func (s *updateStore) GetAccountById(id int) (*Account, error) {
+	return &Account{ID: id, EmailVerified: true}, nil
+}
+
+func TestPatchAccountTellsOmittedNullAndEmptyApart(t *testing.T) {
+	ptr := func(s string) *string { return &s }
+	tests := []struct {
+		name      string
+		body      string
+		wantFirst *string
+		wantEmail *string
+	}{
+		{"omitted", `{"last_name":"Byron","version":1}`, nil, nil},
+		{"null", `{"first_name":null,"email":null,"last_name":"Byron","version":1}`, nil, nil},
+		{"set", `{"first_name":"Augusta","email":"ada@example.com","version":1}`, ptr("Augusta"), ptr("ada@example.com")},
+		{"email cleared", `{"email":"","version":1}`, nil, ptr("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &updateStore{}
+			s := NewAPIServer("", store, testConfig(t))
+			router := mux.NewRouter()
+			router.Handle("/account/{id}", s.makeHTTPHandler(s.handleUpdateAccount))
+
+			rec := serve(router, http.MethodPatch, "/account/1", "", strings.NewReader(tt.body))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got %d %s, want 200", rec.Code, rec.Body)
+			}
+			if !reflect.DeepEqual(store.req.FirstName, tt.wantFirst) || !reflect.DeepEqual(store.req.Email, tt.wantEmail) {
+				t.Errorf("update of first name %v and email %v, want %v and %v",
+					deref(store.req.FirstName), deref(store.req.Email), deref(tt.wantFirst), deref(tt.wantEmail))
+			}
+		})
+	}
+}
+
+func TestPatchAccountRejectsEmptyNames(t *testing.T) {
+	s := NewAPIServer("", &updateStore{}, testConfig(t))
+	router := mux.NewRouter()
+	router.Handle("/account/{id}", s.makeHTTPHandler(s.handleUpdateAccount))
+
+	for _, field := range []string{"first_name", "last_name"} {
+		rec := serve(router, http.MethodPatch, "/account/1", "", strings.NewReader(`{"`+field+`":"","version":1}`))
+		if body := decodeError(t, rec); rec.Code != http.StatusBadRequest || len(body.Details) == 0 {
+			t.Errorf("emptying %s: got %d %s, want 400 naming the field", field, rec.Code, rec.Body)
+		}
+	}
+}
+
+// deref formats an optional string for test failures.
+func deref(s *string) string {
+	if s == nil {
+		return "<nil>"
+	}
+	return strconv.Quote(*s)
+}
+
+// blockingStore holds GetAccounts until the request is cancelled, like a
+// slow query would.
+type blockingStore struct {
+	Storage
+	started chan struct{}
+	counted bool
+}
+
+func (s *blockingStore) GetAccounts(ctx context.Context, opts AccountListOptions) ([]*Account, error) {
+	close(s.started)
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (s *blockingStore) CountAccounts(ctx context.Context, opts AccountListOptions) (int, error) {
+	s.counted = true
+	return 0, nil
+}
+
+func TestCancelledGetAccountsWritesNothing(t *testing.T) {
+	store := &blockingStore{started: make(chan struct{})}
+	s := NewAPIServer("", store, testConfig(t))
+	handler := s.makeHTTPHandler(s.handleGetAccount)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodGet, "/account", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(rec, req)
+	}()
+
+	// The client goes away while the query runs.
+	<-store.started
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the handler didn't return after the client went away")
+	}
+
+	if rec.Body.Len() != 0 || len(rec.Header()) != 0 {
+		t.Errorf("wrote %d %v %q to a cancelled client, want nothing", rec.Code, rec.Header(), rec.Body)
+	}
+	if store.counted {
+		t.Error("the accounts were counted after the client went away")
+	}
+}
+
+// jobStore counts the calls of the background jobs to the store.
+type jobStore struct {
+	Storage
+	calls atomic.Int64
+}
+
+func (s *jobStore) GetDueScheduledTransfers(now time.Time) ([]*ScheduledTransfer, error) {
+	s.calls.Add(1)
+	return nil, nil
+}
+
+func (s *jobStore) ExpirePendingTransfers() (int, error) {
+	s.calls.Add(1)
+	return 0, nil
+}
+
+func (s *jobStore) AccrueInterest(day time.Time) (int, error) {
+	s.calls.Add(1)
+	return 0, nil
+}
+
+func (s *jobStore) GetOutboxEvents(limit int, skipAccounts []int64) ([]*OutboxEvent, error) {
+	s.calls.Add(1)
+	return nil, nil
+}
+
+func (s *jobStore) GetPendingStatementEmails(limit int) ([]*StatementEmail, error) {
+	s.calls.Add(1)
+	return nil, nil
+}
+
+func TestBatchesRejectNullItems(t *testing.T) {
+	s := NewAPIServer("", nil, testConfig(t))
+
+	tests := []struct {
+		name    string
+		handler apiFunc
+		body    string
+	}{
+		{"accounts", s.handleCreateAccountsBatch,
+			`[{"first_name": "Ada", "last_name": "Lovelace", "email": "ada@example.com", "password": "Passw0rd!"}, null]`},
+		{"transfers", s.handleTransferBatch, `[{"to_account": 79927398713, "amount": 10}, null]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			s.makeHTTPHandler(tt.handler)(rec, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(tt.body)))
+
+			var body ApiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != http.StatusBadRequest || body.Error.Message != "item 1 is required" || body.Error.Details["index"] != 1.0 {
+				t.Errorf("got %d %s, want 400 for item 1", rec.Code, rec.Body)
+			}
+		})
+	}
+}
+
+func TestRunReturnsListenErrorAfterStoppingJobs(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SchedulePollInterval = time.Millisecond
+	cfg.InterestAccrualInterval = time.Millisecond
+	cfg.WebhookPollInterval = time.Millisecond
+	cfg.StatementEmailPollInterval = time.Millisecond
+
+	// Taking the port the server wants, so that it can't listen.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	store := &jobStore{}
+	if err := NewAPIServer(listener.Addr().String(), store, cfg).Run(); err == nil {
+		t.Fatal("expected an error for an address in use")
+	}
+
+	calls := store.calls.Load()
+	time.Sleep(20 * time.Millisecond)
+	if got := store.calls.Load(); got != calls {
+		t.Errorf("jobs made %d store calls after Run returned", got-calls)
+	}
+}
+
+func TestSlowClientIsTimedOut(t *testing.T) {
+	tests := []struct {
+		name  string
+		send  string
+		setup func(cfg *Config)
+	}{
+		{"headers", "GET /version HTTP/1.1\r\nHost: localhost\r\n", func(cfg *Config) {
+			cfg.ReadHeaderTimeout = 100 * time.Millisecond
+		}},
+		{"body", "POST /echo HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\n{", func(cfg *Config) {
+			cfg.ReadTimeout = 100 * time.Millisecond
+		}},
+		{"idle", "GET /version HTTP/1.1\r\nHost: localhost\r\n\r\n", func(cfg *Config) {
+			cfg.IdleTimeout = 100 * time.Millisecond
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout = time.Minute, time.Minute, time.Minute, time.Minute
+			tt.setup(cfg)
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(w, r.Body)
+			})
+			server := NewAPIServer("", nil, cfg).newHTTPServer("", handler)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go server.Serve(listener)
+			defer server.Close()
+
+			// The client sends part of a request, or a whole one it then
+			// keeps the connection of, and stalls.
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := io.WriteString(conn, tt.send); err != nil {
+				t.Fatal(err)
+			}
+
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Fatalf("the server kept the connection of a stalled client open: %v", err)
+			}
+		})
+	}
+}
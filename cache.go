@@ -0,0 +1,322 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// accountCacheRequests counts the account lookups answered by the cache. The
+// hit rate is hits / (hits + misses), e.g. in PromQL:
+//
+//	sum(rate(account_cache_requests_total{result="hit"}[5m]))
+//	  / sum(rate(account_cache_requests_total[5m]))
+var accountCacheRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "account_cache_requests_total",
+		Help: "Number of account lookups through the cache, by result (hit or miss).",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(accountCacheRequests)
+}
+
+// Cache holds accounts by id for a short while. Implementations must be safe
+// for concurrent use; an in-process LRU is the only one so far, but a shared
+// one such as Redis fits behind the same interface.
+type Cache interface {
+	Get(id int) (*Account, bool)
+	Set(account *Account)
+	Delete(id int)
+	Purge()
+}
+
+// lruCache is a Cache of bounded size evicting the least recently used
+// account, whose entries also expire after a TTL.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // of *lruEntry, most recently used first
+	entries map[int]*list.Element
+	clock   Clock
+}
+
+type lruEntry struct {
+	account   Account
+	expiresAt time.Time
+}
+
+// NewLRUCache returns a Cache of at most size accounts, each kept for ttl as
+// timed by clock.
+func NewLRUCache(size int, ttl time.Duration, clock Clock) Cache {
+	return &lruCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[int]*list.Element),
+		clock:   clock,
+	}
+}
+
+// Get returns a copy of the cached account, so callers may modify it freely.
+func (c *lruCache) Get(id int) (*Account, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if c.clock.Now().After(entry.expiresAt) {
+		c.remove(elem)
+		return nil, false
+	}
+
+	c.order.MoveToFront(elem)
+	account := entry.account
+	return &account, true
+}
+
+func (c *lruCache) Set(account *Account) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &lruEntry{account: *account, expiresAt: c.clock.Now().Add(c.ttl)}
+	if elem, ok := c.entries[account.ID]; ok {
+		elem.Value = entry
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[account.ID] = c.order.PushFront(entry)
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+func (c *lruCache) Delete(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[id]; ok {
+		c.remove(elem)
+	}
+}
+
+func (c *lruCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[int]*list.Element)
+}
+
+func (c *lruCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*lruEntry).account.ID)
+}
+
+// cachedStore serves account lookups from a Cache in front of another Storage,
+// dropping the accounts a write may have changed. Writes that touch accounts
+// it can't name, such as interest accrual, purge the whole cache.
+//
+// Invalidation only reaches the cache of this process: with an in-process
+// cache and several instances, another instance may serve an account up to
+// the cache TTL old. The same holds for a lookup racing with a write.
+type cachedStore struct {
+	Storage
+	cache Cache
+
+	// feeAccount is charged on transfers behind the store's back.
+	feeAccount int64
+
+	// numbers maps the account numbers looked up so far to their id, which
+	// never changes, so that lookups and invalidations by number find the
+	// cached entry.
+	mu      sync.Mutex
+	numbers map[int64]int
+}
+
+// NewCachedStore puts cache in front of the account lookups of store.
+func NewCachedStore(store Storage, cache Cache, feeAccount int64) Storage {
+	return &cachedStore{
+		Storage:    store,
+		cache:      cache,
+		feeAccount: feeAccount,
+		numbers:    make(map[int64]int),
+	}
+}
+
+func (s *cachedStore) GetAccountById(id int) (*Account, error) {
+	if account, ok := s.cache.Get(id); ok {
+		accountCacheRequests.WithLabelValues("hit").Inc()
+		return account, nil
+	}
+	accountCacheRequests.WithLabelValues("miss").Inc()
+
+	account, err := s.Storage.GetAccountById(id)
+	if err != nil {
+		return nil, err
+	}
+	s.remember(account)
+	return account, nil
+}
+
+func (s *cachedStore) GetAccountByNumber(number int64) (*Account, error) {
+	if id, ok := s.idOf(number); ok {
+		if account, ok := s.cache.Get(id); ok {
+			accountCacheRequests.WithLabelValues("hit").Inc()
+			return account, nil
+		}
+	}
+	accountCacheRequests.WithLabelValues("miss").Inc()
+
+	account, err := s.Storage.GetAccountByNumber(number)
+	if err != nil {
+		return nil, err
+	}
+	s.remember(account)
+	return account, nil
+}
+
+// Primary bypasses the cache too, as it may lag behind just like a replica.
+func (s *cachedStore) Primary() Storage {
+	return s.Storage.Primary()
+}
+
+func (s *cachedStore) remember(account *Account) {
+	s.mu.Lock()
+	s.numbers[account.Number] = account.ID
+	s.mu.Unlock()
+
+	s.cache.Set(account)
+}
+
+func (s *cachedStore) idOf(number int64) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.numbers[number]
+	return id, ok
+}
+
+// forgetNumbers drops the cached accounts with the given numbers.
+func (s *cachedStore) forgetNumbers(numbers ...int64) {
+	for _, number := range numbers {
+		if id, ok := s.idOf(number); ok {
+			s.cache.Delete(id)
+		}
+	}
+}
+
+func (s *cachedStore) DeleteAccount(id int) error {
+	defer s.cache.Delete(id)
+	return s.Storage.DeleteAccount(id)
+}
+
+func (s *cachedStore) UpdateAccount(id int, account *UpdateAccountRequest) error {
+	defer s.cache.Delete(id)
+	return s.Storage.UpdateAccount(id, account)
+}
+
+func (s *cachedStore) Deposit(id int, amount Money) (*Account, error) {
+	defer s.cache.Delete(id)
+	return s.Storage.Deposit(id, amount)
+}
+
+func (s *cachedStore) Withdraw(id int, amount Money, labels TransactionLabels) (*Account, error) {
+	defer s.cache.Delete(id)
+	return s.Storage.Withdraw(id, amount, labels)
+}
+
+func (s *cachedStore) Transfer(fromID int, toNumber int64, amount Money, labels TransactionLabels) (Money, error) {
+	defer s.forgetNumbers(toNumber, s.feeAccount)
+	defer s.cache.Delete(fromID)
+	return s.Storage.Transfer(fromID, toNumber, amount, labels)
+}
+
+func (s *cachedStore) TransferBatch(fromID int, items []*BatchTransferItem) ([]*BatchTransferResult, error) {
+	defer s.forgetNumbers(s.feeAccount)
+	defer s.cache.Delete(fromID)
+	for _, item := range items {
+		defer s.forgetNumbers(item.ToAccount)
+	}
+	return s.Storage.TransferBatch(fromID, items)
+}
+
+func (s *cachedStore) CreatePendingTransfer(fromID int, toNumber int64, amount Money, labels TransactionLabels, ttl time.Duration) (*PendingTransfer, error) {
+	defer s.cache.Delete(fromID)
+	return s.Storage.CreatePendingTransfer(fromID, toNumber, amount, labels, ttl)
+}
+
+func (s *cachedStore) ConfirmTransfer(id, fromID int) (*PendingTransfer, error) {
+	transfer, err := s.Storage.ConfirmTransfer(id, fromID)
+	s.cache.Delete(fromID)
+	s.forgetNumbers(s.feeAccount)
+	if transfer != nil {
+		s.forgetNumbers(transfer.ToAccount)
+	}
+	return transfer, err
+}
+
+func (s *cachedStore) ReverseTransfer(transactionID int) (*Transaction, error) {
+	defer s.cache.Purge()
+	return s.Storage.ReverseTransfer(transactionID)
+}
+
+func (s *cachedStore) ExpirePendingTransfers() (int, error) {
+	defer s.cache.Purge()
+	return s.Storage.ExpirePendingTransfers()
+}
+
+func (s *cachedStore) AccrueInterest(day time.Time) (int, error) {
+	defer s.cache.Purge()
+	return s.Storage.AccrueInterest(day)
+}
+
+func (s *cachedStore) UpdateAccountStatus(id int, from, to AccountStatus) (*Account, error) {
+	defer s.cache.Delete(id)
+	return s.Storage.UpdateAccountStatus(id, from, to)
+}
+
+func (s *cachedStore) TransferOwnership(id int, holder *TransferOwnershipRequest, encryptedPassword string, actorID int) (*Account, error) {
+	defer s.cache.Delete(id)
+	return s.Storage.TransferOwnership(id, holder, encryptedPassword, actorID)
+}
+
+func (s *cachedStore) CloseAccount(id int, sweepTo int64) (*Account, error) {
+	defer s.forgetNumbers(sweepTo)
+	defer s.cache.Delete(id)
+	return s.Storage.CloseAccount(id, sweepTo)
+}
+
+func (s *cachedStore) CloseDormantAccounts(inactiveSince time.Time, dryRun bool, actorID int) (int, error) {
+	defer s.cache.Purge()
+	return s.Storage.CloseDormantAccounts(inactiveSince, dryRun, actorID)
+}
+
+func (s *cachedStore) VerifyEmail(tokenHash string) (*Account, error) {
+	account, err := s.Storage.VerifyEmail(tokenHash)
+	if account != nil {
+		s.cache.Delete(account.ID)
+	}
+	return account, err
+}
+
+// RevokeTokens and ChangePassword change every account of the customer, whose
+// ids the cache doesn't know.
+func (s *cachedStore) RevokeTokens(accountID int) error {
+	defer s.cache.Purge()
+	return s.Storage.RevokeTokens(accountID)
+}
+
+func (s *cachedStore) ChangePassword(accountID int, encryptedPassword string) (*Account, error) {
+	defer s.cache.Purge()
+	return s.Storage.ChangePassword(accountID, encryptedPassword)
+}
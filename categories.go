@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// checkCategory rejects categories that aren't configured. An empty category
+// means none.
+func (s *APIServer) checkCategory(category string) error {
+	if category == "" || slices.Contains(s.cfg.TransactionCategories, category) {
+		return nil
+	}
+	return &ValidationError{Fields: []FieldError{{
+		Field:   "category",
+		Message: "must be one of " + strings.Join(s.cfg.TransactionCategories, ", "),
+	}}}
+}
+
+// handleGetCategoryTotals handles GET requests for the totals of an account's
+// history by category, over the optional from/to dates of statements.
+func (s *APIServer) handleGetCategoryTotals(w http.ResponseWriter, r *http.Request) error {
+	filter, err := getStatementPeriod(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	totals, err := s.store.SumByCategory(r.Context(), account.ID, filter)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, totals)
+}
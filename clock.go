@@ -0,0 +1,17 @@
+package main
+
+import "time"
+
+// Clock tells the time. Everything that depends on the time of day reads it
+// through the Clock of the config rather than time.Now, so that tests can
+// stop it.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// fakeClock is a Clock for tests, which stands still until moved.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to now.
+func (c *fakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// accrualStore records the days interest is accrued for.
+type accrualStore struct {
+	Storage
+	days []time.Time
+}
+
+func (s *accrualStore) AccrueInterest(day time.Time) (int, error) {
+	s.days = append(s.days, day)
+	return 0, nil
+}
+
+func TestInterestAccrualCreditsTheUTCDay(t *testing.T) {
+	// Late in the evening in New York is already the next day in UTC.
+	newYork := time.FixedZone("EST", -5*60*60)
+	clock := newFakeClock(time.Date(2024, 1, 31, 23, 30, 0, 0, newYork))
+	cfg := testConfig(t)
+	setClock(cfg, clock)
+	store := &accrualStore{}
+	s := NewAPIServer("", store, cfg)
+
+	// A done context stops the job after its first round.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.runInterestAccrual(ctx)
+	clock.Advance(24 * time.Hour)
+	s.runInterestAccrual(ctx)
+
+	want := []time.Time{
+		time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2024, 2, 2, 0, 0, 0, 0, time.UTC),
+	}
+	if len(store.days) != len(want) || !store.days[0].Equal(want[0]) || !store.days[1].Equal(want[1]) {
+		t.Errorf("accrued interest for %v, want %v", store.days, want)
+	}
+}
+
+// scheduleStore keeps the scheduled transfers created for its accounts.
+type scheduleStore struct {
+	accountsStore
+	created *ScheduledTransfer
+}
+
+func (s *scheduleStore) CreateScheduledTransfer(st *ScheduledTransfer) error {
+	s.created = st
+	return nil
+}
+
+func TestScheduledTransferStartsAfterTheClock(t *testing.T) {
+	now := time.Date(2024, 1, 31, 9, 30, 0, 0, time.UTC)
+	cfg := testConfig(t)
+	setClock(cfg, newFakeClock(now))
+	store := &scheduleStore{accountsStore: accountsStore{accounts: []*Account{
+		{ID: 1, Number: 79927398713, EmailVerified: true},
+		{ID: 2, Number: 49927398716},
+	}}}
+	s := NewAPIServer("", store, cfg)
+	router := mux.NewRouter()
+	router.Handle("/account/{id}/scheduled-transfers", s.makeHTTPHandler(s.handleCreateScheduledTransfer))
+
+	request := func(nextRun time.Time) *httptest.ResponseRecorder {
+		body := `{"to_account":49927398716,"amount":"10.00","frequency":"monthly","next_run":"` + nextRun.Format(time.RFC3339) + `"}`
+		return serve(router, http.MethodPost, "/account/1/scheduled-transfers", "", strings.NewReader(body))
+	}
+
+	if rec := request(now.Add(-time.Minute)); rec.Code != http.StatusBadRequest {
+		t.Errorf("next run before the clock: got %d %s, want 400", rec.Code, rec.Body)
+	}
+
+	// Long past by the system clock, but not by the server's.
+	if rec := request(now.Add(time.Minute)); rec.Code >= 300 {
+		t.Fatalf("next run after the clock: got %d %s, want it created", rec.Code, rec.Body)
+	}
+	if store.created == nil || !store.created.CreatedAt.Equal(now) {
+		t.Errorf("created %+v, want it created at %s", store.created, now)
+	}
+}
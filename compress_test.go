@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// gzipGet serves a GET request accepting encoding to a handler writing body
+// in chunks of chunk bytes with contentType.
+func gzipGet(t *testing.T, encoding, contentType string, body []byte, chunk int) *httptest.ResponseRecorder {
+	t.Helper()
+
+	handler := withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusCreated)
+		for rest := body; len(rest) > 0; {
+			n := min(chunk, len(rest))
+			if _, err := w.Write(rest[:n]); err != nil {
+				t.Error(err)
+			}
+			rest = rest[n:]
+		}
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if encoding != "" {
+		req.Header.Set("Accept-Encoding", encoding)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	body := []byte(`[` + strings.Repeat(`{"first_name":"Ada","last_name":"Lovelace"},`, 100) + `{}]`)
+
+	// Also written in chunks smaller than the threshold, so that the
+	// decision is made halfway.
+	for _, chunk := range []int{len(body), 100} {
+		rec := gzipGet(t, "deflate, gzip;q=0.8", "application/json", body, chunk)
+		if rec.Code != http.StatusCreated || rec.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("chunks of %d: got %d encoded %q, want 201 gzip", chunk, rec.Code, rec.Header().Get("Content-Encoding"))
+		}
+		if rec.Body.Len() >= len(body) {
+			t.Errorf("chunks of %d: %d compressed bytes for %d", chunk, rec.Body.Len(), len(body))
+		}
+
+		gz, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(gz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("chunks of %d: decompressed %q, want %q", chunk, got, body)
+		}
+	}
+}
+
+func TestGzipSkipsWhatItShouldnt(t *testing.T) {
+	large := bytes.Repeat([]byte("a"), 2*gzipMinSize)
+	tests := []struct {
+		name        string
+		encoding    string
+		contentType string
+		body        []byte
+	}{
+		{"not accepted", "", "application/json", large},
+		{"refused", "gzip;q=0, deflate", "application/json", large},
+		{"small", "gzip", "application/json", []byte(`{"ok":true}`)},
+		{"already compressed", "gzip", "application/pdf", large},
+	}
+	for _, tt := range tests {
+		rec := gzipGet(t, tt.encoding, tt.contentType, tt.body, len(tt.body))
+		if rec.Code != http.StatusCreated || rec.Header().Get("Content-Encoding") != "" || !bytes.Equal(rec.Body.Bytes(), tt.body) {
+			t.Errorf("%s: got %d encoded %q, want the body as it is", tt.name, rec.Code, rec.Header().Get("Content-Encoding"))
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%s: Vary %q, want Accept-Encoding", tt.name, got)
+		}
+	}
+}
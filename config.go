@@ -0,0 +1,659 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Environment selects between the lenient defaults convenient while
+// developing and the stricter ones production needs.
+type Environment string
+
+const (
+	EnvDevelopment Environment = "development"
+	EnvProduction  Environment = "production"
+)
+
+// Config holds the settings read from the environment at startup.
+type Config struct {
+	// Env is the environment the server runs in. In production, internal
+	// error details are logged instead of returned to clients, DATABASE_URL
+	// must be set and request bodies must declare their Content-Type.
+	Env Environment
+
+	// Clock tells the time to everything that depends on it, so tests can
+	// replace the system clock.
+	Clock Clock
+
+	// TokenKeys signs and verifies the API tokens.
+	TokenKeys *TokenKeys
+
+	// RateLimiter bounds how many requests a client may make, or is nil when
+	// rate limiting is disabled.
+	RateLimiter RateLimiter
+
+	// AccountCreationLimiter bounds how many accounts a client may open, or
+	// is nil when unlimited. It applies on top of RateLimiter.
+	AccountCreationLimiter RateLimiter
+
+	// AccountNumberFormat is the length and prefix of new account numbers.
+	// Existing accounts keep their numbers.
+	AccountNumberFormat AccountNumberFormat
+
+	// PasswordPolicy is what new passwords must satisfy.
+	PasswordPolicy PasswordPolicy
+	// BcryptCost is the work factor of password hashes. Every step up doubles
+	// the time a hash takes, for logins and attackers alike: the default of
+	// 10 takes around 80ms on one core, 12 around 300ms. Tests can go down
+	// to 4.
+	BcryptCost int
+
+	// PublicURL is where clients reach the API, used for the links in emails.
+	PublicURL string
+	// EmailVerificationTTL is how long the link of a verification email works.
+	EmailVerificationTTL time.Duration
+
+	// SMTPHost is the mail server emails are sent through, over STARTTLS when
+	// it supports it. Without one, emails are only logged. SMTPUsername and
+	// SMTPPassword authenticate with PLAIN auth when set.
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUsername string
+	SMTPPassword string
+	// SMTPFrom is the sender address of emails.
+	SMTPFrom string
+	// StatementEmailPollInterval is how often statements queued for email are
+	// looked for.
+	StatementEmailPollInterval time.Duration
+
+	// LoginMaxFailures consecutive failed logins lock an account for
+	// LoginLockout.
+	LoginMaxFailures int
+	LoginLockout     time.Duration
+
+	// TOTPEncryptionKey encrypts the TOTP secrets at rest. Two-factor
+	// authentication is unavailable without it.
+	TOTPEncryptionKey []byte
+
+	// ListenAddress is the host:port the API is served on.
+	ListenAddress string
+	// AllowMissingContentType accepts request bodies without a Content-Type
+	// header, for clients that don't send one.
+	AllowMissingContentType bool
+	// LogBodies logs the bodies of every request and response, with
+	// credentials redacted. Meant for debugging only.
+	LogBodies bool
+	// CORSAllowedOrigins may call the API from browsers, e.g.
+	// "https://app.example.com", or any origin with "*". Routes that move
+	// money or credentials are only open to CORSTrustedOrigins, which are
+	// also the only origins allowed to send credentials. Preflight responses
+	// are cached for CORSMaxAge.
+	CORSAllowedOrigins []string
+	CORSTrustedOrigins []string
+	CORSMaxAge         time.Duration
+	// ShutdownTimeout is how long in-flight requests may take to complete
+	// once a shutdown signal is received.
+	ShutdownTimeout time.Duration
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout and IdleTimeout bound how
+	// long a client may take to send its headers, to send its whole request,
+	// to be sent the response and to keep an idle connection open, so that
+	// slow clients can't hold connections forever. WriteTimeout counts from
+	// the end of the request headers and must leave time for the largest
+	// statements and exports to stream.
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// DatabaseURL is the lib/pq connection string of the Postgres database.
+	DatabaseURL string
+	// DBReplicaURL is the connection string of a read replica that serves
+	// account and transaction reads. Empty means reading from the primary.
+	DBReplicaURL string
+
+	// DBMaxOpenConns, DBMaxIdleConns and DBConnMaxLifetime size the database
+	// connection pool. Zero open connections means unlimited.
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	// AccountCacheSize is how many accounts are cached in process, each for
+	// AccountCacheTTL. Zero disables the cache.
+	AccountCacheSize int
+	AccountCacheTTL  time.Duration
+
+	// DBRetryAttempts is how many times a transaction failing with a
+	// serialization failure or deadlock is attempted, starting with a delay
+	// of DBRetryDelay and doubling it every time.
+	DBRetryAttempts int
+	DBRetryDelay    time.Duration
+
+	// MinBalances is the lowest balance each account type may be left with
+	// after a withdrawal or transfer. Negative values allow an overdraft.
+	MinBalances map[AccountType]Money
+
+	// MinOpeningDeposits is the lowest initial deposit each account type may
+	// be opened with.
+	MinOpeningDeposits map[AccountType]Money
+
+	// DailyTransferLimits caps the total each account type may send by
+	// transfer per UTC day. Zero means no limit.
+	DailyTransferLimits map[AccountType]Money
+
+	// TransferApprovalThreshold is the amount from which a transfer is only
+	// executed once confirmed; until then it's held on the source account for
+	// at most PendingTransferTTL. Zero disables confirmations. It may not
+	// exceed a daily transfer limit.
+	TransferApprovalThreshold Money
+	PendingTransferTTL        time.Duration
+
+	// TransactionCategories are the categories holders may file withdrawals
+	// and transfers under.
+	TransactionCategories []string
+
+	// TransferFees are charged to senders on top of every transfer.
+	TransferFees FeeSchedule
+
+	// MetricsAddress, when set, serves /metrics on a separate listener
+	// instead of the main API router.
+	MetricsAddress string
+
+	// SchedulePollInterval is how often due scheduled transfers are looked for.
+	SchedulePollInterval time.Duration
+	// ScheduleRetryDelay is how long a failed scheduled transfer waits before
+	// it is attempted again.
+	ScheduleRetryDelay time.Duration
+	// ScheduleMaxRetries is how many times a failed run is retried before
+	// that occurrence is skipped and the schedule moves on to the next one.
+	ScheduleMaxRetries int
+
+	// DormantDays is how many days without ledger activity make an empty
+	// account dormant, unless the cleanup request says otherwise.
+	DormantDays int
+
+	// InterestRates is the annual interest rate given to new accounts of each
+	// type, e.g. 0.02 for 2%. Interest accrues daily.
+	InterestRates map[AccountType]float64
+	// InterestAccrualInterval is how often the interest job checks for
+	// accounts that haven't been credited for the current day yet.
+	InterestAccrualInterval time.Duration
+
+	// FXRates are the exchange rates used for transfers between accounts of
+	// different currencies, keyed by "FROM/TO".
+	FXRates map[string]float64
+
+	// WebhookPollInterval is how often the outbox is read for new events, up
+	// to WebhookBatchSize at a time.
+	WebhookPollInterval time.Duration
+	WebhookBatchSize    int
+	// WebhookMaxAttempts is how many times a delivery is tried, waiting
+	// WebhookRetryDelay before the first retry and doubling it every time.
+	WebhookMaxAttempts int
+	WebhookRetryDelay  time.Duration
+
+	// TLSCertFile and TLSKeyFile, when both set, make the server speak HTTPS
+	// instead of plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+}
+
+// defaultTransactionCategories is the comma separated list of categories used
+// unless TRANSACTION_CATEGORIES is set.
+const defaultTransactionCategories = "groceries,dining,rent,utilities,transport,health,entertainment,shopping,salary,savings,other"
+
+// LoadConfig reads the configuration from the environment, applying defaults
+// for anything that isn't set.
+func LoadConfig() (*Config, error) {
+	checking, err := envMoney("MIN_BALANCE_CHECKING", -10000)
+	if err != nil {
+		return nil, err
+	}
+
+	savings, err := envMoney("MIN_BALANCE_SAVINGS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	checkingOpening, err := envMoney("MIN_OPENING_DEPOSIT_CHECKING", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	savingsOpening, err := envMoney("MIN_OPENING_DEPOSIT_SAVINGS", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	checkingLimit, err := envMoney("DAILY_TRANSFER_LIMIT_CHECKING", 500000)
+	if err != nil {
+		return nil, err
+	}
+
+	savingsLimit, err := envMoney("DAILY_TRANSFER_LIMIT_SAVINGS", 100000)
+	if err != nil {
+		return nil, err
+	}
+
+	env := Environment(envString("APP_ENV", string(EnvDevelopment)))
+	if env != EnvDevelopment && env != EnvProduction {
+		return nil, fmt.Errorf("APP_ENV must be %s or %s, got %q", EnvDevelopment, EnvProduction, env)
+	}
+
+	cfg := &Config{
+		Env:          env,
+		Clock:        realClock{},
+		DatabaseURL:  envString("DATABASE_URL", defaultDatabaseURL),
+		DBReplicaURL: envString("DB_REPLICA_URL", ""),
+		MinBalances: map[AccountType]Money{
+			AccountTypeChecking: checking,
+			AccountTypeSavings:  savings,
+		},
+		MinOpeningDeposits: map[AccountType]Money{
+			AccountTypeChecking: checkingOpening,
+			AccountTypeSavings:  savingsOpening,
+		},
+		DailyTransferLimits: map[AccountType]Money{
+			AccountTypeChecking: checkingLimit,
+			AccountTypeSavings:  savingsLimit,
+		},
+		MetricsAddress: os.Getenv("METRICS_ADDR"),
+		TLSCertFile:    os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:     os.Getenv("TLS_KEY_FILE"),
+	}
+
+	if env == EnvProduction && os.Getenv("DATABASE_URL") == "" {
+		return nil, fmt.Errorf("DATABASE_URL must be set in production")
+	}
+
+	if cfg.TokenKeys, err = loadTokenKeys(cfg.Clock); err != nil {
+		return nil, err
+	}
+
+	if cfg.RateLimiter, err = loadRateLimiter(cfg.Clock); err != nil {
+		return nil, err
+	}
+
+	if cfg.AccountCreationLimiter, err = loadAccountCreationLimiter(cfg.Clock); err != nil {
+		return nil, err
+	}
+
+	if cfg.ListenAddress, err = listenAddress(); err != nil {
+		return nil, err
+	}
+
+	if str := os.Getenv("TOTP_ENCRYPTION_KEY"); str != "" {
+		cfg.TOTPEncryptionKey, err = hex.DecodeString(str)
+		if err != nil || len(cfg.TOTPEncryptionKey) != 32 {
+			return nil, fmt.Errorf("TOTP_ENCRYPTION_KEY must be 64 hex characters (32 bytes)")
+		}
+	}
+
+	if cfg.AllowMissingContentType, err = envBool("ALLOW_MISSING_CONTENT_TYPE", env == EnvDevelopment); err != nil {
+		return nil, err
+	}
+
+	if cfg.LogBodies, err = envBool("LOG_BODIES", false); err != nil {
+		return nil, err
+	}
+
+	cfg.CORSAllowedOrigins = envList("CORS_ALLOWED_ORIGINS")
+	cfg.CORSTrustedOrigins = envList("CORS_TRUSTED_ORIGINS")
+	if slices.Contains(cfg.CORSTrustedOrigins, "*") {
+		return nil, fmt.Errorf("CORS_TRUSTED_ORIGINS must list origins, not *")
+	}
+	if cfg.CORSMaxAge, err = envDuration("CORS_MAX_AGE", 10*time.Minute); err != nil {
+		return nil, err
+	}
+
+	if cfg.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT", 15*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ReadHeaderTimeout, err = envDuration("READ_HEADER_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ReadTimeout, err = envDuration("READ_TIMEOUT", 15*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.WriteTimeout, err = envDuration("WRITE_TIMEOUT", 60*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.IdleTimeout, err = envDuration("IDLE_TIMEOUT", 120*time.Second); err != nil {
+		return nil, err
+	}
+	for name, timeout := range map[string]time.Duration{
+		"READ_HEADER_TIMEOUT": cfg.ReadHeaderTimeout,
+		"READ_TIMEOUT":        cfg.ReadTimeout,
+		"WRITE_TIMEOUT":       cfg.WriteTimeout,
+		"IDLE_TIMEOUT":        cfg.IdleTimeout,
+	} {
+		if timeout <= 0 {
+			return nil, fmt.Errorf("%s must be positive", name)
+		}
+	}
+
+	cfg.AccountNumberFormat.Prefix = envString("ACCOUNT_NUMBER_PREFIX", "")
+	if cfg.AccountNumberFormat.Digits, err = envInt("ACCOUNT_NUMBER_DIGITS", 8); err != nil {
+		return nil, err
+	}
+	if err := cfg.AccountNumberFormat.Validate(); err != nil {
+		return nil, fmt.Errorf("ACCOUNT_NUMBER_DIGITS and ACCOUNT_NUMBER_PREFIX: %w", err)
+	}
+
+	if cfg.PasswordPolicy, err = loadPasswordPolicy(); err != nil {
+		return nil, err
+	}
+	if cfg.BcryptCost, err = envInt("BCRYPT_COST", bcrypt.DefaultCost); err != nil {
+		return nil, err
+	}
+	if cfg.BcryptCost < bcrypt.MinCost || cfg.BcryptCost > bcrypt.MaxCost {
+		return nil, fmt.Errorf("BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	cfg.TransactionCategories = strings.Split(envString("TRANSACTION_CATEGORIES", defaultTransactionCategories), ",")
+	for i, category := range cfg.TransactionCategories {
+		cfg.TransactionCategories[i] = strings.TrimSpace(category)
+		if cfg.TransactionCategories[i] == "" || len(cfg.TransactionCategories[i]) > 50 {
+			return nil, fmt.Errorf("TRANSACTION_CATEGORIES must list categories of 1 to 50 characters, got %q", category)
+		}
+	}
+
+	cfg.PublicURL = strings.TrimSuffix(envString("PUBLIC_URL", "http://localhost:8080"), "/")
+	if cfg.EmailVerificationTTL, err = envDuration("EMAIL_VERIFICATION_TTL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+
+	cfg.SMTPHost = envString("SMTP_HOST", "")
+	if cfg.SMTPPort, err = envInt("SMTP_PORT", 587); err != nil {
+		return nil, err
+	}
+	cfg.SMTPUsername = envString("SMTP_USERNAME", "")
+	cfg.SMTPPassword = envString("SMTP_PASSWORD", "")
+	cfg.SMTPFrom = envString("SMTP_FROM", "no-reply@localhost")
+	if cfg.StatementEmailPollInterval, err = envDuration("STATEMENT_EMAIL_POLL_INTERVAL", 5*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.LoginMaxFailures, err = envInt("LOGIN_MAX_FAILURES", 5); err != nil {
+		return nil, err
+	}
+	if cfg.LoginMaxFailures == 0 {
+		return nil, fmt.Errorf("LOGIN_MAX_FAILURES must be at least 1")
+	}
+	if cfg.LoginLockout, err = envDuration("LOGIN_LOCKOUT", 15*time.Minute); err != nil {
+		return nil, err
+	}
+
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	if cfg.TransferApprovalThreshold, err = envMoney("TRANSFER_APPROVAL_THRESHOLD", 50000); err != nil {
+		return nil, err
+	}
+	// No transfer above a daily limit gets through to be held.
+	if threshold := cfg.TransferApprovalThreshold; threshold > 0 {
+		if checkingLimit > 0 && threshold > checkingLimit {
+			return nil, fmt.Errorf("TRANSFER_APPROVAL_THRESHOLD %s exceeds DAILY_TRANSFER_LIMIT_CHECKING %s", threshold, checkingLimit)
+		}
+		if savingsLimit > 0 && threshold > savingsLimit {
+			return nil, fmt.Errorf("TRANSFER_APPROVAL_THRESHOLD %s exceeds DAILY_TRANSFER_LIMIT_SAVINGS %s", threshold, savingsLimit)
+		}
+	}
+	if cfg.PendingTransferTTL, err = envDuration("PENDING_TRANSFER_TTL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+
+	if cfg.TransferFees, err = loadFeeSchedule(); err != nil {
+		return nil, err
+	}
+
+	if cfg.DBMaxOpenConns, err = envInt("DB_MAX_OPEN_CONNS", 25); err != nil {
+		return nil, err
+	}
+	if cfg.DBMaxIdleConns, err = envInt("DB_MAX_IDLE_CONNS", 25); err != nil {
+		return nil, err
+	}
+	if cfg.DBConnMaxLifetime, err = envDuration("DB_CONN_MAX_LIFETIME", 5*time.Minute); err != nil {
+		return nil, err
+	}
+
+	if cfg.AccountCacheSize, err = envInt("ACCOUNT_CACHE_SIZE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.AccountCacheTTL, err = envDuration("ACCOUNT_CACHE_TTL", 30*time.Second); err != nil {
+		return nil, err
+	}
+
+	if cfg.DBRetryAttempts, err = envInt("DB_RETRY_ATTEMPTS", 3); err != nil {
+		return nil, err
+	}
+	if cfg.DBRetryDelay, err = envDuration("DB_RETRY_DELAY", 50*time.Millisecond); err != nil {
+		return nil, err
+	}
+
+	if cfg.SchedulePollInterval, err = envDuration("SCHEDULE_POLL_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.ScheduleRetryDelay, err = envDuration("SCHEDULE_RETRY_DELAY", time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.ScheduleMaxRetries, err = envInt("SCHEDULE_MAX_RETRIES", 3); err != nil {
+		return nil, err
+	}
+
+	if cfg.DormantDays, err = envInt("DORMANT_DAYS", 365); err != nil {
+		return nil, err
+	}
+	if cfg.DormantDays < 1 {
+		return nil, fmt.Errorf("DORMANT_DAYS must be at least 1")
+	}
+
+	savingsRate, err := envFloat("INTEREST_RATE_SAVINGS", 0.01)
+	if err != nil {
+		return nil, err
+	}
+	cfg.InterestRates = map[AccountType]float64{
+		AccountTypeChecking: 0,
+		AccountTypeSavings:  savingsRate,
+	}
+	if cfg.InterestAccrualInterval, err = envDuration("INTEREST_ACCRUAL_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+
+	if cfg.FXRates, err = parseRates(os.Getenv("FX_RATES")); err != nil {
+		return nil, fmt.Errorf("FX_RATES: %w", err)
+	}
+
+	if cfg.WebhookPollInterval, err = envDuration("WEBHOOK_POLL_INTERVAL", time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.WebhookBatchSize, err = envInt("WEBHOOK_BATCH_SIZE", 100); err != nil {
+		return nil, err
+	}
+	if cfg.WebhookMaxAttempts, err = envInt("WEBHOOK_MAX_ATTEMPTS", 5); err != nil {
+		return nil, err
+	}
+	if cfg.WebhookRetryDelay, err = envDuration("WEBHOOK_RETRY_DELAY", time.Second); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// defaultDatabaseURL matches the database started by docker-compose.yml.
+const defaultDatabaseURL = "user=postgres dbname=postgres password=admin sslmode=disable"
+
+// listenAddress reads LISTEN_ADDR, or else PORT as set by hosting platforms,
+// defaulting to ":8080".
+func listenAddress() (string, error) {
+	key, addr := "LISTEN_ADDR", os.Getenv("LISTEN_ADDR")
+	if addr == "" {
+		addr = ":8080"
+		if port := os.Getenv("PORT"); port != "" {
+			key, addr = "PORT", ":"+port
+		}
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("%s: invalid address %q, expected host:port", key, addr)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("%s: invalid port %q", key, port)
+	}
+	return addr, nil
+}
+
+// loadFeeSchedule reads TRANSFER_FEE_FLAT, TRANSFER_FEE_PERCENT and the
+// FEE_ACCOUNT_NUMBER they are credited to, which is required once any fee is
+// set.
+func loadFeeSchedule() (FeeSchedule, error) {
+	var fees FeeSchedule
+	var err error
+
+	if fees.Flat, err = envMoney("TRANSFER_FEE_FLAT", 0); err != nil {
+		return fees, err
+	}
+	if fees.Flat < 0 {
+		return fees, fmt.Errorf("TRANSFER_FEE_FLAT must not be negative")
+	}
+	if fees.Percent, err = envFloat("TRANSFER_FEE_PERCENT", 0); err != nil {
+		return fees, err
+	}
+
+	account, err := envInt("FEE_ACCOUNT_NUMBER", 0)
+	if err != nil {
+		return fees, err
+	}
+	fees.Account = int64(account)
+
+	if (fees.Flat > 0 || fees.Percent > 0) && fees.Account == 0 {
+		return fees, fmt.Errorf("FEE_ACCOUNT_NUMBER must be set when transfer fees are")
+	}
+	return fees, nil
+}
+
+// loadPasswordPolicy reads PASSWORD_MIN_LENGTH and the PASSWORD_REQUIRE_*
+// flags, defaulting to 8 characters with upper and lowercase letters and a
+// digit.
+func loadPasswordPolicy() (PasswordPolicy, error) {
+	p := PasswordPolicy{MinLength: 8, RequireUpper: true, RequireLower: true, RequireDigit: true}
+	var err error
+
+	if p.MinLength, err = envInt("PASSWORD_MIN_LENGTH", p.MinLength); err != nil {
+		return p, err
+	}
+	if p.MinLength < 1 || p.MinLength > 72 {
+		return p, fmt.Errorf("PASSWORD_MIN_LENGTH must be between 1 and 72")
+	}
+	if p.RequireUpper, err = envBool("PASSWORD_REQUIRE_UPPER", p.RequireUpper); err != nil {
+		return p, err
+	}
+	if p.RequireLower, err = envBool("PASSWORD_REQUIRE_LOWER", p.RequireLower); err != nil {
+		return p, err
+	}
+	if p.RequireDigit, err = envBool("PASSWORD_REQUIRE_DIGIT", p.RequireDigit); err != nil {
+		return p, err
+	}
+	if p.RequireSymbol, err = envBool("PASSWORD_REQUIRE_SYMBOL", p.RequireSymbol); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+// envString reads a string from the environment.
+func envString(key, def string) string {
+	if str := os.Getenv(key); str != "" {
+		return str
+	}
+	return def
+}
+
+// envList reads a comma separated list from the environment, empty when unset.
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// envMoney reads a decimal amount such as "-100.00" from the environment.
+func envMoney(key string, def Money) (Money, error) {
+	str := os.Getenv(key)
+	if str == "" {
+		return def, nil
+	}
+
+	m, err := parseMoney(str)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return m, nil
+}
+
+// envInt reads a non-negative integer from the environment.
+func envInt(key string, def int) (int, error) {
+	str := os.Getenv(key)
+	if str == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: invalid number %q", key, str)
+	}
+	return n, nil
+}
+
+// envBool reads a boolean such as "true" or "0" from the environment.
+func envBool(key string, def bool) (bool, error) {
+	str := os.Getenv(key)
+	if str == "" {
+		return def, nil
+	}
+
+	b, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid boolean %q", key, str)
+	}
+	return b, nil
+}
+
+// envDuration reads a positive duration such as "30s" from the environment.
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	str := os.Getenv(key)
+	if str == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(str)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%s: invalid duration %q", key, str)
+	}
+	return d, nil
+}
+
+// envFloat reads a non-negative decimal number from the environment.
+func envFloat(key string, def float64) (float64, error) {
+	str := os.Getenv(key)
+	if str == "" {
+		return def, nil
+	}
+
+	f, err := strconv.ParseFloat(str, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%s: invalid number %q", key, str)
+	}
+	return f, nil
+}
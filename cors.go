@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// corsAllowedHeaders are the request headers browsers may send cross-origin.
+var corsAllowedHeaders = []string{"Authorization", "Content-Type", "Accept", "Accept-Language", "If-None-Match", requestIDHeader}
+
+// corsExposedHeaders are the response headers scripts of other origins may
+// read.
+var corsExposedHeaders = []string{"Link", "X-Total-Count", "Retry-After", "Content-Language", "ETag", requestIDHeader}
+
+// CORSPolicy says which other origins may call a route from a browser.
+type CORSPolicy struct {
+	// Origins may call the route, or any origin if it holds "*".
+	Origins []string
+	// CredentialOrigins may also send credentials, such as cookies or TLS
+	// client certificates. They must be in Origins too.
+	CredentialOrigins []string
+}
+
+// allows reports whether origin may call a route under the policy, and with
+// credentials.
+func (p *CORSPolicy) allows(origin string) (allowed, credentials bool) {
+	if !slices.Contains(p.Origins, origin) && !slices.Contains(p.Origins, "*") {
+		return false, false
+	}
+	return true, slices.Contains(p.CredentialOrigins, origin)
+}
+
+// corsPolicies picks the CORS policy of each route. A route in routes gets
+// its own policy for all its methods. Other routes get read for GET and HEAD
+// and write for the rest.
+type corsPolicies struct {
+	read   *CORSPolicy
+	write  *CORSPolicy
+	routes map[string]*CORSPolicy // by path template
+	maxAge time.Duration
+}
+
+// newCORSPolicies builds the policies of cfg. Read endpoints are open to
+// CORSAllowedOrigins, with credentials for CORSTrustedOrigins, and other
+// endpoints to CORSAllowedOrigins without credentials. The routes that move
+// money or credentials are only open to CORSTrustedOrigins.
+func newCORSPolicies(cfg *Config) *corsPolicies {
+	trusted := &CORSPolicy{Origins: cfg.CORSTrustedOrigins, CredentialOrigins: cfg.CORSTrustedOrigins}
+
+	return &corsPolicies{
+		read:  &CORSPolicy{Origins: cfg.CORSAllowedOrigins, CredentialOrigins: cfg.CORSTrustedOrigins},
+		write: &CORSPolicy{Origins: cfg.CORSAllowedOrigins},
+		routes: map[string]*CORSPolicy{
+			"/login":                            trusted,
+			"/transfer":                         trusted,
+			"/transfers/batch":                  trusted,
+			"/transfer/{transferID}/confirm":    trusted,
+			"/transfer/{transactionID}/reverse": trusted,
+			"/account/{id}/withdraw":            trusted,
+			"/account/{id}/close":               trusted,
+			"/account/{id}/change-password":     trusted,
+			"/account/{id}/logout-all":          trusted,
+			"/account/{id}/transfer-ownership":  trusted,
+			"/account/{id}/2fa/enable":          trusted,
+			"/account/{id}/2fa/verify":          trusted,
+			"/account/{id}/scheduled-transfers": trusted,
+		},
+		maxAge: cfg.CORSMaxAge,
+	}
+}
+
+// policy returns the policy of r, requested with method, and whether any
+// route matches it at all.
+func (p *corsPolicies) policy(router *mux.Router, r *http.Request, method string) (*CORSPolicy, bool) {
+	req := r.Clone(r.Context())
+	req.Method = method
+
+	var match mux.RouteMatch
+	if !router.Match(req, &match) || match.MatchErr != nil {
+		return nil, false
+	}
+
+	if template, err := match.Route.GetPathTemplate(); err == nil {
+		if policy, ok := p.routes[template]; ok {
+			return policy, true
+		}
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return p.read, true
+	}
+	return p.write, true
+}
+
+// withCORS answers the CORS preflight requests for the routes of router and
+// adds the CORS headers to the responses of cross-origin requests, following
+// policies. Origins a policy doesn't allow get no CORS headers, which lets
+// browsers block them; the request itself is still served, as to any other
+// client. It wraps router rather than being one of its middlewares, since
+// preflight OPTIONS requests match no route.
+func withCORS(router *mux.Router, policies *corsPolicies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			router.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+
+		requestedMethod := r.Header.Get("Access-Control-Request-Method")
+		preflight := r.Method == http.MethodOptions && requestedMethod != ""
+		if !preflight {
+			if policy, ok := policies.policy(router, r, r.Method); ok {
+				if allowed, credentials := policy.allows(origin); allowed {
+					setCORSOrigin(w, origin, credentials)
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+				}
+			}
+			router.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Access-Control-Request-Method")
+		w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+		policy, ok := policies.policy(router, r, requestedMethod)
+		if !ok {
+			handleRouteNotFound(w, r)
+			return
+		}
+		if allowed, credentials := policy.allows(origin); allowed {
+			setCORSOrigin(w, origin, credentials)
+			w.Header().Set("Access-Control-Allow-Methods", requestedMethod)
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(policies.maxAge.Seconds())))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// setCORSOrigin allows origin. It is echoed rather than answered with "*",
+// which browsers reject along with credentials.
+func setCORSOrigin(w http.ResponseWriter, origin string, credentials bool) {
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
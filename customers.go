@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// CreateWalletRequest opens another account for the authenticated customer.
+// The holder's name and password are those of the account the token was
+// issued to.
+type CreateWalletRequest struct {
+	Type     AccountType `json:"account_type" validate:"omitempty,oneof=checking savings"` // defaults to checking
+	Currency string      `json:"currency" validate:"omitempty,iso4217"`                    // defaults to DefaultCurrency
+}
+
+// getCustomerID reads the {customerID} route variable.
+func getCustomerID(r *http.Request) (int, error) {
+	idStr := mux.Vars(r)["customerID"]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid customer ID: %s", idStr)
+	}
+	return id, nil
+}
+
+// authorizeCustomer returns the {customerID} of the request, which must be
+// the customer of the authenticated account unless it is an admin's.
+func authorizeCustomer(r *http.Request, account *Account) (int, error) {
+	customerID, err := getCustomerID(r)
+	if err != nil {
+		return 0, err
+	}
+	if customerID != account.CustomerID && !account.IsAdmin {
+		return 0, ErrPermissionDenied
+	}
+	return customerID, nil
+}
+
+// handleGetCustomerAccounts handles GET requests for all the accounts of a
+// customer.
+func (s *APIServer) handleGetCustomerAccounts(w http.ResponseWriter, r *http.Request) error {
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	customerID, err := authorizeCustomer(r, account)
+	if err != nil {
+		return err
+	}
+
+	accounts, err := s.store.GetAccountsByCustomer(r.Context(), customerID)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]*AccountResponse, len(accounts))
+	for i, a := range accounts {
+		resp[i] = toAccountResponse(a)
+	}
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// handleCreateWallet handles POST requests for opening another account for
+// the authenticated customer. Wallets open empty with the holder's name and
+// password, and without an email address, which stays with the account the
+// customer signed up with. Whether it is verified carries over.
+func (s *APIServer) handleCreateWallet(w http.ResponseWriter, r *http.Request) error {
+	holder, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	customerID, err := getCustomerID(r)
+	if err != nil {
+		return err
+	}
+	if customerID != holder.CustomerID {
+		return ErrPermissionDenied
+	}
+
+	req := &CreateWalletRequest{}
+	if err := decodeAndValidate(w, r, req); err != nil {
+		return err
+	}
+
+	account := &Account{
+		CustomerID:        holder.CustomerID,
+		FirstName:         holder.FirstName,
+		LastName:          holder.LastName,
+		EncryptedPassword: holder.EncryptedPassword,
+		EmailVerified:     holder.EmailVerified,
+		Number:            s.cfg.AccountNumberFormat.newNumber(),
+		Currency:          DefaultCurrency,
+		Type:              AccountTypeChecking,
+		Status:            AccountStatusActive,
+	}
+	if req.Type != "" {
+		account.Type = req.Type
+	}
+	if req.Currency != "" {
+		account.Currency = req.Currency
+	}
+
+	if err := s.store.CreateAccount(account); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusCreated, toAccountResponse(account))
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// docsFS holds the hand-written OpenAPI description and the Swagger UI page.
+//
+//go:embed docs/openapi.json docs/index.html
+var docsFS embed.FS
+
+func handleOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	spec, err := docsFS.ReadFile("docs/openapi.json")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(spec)
+}
+
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	page, err := docsFS.ReadFile("docs/index.html")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
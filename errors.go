@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// ErrRouteNotFound is returned for requests to a path the API doesn't serve.
+var ErrRouteNotFound = errors.New("route not found")
+
+// ErrMethodNotAllowed is returned for requests to a path the API serves, but
+// not with the method of the request.
+var ErrMethodNotAllowed = errors.New("method not allowed")
+
+// ErrorCode is a stable, machine readable identifier of a failure. Clients
+// branch on the code; the message is for humans and may change.
+type ErrorCode string
+
+const (
+	CodeBadRequest                ErrorCode = "BAD_REQUEST"
+	CodeValidationFailed          ErrorCode = "VALIDATION_FAILED"
+	CodeInvalidCredentials        ErrorCode = "INVALID_CREDENTIALS"
+	CodeTokenExpired              ErrorCode = "TOKEN_EXPIRED"
+	CodeTOTPRequired              ErrorCode = "TOTP_REQUIRED"
+	CodeTwoFactorEnabled          ErrorCode = "TWO_FACTOR_ENABLED"
+	CodePermissionDenied          ErrorCode = "PERMISSION_DENIED"
+	CodeAccountLocked             ErrorCode = "ACCOUNT_LOCKED"
+	CodeAccountNotFound           ErrorCode = "ACCOUNT_NOT_FOUND"
+	CodeAccountFrozen             ErrorCode = "ACCOUNT_FROZEN"
+	CodeAccountClosed             ErrorCode = "ACCOUNT_CLOSED"
+	CodeEmailTaken                ErrorCode = "EMAIL_TAKEN"
+	CodeEmailNotVerified          ErrorCode = "EMAIL_NOT_VERIFIED"
+	CodeEmailAlreadyVerified      ErrorCode = "EMAIL_ALREADY_VERIFIED"
+	CodeInvalidVerificationToken  ErrorCode = "INVALID_VERIFICATION_TOKEN"
+	CodeStaleUpdate               ErrorCode = "STALE_UPDATE"
+	CodeNonZeroBalance            ErrorCode = "NON_ZERO_BALANCE"
+	CodeScheduledTransfersPending ErrorCode = "SCHEDULED_TRANSFERS_PENDING"
+	CodePendingTransfers          ErrorCode = "PENDING_TRANSFERS"
+	CodeTransferNotFound          ErrorCode = "TRANSFER_NOT_FOUND"
+	CodeTransferNotPending        ErrorCode = "TRANSFER_NOT_PENDING"
+	CodeTransactionNotFound       ErrorCode = "TRANSACTION_NOT_FOUND"
+	CodeAlreadyReversed           ErrorCode = "ALREADY_REVERSED"
+	CodeInsufficientFunds         ErrorCode = "INSUFFICIENT_FUNDS"
+	CodeDailyLimitExceeded        ErrorCode = "DAILY_LIMIT_EXCEEDED"
+	CodeBodyTooLarge              ErrorCode = "BODY_TOO_LARGE"
+	CodeRateLimited               ErrorCode = "RATE_LIMITED"
+	CodeUnsupportedMediaType      ErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	CodeRouteNotFound             ErrorCode = "ROUTE_NOT_FOUND"
+	CodeMethodNotAllowed          ErrorCode = "METHOD_NOT_ALLOWED"
+	CodeInternal                  ErrorCode = "INTERNAL_ERROR"
+)
+
+// ApiError is the body of every error response.
+type ApiError struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code    ErrorCode              `json:"code"`
+	Message string                 `json:"message"`
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// detailer is implemented by errors that carry structured context, such as
+// the amounts involved in a rejected transfer.
+type detailer interface {
+	Details() map[string]interface{}
+}
+
+// ErrBatchItemRequired is the error of the items of a batch that are null.
+var ErrBatchItemRequired = errors.New("is required")
+
+// BatchItemError reports the item of a batch request that made the whole
+// batch fail. It matches whatever the item's own error matches.
+type BatchItemError struct {
+	Index int
+	Err   error
+}
+
+func (e *BatchItemError) Error() string {
+	if e.Err == ErrBatchItemRequired {
+		return fmt.Sprintf("item %d is required", e.Index)
+	}
+	return fmt.Sprintf("item %d: %v", e.Index, e.Err)
+}
+
+func (e *BatchItemError) Unwrap() error {
+	return e.Err
+}
+
+func (e *BatchItemError) Details() map[string]interface{} {
+	details := map[string]interface{}{"index": e.Index}
+
+	var d detailer
+	if errors.As(e.Err, &d) {
+		for k, v := range d.Details() {
+			details[k] = v
+		}
+	}
+	return details
+}
+
+// errorMappings lists the errors with a dedicated status and code, matched
+// with errors.Is in order. Anything else is a Bad Request.
+var errorMappings = []struct {
+	target error
+	status int
+	code   ErrorCode
+}{
+	{ErrValidation, http.StatusBadRequest, CodeValidationFailed},
+	{ErrInvalidCredentials, http.StatusUnauthorized, CodeInvalidCredentials},
+	{ErrAccountLocked, http.StatusLocked, CodeAccountLocked},
+	{ErrTOTPRequired, http.StatusUnauthorized, CodeTOTPRequired},
+	{ErrTwoFactorEnabled, http.StatusConflict, CodeTwoFactorEnabled},
+	{ErrPermissionDenied, http.StatusForbidden, CodePermissionDenied},
+	{ErrAccountNotFound, http.StatusNotFound, CodeAccountNotFound},
+	{ErrAccountFrozen, http.StatusForbidden, CodeAccountFrozen},
+	{ErrAccountClosed, http.StatusForbidden, CodeAccountClosed},
+	{ErrEmailTaken, http.StatusConflict, CodeEmailTaken},
+	{ErrEmailNotVerified, http.StatusForbidden, CodeEmailNotVerified},
+	{ErrEmailAlreadyVerified, http.StatusConflict, CodeEmailAlreadyVerified},
+	{ErrInvalidVerificationToken, http.StatusBadRequest, CodeInvalidVerificationToken},
+	{ErrStaleUpdate, http.StatusConflict, CodeStaleUpdate},
+	{ErrNonZeroBalance, http.StatusConflict, CodeNonZeroBalance},
+	{ErrScheduledTransfersPending, http.StatusConflict, CodeScheduledTransfersPending},
+	{ErrPendingTransfers, http.StatusConflict, CodePendingTransfers},
+	{ErrTransferNotFound, http.StatusNotFound, CodeTransferNotFound},
+	{ErrTransferNotPending, http.StatusConflict, CodeTransferNotPending},
+	{ErrTransactionNotFound, http.StatusNotFound, CodeTransactionNotFound},
+	{ErrAlreadyReversed, http.StatusConflict, CodeAlreadyReversed},
+	{ErrInsufficientFunds, http.StatusUnprocessableEntity, CodeInsufficientFunds},
+	{ErrDailyLimitExceeded, http.StatusUnprocessableEntity, CodeDailyLimitExceeded},
+	{ErrUnsupportedMediaType, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType},
+	{ErrRateLimited, http.StatusTooManyRequests, CodeRateLimited},
+	{ErrRouteNotFound, http.StatusNotFound, CodeRouteNotFound},
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed, CodeMethodNotAllowed},
+}
+
+// newAPIError builds the response body for err.
+func newAPIError(code ErrorCode, err error) ApiError {
+	body := ErrorBody{Code: code, Message: err.Error()}
+
+	var d detailer
+	if errors.As(err, &d) {
+		body.Details = d.Details()
+	}
+
+	return ApiError{Error: body}
+}
+
+// errorResponse picks the HTTP status and body for an error returned by a
+// handler.
+func errorResponse(err error) (int, ApiError) {
+	for _, m := range errorMappings {
+		if errors.Is(err, m.target) {
+			return m.status, newAPIError(m.code, err)
+		}
+	}
+
+	if errors.As(err, new(*http.MaxBytesError)) {
+		return http.StatusRequestEntityTooLarge, newAPIError(CodeBodyTooLarge, err)
+	}
+
+	if isInternalError(err) {
+		return http.StatusInternalServerError, newAPIError(CodeInternal, err)
+	}
+
+	return http.StatusBadRequest, newAPIError(CodeBadRequest, err)
+}
+
+// isInternalError reports whether err is the server's fault rather than the
+// client's, such as a failing database. Its message may reveal internals.
+func isInternalError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, new(*pq.Error)) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, sql.ErrTxDone) ||
+		errors.Is(err, driver.ErrBadConn)
+}
+
+// writeError writes the error response for err, in the language the client
+// of r prefers.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, apiErr := errorResponse(err)
+	localizeError(w, r, &apiErr)
+	WriteJSON(w, status, apiErr)
+}
+
+// handleRouteNotFound answers requests no route matched in the same JSON as
+// every other error.
+func handleRouteNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, fmt.Errorf("%w: %s %s", ErrRouteNotFound, r.Method, r.URL.Path))
+}
+
+// methodNotAllowedHandler answers requests whose path matched a route of
+// router, but not its methods, in the same JSON as every other error. The
+// Allow header lists the methods the path does accept.
+func methodNotAllowedHandler(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var allowed []string
+		router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+			methods, err := route.GetMethods()
+			if err != nil {
+				return nil
+			}
+			for _, method := range methods {
+				if slices.Contains(allowed, method) {
+					continue
+				}
+				req := r.Clone(r.Context())
+				req.Method = method
+				if route.Match(req, &mux.RouteMatch{}) {
+					allowed = append(allowed, method)
+				}
+			}
+			return nil
+		})
+
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, r, fmt.Errorf("%w: %s %s", ErrMethodNotAllowed, r.Method, r.URL.Path))
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// accountETag is the ETag of an account, which changes with any of its fields,
+// updated_at included. It is weak, as the bytes sent also depend on the format
+// and compression the client asked for.
+func accountETag(account *AccountResponse) (string, error) {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return `W/"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// notModified reports whether the If-None-Match header of r names etag, so
+// that the client's copy is still current. Tags are compared weakly, as GET
+// and HEAD requests allow.
+func notModified(r *http.Request, etag string) bool {
+	header := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if header == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAccountValidators sets the ETag of account and has caches revalidate it
+// on every use. It reports whether the request was conditional on a copy that
+// is still current, in which case 304 Not Modified has been written.
+func writeAccountValidators(w http.ResponseWriter, r *http.Request, account *AccountResponse) (bool, error) {
+	etag, err := accountETag(account)
+	if err != nil {
+		return false, err
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if notModified(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccountETagFlow(t *testing.T) {
+	cfg := testConfig(t)
+	account := &Account{ID: 1, CustomerID: 1, Number: 79927398713, Balance: 12_34, TokenVersion: 1,
+		UpdatedAt: NewTimestamp(time.Date(2024, 1, 31, 9, 30, 0, 0, time.UTC))}
+	routes := NewAPIServer("", &accountsStore{accounts: []*Account{account}}, cfg).routes()
+	token, err := createJWTToken(account, cfg.TokenKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(method, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/account/1", nil)
+		req.Header.Set("Authorization", token)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get(http.MethodGet, "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || first.Body.Len() == 0 {
+		t.Fatalf("first GET: got %d with ETag %q, want 200 with one", first.Code, etag)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		rec := get(method, etag)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 || rec.Header().Get("ETag") != etag {
+			t.Errorf("%s with the current ETag: got %d %q with ETag %q, want an empty 304", method, rec.Code, rec.Body, rec.Header().Get("ETag"))
+		}
+	}
+	if rec := get(http.MethodGet, `"other", `+strings.TrimPrefix(etag, "W/")); rec.Code != http.StatusNotModified {
+		t.Errorf("GET with the ETag in a list, compared weakly: got %d, want 304", rec.Code)
+	}
+
+	// Once the account changes, the old copy is stale.
+	account.Balance = 10_00
+	account.UpdatedAt = NewTimestamp(account.UpdatedAt.Add(time.Second))
+	rec := get(http.MethodGet, etag)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+		t.Errorf("GET after a change: got %d with ETag %q, want 200 with a new one", rec.Code, rec.Header().Get("ETag"))
+	}
+}
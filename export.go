@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// exportSchemaVersion identifies the layout of account exports. It is bumped
+// whenever a change could break a program reading them.
+const exportSchemaVersion = 1
+
+// accountExportHeader is everything of an export but the transactions, which
+// are streamed after it.
+type accountExportHeader struct {
+	SchemaVersion      int                  `json:"schema_version"`
+	ExportedAt         Timestamp            `json:"exported_at"`
+	Account            *AccountResponse     `json:"account"`
+	ScheduledTransfers []*ScheduledTransfer `json:"scheduled_transfers"`
+}
+
+// handleExportAccount handles GET requests for everything stored about the
+// authenticated account, as one JSON document: the account, its scheduled
+// transfers and its whole history. The history is streamed from the database
+// rather than loaded first, however long it is, and the write deadline is
+// pushed back before every write: a long history may take more than
+// WriteTimeout in all, but a client that stops reading for WriteTimeout is
+// still cut off.
+func (s *APIServer) handleExportAccount(w http.ResponseWriter, r *http.Request) error {
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	scheduled, err := s.store.GetScheduledTransfersByAccount(r.Context(), account.ID)
+	if err != nil {
+		return err
+	}
+
+	header, err := json.Marshal(accountExportHeader{
+		SchemaVersion:      exportSchemaVersion,
+		ExportedAt:         NewTimestamp(s.clock.Now()),
+		Account:            toAccountResponse(account),
+		ScheduledTransfers: scheduled,
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"export-%d.json\"", account.Number))
+
+	rc := http.NewResponseController(w)
+	write := func(p []byte) error {
+		err := rc.SetWriteDeadline(time.Now().Add(s.cfg.WriteTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+		_, err = w.Write(p)
+		return err
+	}
+
+	// The header object is reopened to append the transactions to it.
+	err = write(append(header[:len(header)-1], `,"transactions":[`...))
+	first := true
+	if err == nil {
+		err = s.store.ForEachTransaction(r.Context(), account.ID, TransactionFilter{}, func(t *Transaction) error {
+			data, err := json.Marshal(t)
+			if err != nil {
+				return err
+			}
+			if !first {
+				data = append([]byte{','}, data...)
+			}
+			first = false
+			return write(data)
+		})
+	}
+	if err == nil {
+		err = write([]byte("]}\n"))
+	}
+
+	// The headers are already sent at this point, so errors can only be logged.
+	if err != nil {
+		log.Println("writing export:", err)
+	}
+	return nil
+}
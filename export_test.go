@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowExportStore sends a history whose entries come in slower, all together,
+// than the write timeout.
+type slowExportStore struct {
+	Storage
+	entries int
+	delay   time.Duration
+}
+
+func (s *slowExportStore) GetScheduledTransfersByAccount(ctx context.Context, accountID int) ([]*ScheduledTransfer, error) {
+	return []*ScheduledTransfer{}, nil
+}
+
+func (s *slowExportStore) ForEachTransaction(ctx context.Context, accountID int, filter TransactionFilter, fn func(*Transaction) error) error {
+	for i := 1; i <= s.entries; i++ {
+		time.Sleep(s.delay)
+		if err := fn(&Transaction{ID: i, AccountID: accountID, Type: TransactionDeposit, Amount: 1_00}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestExportOutlastsWriteTimeout(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.WriteTimeout = 100 * time.Millisecond
+	s := NewAPIServer("", &slowExportStore{entries: 6, delay: 50 * time.Millisecond}, cfg)
+
+	account := &Account{ID: 1, Number: 79927398713, FirstName: "Ada", LastName: "Lovelace"}
+	handler := withMetrics(withGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), accountContextKey{}, account)
+		s.makeHTTPHandler(s.handleExportAccount)(w, r.WithContext(ctx))
+	})))
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.WriteTimeout = cfg.WriteTimeout
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var export struct {
+		Transactions []*Transaction `json:"transactions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&export); err != nil {
+		t.Fatalf("export cut off: %v", err)
+	}
+	if len(export.Transactions) != 6 {
+		t.Errorf("export holds %d transactions, want 6", len(export.Transactions))
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"math"
+	"net/http"
+)
+
+// FeeSchedule is what senders pay on top of every transfer: a flat amount
+// plus a percentage of the amount, credited to the account numbered Account.
+type FeeSchedule struct {
+	Flat    Money   `json:"flat"`
+	Percent float64 `json:"percent"` // e.g. 0.5 for 0.5%
+	Account int64   `json:"-"`
+}
+
+// Fee returns the fee from pays for transferring amount, in from's currency.
+// The fee account itself transfers for free.
+func (f FeeSchedule) Fee(from *Account, amount Money) Money {
+	if from.Number == f.Account {
+		return 0
+	}
+	return f.Flat + Money(math.Round(float64(amount)*f.Percent/100))
+}
+
+// handleGetFees handles GET requests for the fee schedule of transfers.
+func (s *APIServer) handleGetFees(w http.ResponseWriter, r *http.Request) error {
+	return WriteJSON(w, http.StatusOK, s.cfg.TransferFees)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultCurrency is the currency of accounts that don't specify one.
+const DefaultCurrency = "USD"
+
+// RateProvider returns how many units of currency to one unit of currency
+// from is worth.
+type RateProvider interface {
+	Rate(from, to string) (float64, error)
+}
+
+// StaticRateProvider serves fixed rates keyed by "FROM/TO" pairs. When only
+// the opposite pair is known its inverse is used.
+type StaticRateProvider struct {
+	rates map[string]float64
+}
+
+func NewStaticRateProvider(rates map[string]float64) *StaticRateProvider {
+	return &StaticRateProvider{rates: rates}
+}
+
+func (p *StaticRateProvider) Rate(from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	if rate, ok := p.rates[from+"/"+to]; ok {
+		return rate, nil
+	}
+	if rate, ok := p.rates[to+"/"+from]; ok && rate != 0 {
+		return 1 / rate, nil
+	}
+	return 0, fmt.Errorf("no exchange rate from %s to %s", from, to)
+}
+
+// validateCurrency checks that code looks like an ISO 4217 code, e.g. "EUR".
+func validateCurrency(code string) error {
+	if len(code) != 3 || strings.ToUpper(code) != code || strings.Trim(code, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return fmt.Errorf("invalid currency: %s", code)
+	}
+	return nil
+}
+
+// parseRates parses pairs such as "USD/EUR=0.92,EUR/GBP=0.85".
+func parseRates(str string) (map[string]float64, error) {
+	rates := map[string]float64{}
+	if str == "" {
+		return rates, nil
+	}
+
+	for _, pair := range strings.Split(str, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		from, to, okPair := strings.Cut(key, "/")
+		if !ok || !okPair || validateCurrency(from) != nil || validateCurrency(to) != nil {
+			return nil, fmt.Errorf("invalid exchange rate: %q", pair)
+		}
+
+		var rate float64
+		if _, err := fmt.Sscan(value, &rate); err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid exchange rate: %q", pair)
+		}
+		rates[key] = rate
+	}
+	return rates, nil
+}
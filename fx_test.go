@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStaticRateProvider(t *testing.T) {
+	rates := NewStaticRateProvider(map[string]float64{"USD/EUR": 0.8})
+
+	tests := []struct {
+		from, to string
+		want     float64
+	}{
+		{"USD", "EUR", 0.8},
+		{"EUR", "USD", 1.25}, // the inverse of the known pair
+		{"GBP", "GBP", 1},
+	}
+	for _, tt := range tests {
+		got, err := rates.Rate(tt.from, tt.to)
+		if err != nil || got != tt.want {
+			t.Errorf("Rate(%s, %s) = %v, %v, want %v", tt.from, tt.to, got, err, tt.want)
+		}
+	}
+
+	if _, err := rates.Rate("USD", "GBP"); err == nil {
+		t.Error("Rate(USD, GBP) without a rate succeeded")
+	}
+}
+
+func TestParseRates(t *testing.T) {
+	got, err := parseRates("USD/EUR=0.92, EUR/GBP=0.85")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]float64{"USD/EUR": 0.92, "EUR/GBP": 0.85}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRates = %v, want %v", got, want)
+	}
+
+	for _, str := range []string{"USD/EUR", "USDEUR=1", "usd/EUR=1", "USD/EUR=0", "USD/EUR=-1", "USD/EUR=abc"} {
+		if _, err := parseRates(str); err == nil {
+			t.Errorf("parseRates(%q) succeeded", str)
+		}
+	}
+}
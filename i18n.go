@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is the language of errors for clients accepting none of the
+// catalogs.
+const defaultLanguage = "en"
+
+// errorMessages translates error messages by language and code. There is no
+// English catalog: the message of the error itself is English, and often more
+// specific than a catalog entry. Codes missing from a catalog fall back to
+// English too. Only the message is translated; codes and details are the same
+// in every language.
+var errorMessages = map[string]map[ErrorCode]string{
+	"es": {
+		CodeBadRequest:                "solicitud inválida",
+		CodeValidationFailed:          "la solicitud no superó la validación",
+		CodeInvalidCredentials:        "credenciales inválidas",
+		CodeTokenExpired:              "el token expiró",
+		CodeTOTPRequired:              "se requiere el código de verificación en dos pasos",
+		CodeTwoFactorEnabled:          "la verificación en dos pasos ya está activada",
+		CodePermissionDenied:          "permiso denegado",
+		CodeAccountLocked:             "demasiados inicios de sesión fallidos, la cuenta está bloqueada",
+		CodeAccountNotFound:           "cuenta no encontrada",
+		CodeAccountFrozen:             "la cuenta está congelada",
+		CodeAccountClosed:             "la cuenta está cerrada",
+		CodeEmailTaken:                "el correo electrónico ya está en uso",
+		CodeEmailNotVerified:          "el correo electrónico no está verificado",
+		CodeEmailAlreadyVerified:      "el correo electrónico ya está verificado",
+		CodeInvalidVerificationToken:  "token de verificación inválido o expirado",
+		CodeStaleUpdate:               "la cuenta cambió desde que se leyó",
+		CodeNonZeroBalance:            "la cuenta todavía tiene saldo",
+		CodeScheduledTransfersPending: "la cuenta tiene transferencias programadas",
+		CodePendingTransfers:          "la cuenta tiene transferencias pendientes",
+		CodeTransferNotFound:          "transferencia no encontrada",
+		CodeTransferNotPending:        "la transferencia ya no está pendiente",
+		CodeTransactionNotFound:       "movimiento no encontrado",
+		CodeAlreadyReversed:           "la transferencia ya fue revertida",
+		CodeInsufficientFunds:         "saldo insuficiente",
+		CodeDailyLimitExceeded:        "se superó el límite diario de transferencias",
+		CodeBodyTooLarge:              "el cuerpo de la solicitud es demasiado grande",
+		CodeRateLimited:               "demasiadas solicitudes",
+		CodeUnsupportedMediaType:      "tipo de contenido no soportado",
+		CodeRouteNotFound:             "ruta no encontrada",
+		CodeMethodNotAllowed:          "método no permitido",
+		CodeInternal:                  "error interno del servidor",
+	},
+	"pt": {
+		CodeBadRequest:                "requisição inválida",
+		CodeValidationFailed:          "a requisição não passou na validação",
+		CodeInvalidCredentials:        "credenciais inválidas",
+		CodeTokenExpired:              "o token expirou",
+		CodeTOTPRequired:              "o código de verificação em duas etapas é obrigatório",
+		CodeTwoFactorEnabled:          "a verificação em duas etapas já está ativada",
+		CodePermissionDenied:          "permissão negada",
+		CodeAccountLocked:             "muitas tentativas de login falharam, a conta está bloqueada",
+		CodeAccountNotFound:           "conta não encontrada",
+		CodeAccountFrozen:             "a conta está congelada",
+		CodeAccountClosed:             "a conta está encerrada",
+		CodeEmailTaken:                "o e-mail já está em uso",
+		CodeEmailNotVerified:          "o e-mail não foi verificado",
+		CodeEmailAlreadyVerified:      "o e-mail já foi verificado",
+		CodeInvalidVerificationToken:  "token de verificação inválido ou expirado",
+		CodeStaleUpdate:               "a conta mudou desde que foi lida",
+		CodeNonZeroBalance:            "a conta ainda tem saldo",
+		CodeScheduledTransfersPending: "a conta tem transferências agendadas",
+		CodePendingTransfers:          "a conta tem transferências pendentes",
+		CodeTransferNotFound:          "transferência não encontrada",
+		CodeTransferNotPending:        "a transferência não está mais pendente",
+		CodeTransactionNotFound:       "lançamento não encontrado",
+		CodeAlreadyReversed:           "a transferência já foi estornada",
+		CodeInsufficientFunds:         "saldo insuficiente",
+		CodeDailyLimitExceeded:        "o limite diário de transferências foi excedido",
+		CodeBodyTooLarge:              "o corpo da requisição é grande demais",
+		CodeRateLimited:               "requisições demais",
+		CodeUnsupportedMediaType:      "tipo de conteúdo não suportado",
+		CodeRouteNotFound:             "rota não encontrada",
+		CodeMethodNotAllowed:          "método não permitido",
+		CodeInternal:                  "erro interno do servidor",
+	},
+}
+
+// preferredLanguage picks the language of errors from an Accept-Language
+// header, e.g. "es-AR,es;q=0.9,en;q=0.8". Languages are matched on their
+// primary subtag, most preferred first.
+func preferredLanguage(header string) string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if tag == "" || q <= 0 {
+			continue
+		}
+		primary, _, _ := strings.Cut(tag, "-")
+		langs = append(langs, weighted{lang: strings.ToLower(primary), q: q})
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	for _, l := range langs {
+		if _, ok := errorMessages[l.lang]; ok || l.lang == defaultLanguage {
+			return l.lang
+		}
+		if l.lang == "*" {
+			break
+		}
+	}
+	return defaultLanguage
+}
+
+// localizeError translates the message of apiErr into the language the client
+// of r prefers, and says which language that is in the Content-Language
+// header.
+func localizeError(w http.ResponseWriter, r *http.Request, apiErr *ApiError) {
+	lang := preferredLanguage(r.Header.Get("Accept-Language"))
+	if msg, ok := errorMessages[lang][apiErr.Error.Code]; ok {
+		apiErr.Error.Message = msg
+	} else {
+		lang = defaultLanguage
+	}
+
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", lang)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPreferredLanguage(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"es", "es"},
+		{"es-AR,es;q=0.9,en;q=0.8", "es"},
+		{"PT-br", "pt"},
+		{"fr, de;q=0.5", "en"},          // no catalog at all
+		{"fr, pt;q=0.5", "pt"},          // the best language with one
+		{"en;q=0.9, es;q=0.8", "en"},    // English is asked for first
+		{"es;q=0.5, pt;q=0.8", "pt"},    // by weight, not order
+		{"es;q=0, pt;q=0.1", "pt"},      // q=0 means not acceptable
+		{"*", "en"},                     // anything goes
+		{"fr, *;q=0.5, es;q=0.1", "en"}, // anything goes before Spanish
+		{"es;q=abc, pt", "pt"},          // malformed weights are skipped
+		{";q=1, , es", "es"},            // as are empty tags
+	}
+	for _, tt := range tests {
+		if got := preferredLanguage(tt.header); got != tt.want {
+			t.Errorf("preferredLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestLocalizedErrors(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, ErrPermissionDenied)
+	})
+
+	tests := []struct {
+		acceptLanguage string
+		wantLanguage   string
+		wantMessage    string
+	}{
+		{"", "en", "permission denied"},
+		{"es-ES", "es", "permiso denegado"},
+		{"pt-BR", "pt", "permissão negada"},
+		{"fr-FR", "en", "permission denied"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tt.acceptLanguage != "" {
+			req.Header.Set("Accept-Language", tt.acceptLanguage)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		body := decodeError(t, rec)
+		if body.Code != CodePermissionDenied || body.Message != tt.wantMessage {
+			t.Errorf("Accept-Language %q: got %s %q, want %s %q", tt.acceptLanguage, body.Code, body.Message, CodePermissionDenied, tt.wantMessage)
+		}
+		if got := rec.Header().Get("Content-Language"); got != tt.wantLanguage {
+			t.Errorf("Accept-Language %q: Content-Language %q, want %q", tt.acceptLanguage, got, tt.wantLanguage)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept-Language" {
+			t.Errorf("Accept-Language %q: Vary %q, want Accept-Language", tt.acceptLanguage, got)
+		}
+	}
+}
+
+func TestLocalizedErrorWithoutTranslationFallsBackToEnglish(t *testing.T) {
+	apiErr := ApiError{Error: ErrorBody{Code: "NOT_IN_ANY_CATALOG", Message: "something specific"}}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "es")
+	rec := httptest.NewRecorder()
+
+	localizeError(rec, req, &apiErr)
+	if apiErr.Error.Message != "something specific" || rec.Header().Get("Content-Language") != "en" {
+		t.Errorf("got %q in %q, want the English message", apiErr.Error.Message, rec.Header().Get("Content-Language"))
+	}
+}
+
+func TestErrorCatalogsCoverTheSameCodes(t *testing.T) {
+	for lang, catalog := range errorMessages {
+		for other, otherCatalog := range errorMessages {
+			for code := range catalog {
+				if _, ok := otherCatalog[code]; !ok {
+					t.Errorf("%s translates %s but %s doesn't", lang, code, other)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// maxImportBytes caps the size of an account import, file and form
+	// included.
+	maxImportBytes = 5 << 20
+
+	// maxImportRows bounds the number of accounts of one import.
+	maxImportRows = 1000
+)
+
+// importAccountsRoute names the route of account imports, whose body is a
+// file upload rather than JSON.
+const importAccountsRoute = "importAccounts"
+
+// importColumns are the columns an account import must have, in any order.
+var importColumns = []string{"first_name", "last_name", "email", "initial_balance"}
+
+// ImportRowStatus tells what became of a row of an account import.
+type ImportRowStatus string
+
+const (
+	ImportRowCreated ImportRowStatus = "created"
+	ImportRowSkipped ImportRowStatus = "skipped"
+)
+
+// ImportRowResult reports on one row of an account import, by its line in
+// the file.
+type ImportRowResult struct {
+	Line    int              `json:"line"`
+	Status  ImportRowStatus  `json:"status"`
+	Errors  []FieldError     `json:"errors,omitempty"` // why the row was skipped
+	Account *AccountResponse `json:"account,omitempty"`
+
+	// TemporaryPassword is the password the holder logs in with first. It
+	// is returned here only, and should be changed soon.
+	TemporaryPassword string `json:"temporary_password,omitempty"`
+}
+
+// ImportAccountsResponse reports on every row of an account import.
+type ImportAccountsResponse struct {
+	Created int                `json:"created"`
+	Skipped int                `json:"skipped"`
+	Rows    []*ImportRowResult `json:"rows"`
+}
+
+// importRow is a row of an account import, validated like a request.
+type importRow struct {
+	FirstName      string `json:"first_name" validate:"required,max=50"`
+	LastName       string `json:"last_name" validate:"required,max=50"`
+	Email          string `json:"email" validate:"required,email,max=255"`
+	InitialBalance Money  `json:"initial_balance" validate:"gte=0"`
+}
+
+// handleImportAccounts handles POST requests for creating accounts from a CSV
+// file, uploaded as the "file" field of a multipart form. Rows that fail
+// validation, repeat an email of the file or use one already taken are
+// skipped, and the others created at once. Anything wrong with the file as a
+// whole, such as a missing column, malformed CSV or too many rows, creates
+// none. Admin only.
+func (s *APIServer) handleImportAccounts(w http.ResponseWriter, r *http.Request) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportBytes)
+	defer r.Body.Close()
+
+	file, err := importFile(r)
+	if err != nil {
+		return err
+	}
+
+	rows, results, err := s.parseImport(file)
+	if err != nil {
+		return err
+	}
+
+	// The results of the rows to create, in the order of accounts.
+	var created []*ImportRowResult
+	for i, row := range rows {
+		if row != nil {
+			created = append(created, results[i])
+		}
+	}
+
+	passwords := make([]string, len(created))
+	for i := range passwords {
+		passwords[i] = randomHex(12)
+	}
+	hashes, err := hashPasswords(passwords, s.cfg.BcryptCost)
+	if err != nil {
+		return err
+	}
+
+	accounts := make([]*Account, 0, len(created))
+	for _, row := range rows {
+		if row == nil {
+			continue
+		}
+		accounts = append(accounts, &Account{
+			FirstName:         row.FirstName,
+			LastName:          row.LastName,
+			Email:             row.Email,
+			EncryptedPassword: hashes[len(accounts)],
+			Number:            s.cfg.AccountNumberFormat.newNumber(),
+			Balance:           row.InitialBalance,
+			Currency:          DefaultCurrency,
+			Type:              AccountTypeChecking,
+			Status:            AccountStatusActive,
+		})
+	}
+
+	skipped, err := s.store.ImportAccounts(accounts)
+	if err != nil {
+		return err
+	}
+
+	for i, account := range accounts {
+		result := created[i]
+		if errors.Is(skipped[i], ErrEmailTaken) {
+			result.Status = ImportRowSkipped
+			result.Errors = []FieldError{{Field: "email", Message: "is already in use"}}
+			continue
+		}
+		result.Account = toAccountResponse(account)
+		result.TemporaryPassword = passwords[i]
+		s.startEmailVerification(account)
+	}
+
+	resp := &ImportAccountsResponse{Rows: results}
+	for _, result := range results {
+		if result.Status == ImportRowCreated {
+			resp.Created++
+		} else {
+			resp.Skipped++
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, resp)
+}
+
+// importFile returns the "file" part of the multipart form of r.
+func importFile(r *http.Request) (io.Reader, error) {
+	form, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			return nil, errors.New(`missing "file" field`)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return part, nil
+		}
+	}
+}
+
+// parseImport reads the rows of an account import, with a result for each in
+// the order of the file. Invalid rows are nil, their results already skipped.
+func (s *APIServer) parseImport(file io.Reader) (rows []*importRow, results []*ImportRowResult, err error) {
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil, errors.New("the file is empty")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	index := make(map[string]int, len(header))
+	for i, column := range header {
+		index[strings.ToLower(strings.TrimSpace(column))] = i
+	}
+	for _, column := range importColumns {
+		if _, ok := index[column]; !ok {
+			return nil, nil, fmt.Errorf("missing column %q, expected %s", column, strings.Join(importColumns, ","))
+		}
+	}
+
+	results = []*ImportRowResult{}
+	lines := make(map[string]int) // of the emails seen so far
+	for count := 0; ; count++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if count == maxImportRows {
+			return nil, nil, fmt.Errorf("an import may hold at most %d rows", maxImportRows)
+		}
+
+		line, _ := reader.FieldPos(0)
+		row, fieldErrs := s.parseImportRow(index, record)
+		if len(fieldErrs) == 0 {
+			email := strings.ToLower(row.Email)
+			if first, ok := lines[email]; ok {
+				fieldErrs = []FieldError{{Field: "email", Message: fmt.Sprintf("repeats line %d", first)}}
+			} else {
+				lines[email] = line
+			}
+		}
+
+		if len(fieldErrs) > 0 {
+			rows = append(rows, nil)
+			results = append(results, &ImportRowResult{Line: line, Status: ImportRowSkipped, Errors: fieldErrs})
+			continue
+		}
+		rows = append(rows, row)
+		results = append(results, &ImportRowResult{Line: line, Status: ImportRowCreated})
+	}
+
+	return rows, results, nil
+}
+
+// parseImportRow builds the row of record, whose columns are found by index,
+// or says what is wrong with it.
+func (s *APIServer) parseImportRow(index map[string]int, record []string) (*importRow, []FieldError) {
+	field := func(column string) string {
+		if i := index[column]; i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	row := &importRow{
+		FirstName: field("first_name"),
+		LastName:  field("last_name"),
+		Email:     field("email"),
+	}
+
+	var fieldErrs []FieldError
+	if balance := field("initial_balance"); balance != "" {
+		amount, err := parseMoney(balance)
+		if err != nil {
+			fieldErrs = append(fieldErrs, FieldError{Field: "initial_balance", Message: "must be an amount such as 100.50"})
+		}
+		row.InitialBalance = amount
+	}
+
+	var verr *ValidationError
+	if err := validateRequest(row); errors.As(err, &verr) {
+		fieldErrs = append(fieldErrs, verr.Fields...)
+	} else if err != nil {
+		fieldErrs = append(fieldErrs, FieldError{Message: err.Error()})
+	}
+
+	if min := s.cfg.MinOpeningDeposits[AccountTypeChecking]; len(fieldErrs) == 0 && row.InitialBalance < min {
+		fieldErrs = append(fieldErrs, FieldError{
+			Field:   "initial_balance",
+			Message: fmt.Sprintf("must be at least %s for %s accounts", min, AccountTypeChecking),
+		})
+	}
+
+	return row, fieldErrs
+}
+
+// hashPasswords hashes many passwords on every CPU, bcrypt being slow on
+// purpose.
+func hashPasswords(passwords []string, cost int) ([]string, error) {
+	hashes := make([]string, len(passwords))
+	errs := make([]error, len(passwords))
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for n := 0; n < runtime.GOMAXPROCS(0); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				hashes[i], errs[i] = hashPassword(passwords[i], cost)
+			}
+		}()
+	}
+	for i := range passwords {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	return hashes, errors.Join(errs...)
+}
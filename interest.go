@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// runInterestAccrual credits the day's interest to savings accounts, checking
+// every accrual interval. The store makes each day idempotent, so the job can
+// run as often as needed without double-crediting. It stops once ctx is done.
+func (s *APIServer) runInterestAccrual(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.InterestAccrualInterval)
+	defer ticker.Stop()
+
+	for {
+		now := s.clock.Now().UTC()
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+		credited, err := s.store.AccrueInterest(day)
+		if err != nil {
+			log.Println("accruing interest:", err)
+		}
+		if credited > 0 {
+			log.Printf("Credited interest for %s to %d accounts", day.Format(statementDateLayout), credited)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// jsonAPIMediaType is the media type of JSON:API documents
+// (https://jsonapi.org).
+const jsonAPIMediaType = "application/vnd.api+json"
+
+// jsonAPIWriter marks the response of a request that asked for JSON:API, so
+// that WriteJSON formats it as such. Handlers write through it unaware.
+type jsonAPIWriter struct {
+	http.ResponseWriter
+}
+
+func (w *jsonAPIWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// withJSONAPI has WriteJSON answer in JSON:API the requests whose Accept
+// header names jsonAPIMediaType. Everything else keeps the plain format. It
+// must be the innermost middleware, for handlers to get its writer.
+func withJSONAPI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if acceptsJSONAPI(r) {
+			w = &jsonAPIWriter{ResponseWriter: w}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func acceptsJSONAPI(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accepted); err == nil && mediaType == jsonAPIMediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonAPIResource is a resource object of a JSON:API document.
+type jsonAPIResource struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+// jsonAPIDocument is a top-level JSON:API document, holding either data or
+// errors.
+type jsonAPIDocument struct {
+	Data   interface{}            `json:"data,omitempty"`
+	Errors []jsonAPIError         `json:"errors,omitempty"`
+	Meta   map[string]interface{} `json:"meta,omitempty"`
+}
+
+// jsonAPIError is an error object of a JSON:API document.
+type jsonAPIError struct {
+	Status string                 `json:"status"`
+	Code   ErrorCode              `json:"code"`
+	Title  string                 `json:"title"`
+	Meta   map[string]interface{} `json:"meta,omitempty"`
+}
+
+// toJSONAPI converts a response body into a JSON:API document. Only accounts
+// and errors have a JSON:API form; ok is false for anything else, which is
+// written as is.
+func toJSONAPI(status int, v interface{}) (doc *jsonAPIDocument, ok bool, err error) {
+	switch v := v.(type) {
+	case *AccountResponse:
+		resource, err := accountResource(v)
+		return &jsonAPIDocument{Data: resource}, true, err
+	case []*AccountResponse:
+		resources := make([]*jsonAPIResource, len(v))
+		for i, account := range v {
+			if resources[i], err = accountResource(account); err != nil {
+				return nil, false, err
+			}
+		}
+		return &jsonAPIDocument{Data: resources}, true, nil
+	case CreateAccountResponse:
+		resource, err := accountResource(v.Account)
+		return &jsonAPIDocument{Data: resource, Meta: map[string]interface{}{"token": v.Token}}, true, err
+	case ApiError:
+		return &jsonAPIDocument{Errors: []jsonAPIError{{
+			Status: strconv.Itoa(status),
+			Code:   v.Error.Code,
+			Title:  v.Error.Message,
+			Meta:   v.Error.Details,
+		}}}, true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+// accountResource turns an account into a resource of type "accounts", whose
+// attributes are the fields of its plain JSON but the id.
+func accountResource(account *AccountResponse) (*jsonAPIResource, error) {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return nil, err
+	}
+
+	// Numbers are kept as they are, account numbers being too long for a
+	// float64.
+	var attributes map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&attributes); err != nil {
+		return nil, err
+	}
+	delete(attributes, "id")
+
+	return &jsonAPIResource{Type: "accounts", ID: strconv.Itoa(account.ID), Attributes: attributes}, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// getAccount requests GET /account/1 as its holder through every middleware,
+// accepting accept.
+func getAccount(t *testing.T, accept string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	cfg := testConfig(t)
+	account := &Account{ID: 1, CustomerID: 1, Number: 79927398713, FirstName: "Ada", LastName: "Lovelace", Balance: 12_34, TokenVersion: 1}
+	routes := NewAPIServer("", &accountsStore{accounts: []*Account{account}}, cfg).routes()
+	token, err := createJWTToken(account, cfg.TokenKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/account/1", nil)
+	req.Header.Set("Authorization", token)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeNumbers decodes rec's body keeping numbers as they are.
+func decodeNumbers(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	dec := json.NewDecoder(bytes.NewReader(rec.Body.Bytes()))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+}
+
+func TestAccountResponsePlainJSON(t *testing.T) {
+	for _, accept := range []string{"", "application/json", "*/*"} {
+		rec := getAccount(t, accept)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("Accept %q: got %d %s %s, want plain JSON", accept, rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+		}
+
+		var body map[string]interface{}
+		decodeNumbers(t, rec, &body)
+		if body["id"] != json.Number("1") || body["number"] != json.Number("79927398713") || body["first_name"] != "Ada" || body["balance"] != "12.34" {
+			t.Errorf("Accept %q: got %s, want the account's fields at the top level", accept, rec.Body)
+		}
+		if _, ok := body["data"]; ok {
+			t.Errorf("Accept %q: got a JSON:API document %s", accept, rec.Body)
+		}
+	}
+}
+
+func TestAccountResponseJSONAPI(t *testing.T) {
+	rec := getAccount(t, "application/json;q=0.5, application/vnd.api+json")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != jsonAPIMediaType {
+		t.Fatalf("got %d %s %s, want a JSON:API document", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	if got := rec.Header().Values("Vary"); !slices.Contains(got, "Accept") {
+		t.Errorf("Vary %v, want Accept", got)
+	}
+
+	var doc struct {
+		Data struct {
+			Type       string                 `json:"type"`
+			ID         string                 `json:"id"`
+			Attributes map[string]interface{} `json:"attributes"`
+		} `json:"data"`
+	}
+	decodeNumbers(t, rec, &doc)
+	if doc.Data.Type != "accounts" || doc.Data.ID != "1" {
+		t.Errorf("resource %s %q, want accounts \"1\"", doc.Data.Type, doc.Data.ID)
+	}
+	attributes := doc.Data.Attributes
+	if attributes["number"] != json.Number("79927398713") || attributes["first_name"] != "Ada" || attributes["balance"] != "12.34" {
+		t.Errorf("attributes %v, want the account's fields", attributes)
+	}
+	if _, ok := attributes["id"]; ok {
+		t.Error("the id is repeated in the attributes")
+	}
+}
+
+func TestErrorResponseJSONAPI(t *testing.T) {
+	routes := NewAPIServer("", &accountsStore{}, testConfig(t)).routes()
+	req := httptest.NewRequest(http.MethodGet, "/account/1", nil)
+	req.Header.Set("Accept", jsonAPIMediaType)
+	rec := httptest.NewRecorder()
+	routes.ServeHTTP(rec, req)
+
+	var doc jsonAPIDocument
+	decodeNumbers(t, rec, &doc)
+	if rec.Code != http.StatusForbidden || len(doc.Errors) != 1 || doc.Errors[0].Status != "403" || doc.Errors[0].Code != CodePermissionDenied {
+		t.Errorf("got %d %s, want a JSON:API 403 error", rec.Code, rec.Body)
+	}
+}
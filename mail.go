@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// Email is a plain text message to a single recipient, optionally with files
+// attached.
+type Email struct {
+	To          string
+	Subject     string
+	Body        string
+	Attachments []*Attachment
+}
+
+// Attachment is a file attached to an email.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// EmailSender delivers emails to account holders.
+type EmailSender interface {
+	Send(email *Email) error
+}
+
+// newEmailSender returns the sender of cfg's SMTP server, or a logEmailSender
+// if there is none.
+func newEmailSender(cfg *Config) EmailSender {
+	if cfg.SMTPHost == "" {
+		return logEmailSender{}
+	}
+
+	sender := &smtpEmailSender{
+		addr:  net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort)),
+		from:  cfg.SMTPFrom,
+		clock: cfg.Clock,
+	}
+	if cfg.SMTPUsername != "" {
+		sender.auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, cfg.SMTPHost)
+	}
+	return sender
+}
+
+// logEmailSender writes emails to the log instead of sending them, which is
+// all there is until a mail server is configured.
+type logEmailSender struct{}
+
+func (logEmailSender) Send(email *Email) error {
+	log.Printf("Email to %s: %s\n%s", email.To, email.Subject, email.Body)
+	for _, a := range email.Attachments {
+		log.Printf("Email to %s: attached %s (%s, %d bytes)", email.To, a.Filename, a.ContentType, len(a.Data))
+	}
+	return nil
+}
+
+// nopEmailSender drops every email, for tests.
+type nopEmailSender struct{}
+
+func (nopEmailSender) Send(*Email) error {
+	return nil
+}
+
+// smtpEmailSender sends emails through an SMTP server. The connection is
+// upgraded with STARTTLS when the server offers it, which smtp.PlainAuth
+// requires unless the server is on localhost.
+type smtpEmailSender struct {
+	addr  string
+	auth  smtp.Auth // nil for servers without authentication
+	from  string
+	clock Clock // dates the messages
+}
+
+func (s *smtpEmailSender) Send(email *Email) error {
+	msg, err := s.message(email)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{email.To}, msg)
+}
+
+// message formats email as a MIME message, multipart when it has
+// attachments.
+func (s *smtpEmailSender) message(email *Email) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", email.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", s.clock.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if len(email.Attachments) == 0 {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buf, email.Body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	parts := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", parts.Boundary())
+
+	body, err := parts.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := writeQuotedPrintable(body, email.Body); err != nil {
+		return nil, err
+	}
+
+	for _, a := range email.Attachments {
+		part, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {a.ContentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// Lines of base64 must not exceed 76 characters.
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 76 {
+			fmt.Fprintf(part, "%s\r\n", encoded[:76])
+			encoded = encoded[76:]
+		}
+		fmt.Fprintf(part, "%s\r\n", encoded)
+	}
+
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
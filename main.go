@@ -1,12 +1,23 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"os"
 )
 
 func main() {
+	// Load the configuration from the environment.
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Starting in %s environment", cfg.Env)
+
 	// Initialize a new Postgres store.
-	store, err := NewPostgresStore()
+	store, err := NewPostgresStore(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -16,7 +27,74 @@ func main() {
 		log.Fatal(err)
 	}
 
-	// Create a new API server with the specified address and store and run it.
-	server := NewAPIServer(":8080", store)
-	server.Run()
-}
\ No newline at end of file
+	// Seed the first admin account if requested.
+	if err := bootstrapAdmin(store, cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	// Cache account lookups in front of the database if enabled.
+	var storage Storage = store
+	if cfg.AccountCacheSize > 0 {
+		storage = NewCachedStore(store, NewLRUCache(cfg.AccountCacheSize, cfg.AccountCacheTTL, cfg.Clock), cfg.TransferFees.Account)
+	}
+
+	// Create a new API server with the specified address and store and run
+	// it, exiting with an error if it couldn't serve or shut down cleanly.
+	server := NewAPIServer(cfg.ListenAddress, storage, cfg)
+	if err := server.Run(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		store.Close()
+		log.Fatal("server: ", err)
+	}
+
+	// Close the database pool once the server and its jobs have stopped.
+	if err := store.Close(); err != nil {
+		log.Println("closing store:", err)
+	}
+}
+
+// bootstrapAdmin creates an admin account from ADMIN_FIRST_NAME, ADMIN_LAST_NAME,
+// ADMIN_EMAIL and ADMIN_PASSWORD when they are set and no admin exists yet,
+// logging its number and token.
+func bootstrapAdmin(store Storage, cfg *Config) error {
+	req := &CreateAccountRequest{
+		FirstName: os.Getenv("ADMIN_FIRST_NAME"),
+		LastName:  os.Getenv("ADMIN_LAST_NAME"),
+		Email:     os.Getenv("ADMIN_EMAIL"),
+		Password:  os.Getenv("ADMIN_PASSWORD"),
+	}
+	if req.FirstName == "" {
+		return nil
+	}
+
+	if err := validateRequest(req); err != nil {
+		return fmt.Errorf("admin bootstrap: %w", err)
+	}
+	if err := cfg.PasswordPolicy.validateField("password", req.Password); err != nil {
+		return fmt.Errorf("admin bootstrap: %w", err)
+	}
+
+	hasAdmin, err := store.HasAdmin()
+	if err != nil || hasAdmin {
+		return err
+	}
+
+	account, err := NewAccount(req.FirstName, req.LastName, req.Email, req.Password, cfg)
+	if err != nil {
+		return err
+	}
+	account.IsAdmin = true
+	account.EmailVerified = true
+
+	if err := store.CreateAccount(account); err != nil {
+		return err
+	}
+
+	tokenString, err := createJWTToken(account, cfg.TokenKeys)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Created admin account %d, token: %s", account.Number, tokenString)
+
+	return nil
+}
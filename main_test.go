@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testConfig loads the configuration with the defaults, plus what the
+// environment of a test can't do without.
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	t.Setenv("JWT_SECRET", strings.Repeat("s", minJWTSecretLength))
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// setClock makes cfg and the token keys loaded with it tell the time by clock.
+func setClock(cfg *Config, clock Clock) {
+	cfg.Clock = clock
+	cfg.TokenKeys.clock = clock
+}
+
+func TestLoadConfigRejectsUnreachableApprovalThreshold(t *testing.T) {
+	t.Setenv("JWT_SECRET", strings.Repeat("s", minJWTSecretLength))
+	t.Setenv("DAILY_TRANSFER_LIMIT_SAVINGS", "1000.00")
+	t.Setenv("TRANSFER_APPROVAL_THRESHOLD", "1000.01")
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("LoadConfig accepted a threshold above the savings daily limit")
+	}
+
+	// Without a limit any threshold can be reached.
+	t.Setenv("DAILY_TRANSFER_LIMIT_SAVINGS", "0")
+	if _, err := LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// requestIDHeader carries the id correlating a request with its log lines.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds ids supplied by clients, which end up in logs.
+const maxRequestIDLength = 64
+
+type requestIDContextKey struct{}
+
+// withRequestID tags every request with an id, reusing the one sent by the
+// client or a proxy when present, and echoes it in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > maxRequestIDLength {
+			id = randomHex(16)
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// getRequestID returns the id assigned by withRequestID, or "" outside of it.
+func getRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// withRecovery turns a panicking handler into a 500 response instead of a
+// dropped connection, logging the panic and its stack with the request id.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if v := recover(); v != nil {
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+
+				log.Printf("panic serving %s %s (request %s): %v\n%s", r.Method, r.URL.Path, getRequestID(r), v, debug.Stack())
+				apiErr := ApiError{Error: ErrorBody{Code: CodeInternal, Message: "internal server error"}}
+				localizeError(w, r, &apiErr)
+				WriteJSON(w, http.StatusInternalServerError, apiErr)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxLoggedBodyBytes caps how much of each body withBodyLogging logs.
+const maxLoggedBodyBytes = 4 << 10
+
+// redactedPattern matches the JSON string fields holding credentials, so that
+// their values can be blanked out of logged bodies. Working on the raw text
+// rather than decoded JSON also covers bodies cut short by the size cap, even
+// in the middle of a value.
+var redactedPattern = regexp.MustCompile(`"(password|current_password|new_password|temporary_password|token|totp_code|secret|otpauth_url|qr_code)"(\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+// redactedHeaders are logged by withBodyLogging without their value.
+var redactedHeaders = []string{"Authorization", "Cookie"}
+
+// withBodyLogging logs the headers and body of every request along with the
+// response body when LogBodies is set, redacting credentials. Bodies are
+// copied as the handler reads and writes them, so nothing is consumed.
+func (s *APIServer) withBodyLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.cfg.LogBodies {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reqBody := &cappedBuffer{max: maxLoggedBodyBytes}
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.TeeReader(r.Body, reqBody), r.Body}
+
+		rec := &bodyRecorder{ResponseWriter: w, status: http.StatusOK, body: cappedBuffer{max: maxLoggedBodyBytes}}
+		next.ServeHTTP(rec, r)
+
+		headers := r.Header.Clone()
+		for _, name := range redactedHeaders {
+			if headers.Get(name) != "" {
+				headers.Set(name, "[REDACTED]")
+			}
+		}
+
+		log.Printf("request %s: %s %s headers=%v body=%s", getRequestID(r), r.Method, r.URL.RequestURI(), headers, reqBody)
+		log.Printf("response %s: %d body=%s", getRequestID(r), rec.status, &rec.body)
+	})
+}
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest.
+type cappedBuffer struct {
+	bytes.Buffer
+	max     int
+	dropped int
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	keep := min(len(p), b.max-b.Len())
+	b.Buffer.Write(p[:keep])
+	b.dropped += len(p) - keep
+	return len(p), nil
+}
+
+// String returns the kept bytes with credentials redacted.
+func (b *cappedBuffer) String() string {
+	var sb strings.Builder
+	sb.WriteString(redactedPattern.ReplaceAllString(b.Buffer.String(), `"$1"$2"[REDACTED]"`))
+	if b.dropped > 0 {
+		fmt.Fprintf(&sb, "... (%d more bytes)", b.dropped)
+	}
+	return sb.String()
+}
+
+// bodyRecorder copies the response status and body written through it.
+type bodyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   cappedBuffer
+}
+
+func (rec *bodyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *bodyRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *bodyRecorder) Write(p []byte) (int, error) {
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// ErrUnsupportedMediaType is returned for request bodies that aren't JSON.
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// withJSONContentType rejects POST, PUT and PATCH requests whose body isn't
+// declared as application/json, or as multipart/form-data for account
+// imports. Bodiless requests always pass, and so do requests without a
+// Content-Type when AllowMissingContentType is set.
+func (s *APIServer) withJSONContentType(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch:
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		contentType := r.Header.Get("Content-Type")
+		if r.ContentLength == 0 || (contentType == "" && s.cfg.AllowMissingContentType) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := "application/json"
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == importAccountsRoute {
+			expected = "multipart/form-data"
+		}
+
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != expected {
+			writeError(w, r, fmt.Errorf("%w: %q, expected %s", ErrUnsupportedMediaType, contentType, expected))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryTurnsPanicsIntoInternalErrors(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) {
+		var claims interface{} = "not a map"
+		_ = claims.(map[string]interface{})
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, http.StatusOK, "ok")
+	})
+	server := httptest.NewServer(withRequestID(withRecovery(mux)))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/panic", nil)
+	req.Header.Set(requestIDHeader, "req-314")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("the panic dropped the connection: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body ApiError
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusInternalServerError || body.Error.Code != CodeInternal || body.Error.Message != "internal server error" {
+		t.Errorf("got %d %+v, want 500 internal server error", resp.StatusCode, body.Error)
+	}
+	if strings.Contains(body.Error.Message, "goroutine") {
+		t.Error("the response leaks the stack trace")
+	}
+	if !strings.Contains(logs.String(), "req-314") || !strings.Contains(logs.String(), "interface conversion") {
+		t.Errorf("the panic wasn't logged with its request id: %s", logs.String())
+	}
+
+	// The server keeps serving.
+	resp, err = http.Get(server.URL + "/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("request after the panic: got %d, want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// migrations bring the tables of databases created by older versions up to
+// date. The create*Table functions only create missing tables, so every change
+// to an existing table needs a migration here as well, written to run just as
+// well on a table created with the change. Migration N is recorded as
+// version N in schema_migrations and runs once; append new ones to the end and
+// never edit those already released.
+var migrations = []string{
+	// Admin role.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS is_admin BOOLEAN NOT NULL DEFAULT FALSE`,
+	// Emails and account types.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS email VARCHAR(255) UNIQUE;
+	ALTER TABLE accounts ADD COLUMN IF NOT EXISTS account_type VARCHAR(20) NOT NULL DEFAULT 'checking'`,
+	// Password login. Accounts from before it have no password to log in
+	// with until an admin sets one.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS encrypted_password VARCHAR(100) NOT NULL DEFAULT '';
+	ALTER TABLE accounts ALTER COLUMN encrypted_password DROP DEFAULT`,
+	// Interest accrual.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS interest_rate DOUBLE PRECISION NOT NULL DEFAULT 0`,
+	// Account status.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS status VARCHAR(10) NOT NULL DEFAULT 'active'`,
+	// Currencies and FX transfers.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS currency VARCHAR(3) NOT NULL DEFAULT 'USD';
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_amount BIGINT;
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_currency VARCHAR(3);
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS fx_rate DOUBLE PRECISION`,
+	// Optimistic locking of account updates.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1`,
+	// Held funds of pending transfers.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS held_balance BIGINT NOT NULL DEFAULT 0`,
+	// Transfer reversals.
+	`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reversal_of INTEGER REFERENCES transactions (id);
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS reversed BOOLEAN NOT NULL DEFAULT FALSE`,
+	// Token revocation.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS token_version INTEGER NOT NULL DEFAULT 1`,
+	// Email verification. Accounts from before it have to verify their email
+	// like new ones.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT FALSE`,
+	// Transaction categories and tags.
+	`ALTER TABLE transactions ADD COLUMN IF NOT EXISTS category VARCHAR(50);
+	ALTER TABLE transactions ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '[]'`,
+	// Ledger timestamps with a time zone. Older entries were written by NOW()
+	// in the session time zone, which is also what they are read in.
+	`ALTER TABLE transactions ALTER COLUMN created_at TYPE TIMESTAMPTZ`,
+	// Customers. Every account from before them gets a customer of its own,
+	// as if it had been opened after.
+	`ALTER TABLE accounts ADD COLUMN IF NOT EXISTS customer_id INTEGER REFERENCES customers (id);
+	CREATE TEMPORARY TABLE account_customers ON COMMIT DROP AS
+		SELECT id AS account_id, nextval(pg_get_serial_sequence('customers', 'id'))::INTEGER AS customer_id, created_at
+		FROM accounts WHERE customer_id IS NULL;
+	INSERT INTO customers (id, created_at) SELECT customer_id, created_at FROM account_customers;
+	UPDATE accounts SET customer_id = m.customer_id FROM account_customers m WHERE accounts.id = m.account_id;
+	ALTER TABLE accounts ALTER COLUMN customer_id SET NOT NULL;
+	CREATE INDEX IF NOT EXISTS accounts_customer_id_idx ON accounts (customer_id)`,
+	// Fees held with pending transfers. Those from before only hold their
+	// amount and are confirmed without a fee.
+	`ALTER TABLE pending_transfers ADD COLUMN IF NOT EXISTS fee BIGINT NOT NULL DEFAULT 0`,
+	// The last TOTP period whose code was accepted, against replays.
+	`ALTER TABLE account_totp ADD COLUMN IF NOT EXISTS last_step BIGINT`,
+	// Labels of pending transfers. Those from before are confirmed unlabelled.
+	`ALTER TABLE pending_transfers ADD COLUMN IF NOT EXISTS category VARCHAR(50);
+	ALTER TABLE pending_transfers ADD COLUMN IF NOT EXISTS tags JSONB NOT NULL DEFAULT '[]'`,
+}
+
+// migrate runs the migrations the database hasn't had yet, in one
+// transaction. The lock on schema_migrations keeps instances starting at the
+// same time from running them twice.
+func (s *PostgresStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("LOCK TABLE schema_migrations IN EXCLUSIVE MODE"); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		if _, err := tx.Exec(migrations[version]); err != nil {
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec("INSERT INTO schema_migrations (version) VALUES ($1)", version+1); err != nil {
+			return err
+		}
+		log.Printf("Applied migration %d", version+1)
+	}
+
+	return tx.Commit()
+}
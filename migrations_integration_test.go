@@ -0,0 +1,108 @@
+//go:build integration
+
+package main
+
+import "testing"
+
+func TestInitIsIdempotent(t *testing.T) {
+	store := newTestStore(t)
+
+	if err := store.Init(); err != nil {
+		t.Fatalf("second Init: %v", err)
+	}
+
+	var applied, latest int
+	if err := store.db.QueryRow("SELECT COUNT(*), MAX(version) FROM schema_migrations").Scan(&applied, &latest); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) || latest != len(migrations) {
+		t.Errorf("%d migrations recorded up to version %d, want %d", applied, latest, len(migrations))
+	}
+}
+
+func TestMigrateUpgradesLedger(t *testing.T) {
+	store := newEmptyTestStore(t)
+
+	// The ledger as it was first released.
+	if _, err := store.db.Exec(`CREATE TABLE transactions (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL,
+		type VARCHAR(20) NOT NULL,
+		amount BIGINT NOT NULL,
+		balance BIGINT NOT NULL,
+		counterparty BIGINT,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	INSERT INTO transactions (account_id, type, amount, balance) VALUES (1, 'deposit', 10_00, 10_00)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		currency string
+		reversed bool
+		tags     string
+	)
+	if err := store.db.QueryRow("SELECT currency, reversed, tags FROM transactions").Scan(&currency, &reversed, &tags); err != nil {
+		t.Fatal(err)
+	}
+	if currency != "USD" || reversed || tags != "[]" {
+		t.Errorf("old entry got currency %q, reversed %t, tags %s, want USD, false and []", currency, reversed, tags)
+	}
+
+	var createdAtType string
+	if err := store.db.QueryRow(`SELECT data_type FROM information_schema.columns
+		WHERE table_name = 'transactions' AND column_name = 'created_at'`).Scan(&createdAtType); err != nil {
+		t.Fatal(err)
+	}
+	if createdAtType != "timestamp with time zone" {
+		t.Errorf("created_at is a %s, want a timestamp with time zone", createdAtType)
+	}
+}
+
+func TestMigrateUpgradesAccounts(t *testing.T) {
+	store := newEmptyTestStore(t)
+
+	// The accounts table as it was first released, with two accounts.
+	if _, err := store.db.Exec(`CREATE TABLE accounts (
+		id SERIAL PRIMARY KEY,
+		first_name VARCHAR(50) NOT NULL,
+		last_name VARCHAR(50) NOT NULL,
+		number BIGINT NOT NULL UNIQUE,
+		balance BIGINT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	INSERT INTO accounts (first_name, last_name, number, balance)
+	VALUES ('Ada', 'Lovelace', 1001, 10_00), ('Alan', 'Turing', 1002, 20_00)`); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	ada, err := store.GetAccountByNumber(1001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alan, err := store.GetAccountByNumber(1002)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ada.CustomerID == 0 || alan.CustomerID == 0 || ada.CustomerID == alan.CustomerID {
+		t.Errorf("old accounts got customers %d and %d, want one each", ada.CustomerID, alan.CustomerID)
+	}
+	if ada.Balance != 10_00 || ada.Type != AccountTypeChecking || ada.Status != AccountStatusActive || ada.Version != 1 {
+		t.Errorf("old account migrated to %+v", ada)
+	}
+
+	// New accounts don't collide with the customers made up for the old ones.
+	created := createTestAccount(t, store, "Grace", "Hopper", 0)
+	if created.CustomerID == ada.CustomerID || created.CustomerID == alan.CustomerID {
+		t.Errorf("new account got the customer %d of an old one", created.CustomerID)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in cents. It is stored as a BIGINT and travels over JSON
+// as a decimal string such as "12.34". Requests may also send it as a JSON
+// number of dollars such as 12.34 or 12.
+type Money int64
+
+// maxAmount caps the amount of a single deposit, withdrawal or transfer, far
+// enough below the range of Money that sums of them can't overflow.
+const maxAmount Money = 1_000_000_000_00
+
+// addMoney returns a+b, and false if the sum overflows.
+func addMoney(a, b Money) (Money, bool) {
+	sum := a + b
+	return sum, (sum > a) == (b > 0)
+}
+
+// String formats m as dollars, e.g. "$12.34" or "-$0.05".
+func (m Money) String() string {
+	if m < 0 {
+		return "-$" + (-m).decimal()
+	}
+	return "$" + m.decimal()
+}
+
+// decimal formats m as a plain decimal number of dollars, e.g. "12.34".
+func (m Money) decimal() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.decimal())
+}
+
+// UnmarshalJSON accepts decimal strings and numbers alike. Numbers are parsed
+// from their text rather than as floats, which would turn 0.29 into 28.99...
+// cents, so the same rules apply to both: at most two fractional digits and
+// no exponent.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	var str string
+	if len(data) > 0 && data[0] != '"' {
+		var number json.Number
+		if err := json.Unmarshal(data, &number); err != nil || strings.ContainsAny(string(number), "eE") {
+			return fmt.Errorf("invalid amount: %s", data)
+		}
+		str = string(number)
+	} else if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("invalid amount: %s", data)
+	}
+
+	parsed, err := parseMoney(str)
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+	return nil
+}
+
+// parseMoney parses a decimal amount of dollars with at most two fractional digits.
+func parseMoney(str string) (Money, error) {
+	invalid := fmt.Errorf("invalid amount: %q", str)
+
+	digits := strings.TrimPrefix(str, "-")
+	negative := digits != str
+
+	whole, frac, _ := strings.Cut(digits, ".")
+	if whole == "" || len(frac) > 2 || strings.ContainsAny(whole+frac, "+-") {
+		return 0, invalid
+	}
+
+	dollars, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, invalid
+	}
+
+	var cents int64
+	if frac != "" {
+		cents, err = strconv.ParseInt(frac+strings.Repeat("0", 2-len(frac)), 10, 64)
+		if err != nil {
+			return 0, invalid
+		}
+	}
+
+	if dollars > (1<<63-1-cents)/100 {
+		return 0, invalid
+	}
+
+	total := dollars*100 + cents
+	if negative {
+		total = -total
+	}
+	return Money(total), nil
+}
+
+// Scan implements sql.Scanner for BIGINT columns.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case int64:
+		*m = Money(v)
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+}
+
+// Value implements driver.Valuer.
+func (m Money) Value() (driver.Value, error) {
+	return int64(m), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMoneyUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json string
+		want Money
+	}{
+		{`12.34`, 12_34},
+		{`12`, 12_00},
+		{`"12.00"`, 12_00},
+		{`"12.3"`, 12_30},
+		{`0.29`, 29}, // 28.999... cents as a float64
+		{`"0.07"`, 7},
+		{`-5.5`, -5_50},
+		{`"92233720368547758.07"`, 1<<63 - 1},
+	}
+	for _, tt := range tests {
+		var got Money
+		if err := json.Unmarshal([]byte(tt.json), &got); err != nil || got != tt.want {
+			t.Errorf("Unmarshal(%s) = %d, %v, want %d cents", tt.json, got, err, tt.want)
+		}
+	}
+}
+
+func TestMoneyUnmarshalJSONRejectsInvalidAmounts(t *testing.T) {
+	for _, data := range []string{
+		`12.345`, `"12.345"`, `1e3`, `"1e3"`, `"12,34"`, `".5"`, `"+12"`, `"12.-3"`, `"abc"`, `""`,
+		`true`, `null`, `"92233720368547758.08"`,
+	} {
+		var m Money
+		if err := json.Unmarshal([]byte(data), &m); err == nil {
+			t.Errorf("Unmarshal(%s) = %d cents, want an error", data, m)
+		}
+	}
+}
+
+func TestMoneyMarshalJSON(t *testing.T) {
+	tests := []struct {
+		money Money
+		want  string
+	}{
+		{12_34, `"12.34"`},
+		{12_00, `"12.00"`},
+		{5, `"0.05"`},
+		{-1_05, `"-1.05"`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(tt.money)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("Marshal(%d) = %s, %v, want %s", tt.money, got, err, tt.want)
+		}
+
+		var back Money
+		if err := json.Unmarshal(got, &back); err != nil || back != tt.money {
+			t.Errorf("round trip of %d gave %d, %v", tt.money, back, err)
+		}
+	}
+}
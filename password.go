@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy is what new passwords must satisfy. Existing passwords are
+// never checked against it.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+}
+
+// WeakPasswordError lists the requirements of the password policy a password
+// doesn't meet, e.g. "contain a digit".
+type WeakPasswordError struct {
+	Unmet []string
+}
+
+func (e *WeakPasswordError) Error() string {
+	return "password must " + strings.Join(e.Unmet, ", ")
+}
+
+// ValidateStrength checks pw against the policy, returning a WeakPasswordError
+// naming every unmet requirement.
+func (p PasswordPolicy) ValidateStrength(pw string) error {
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range pw {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+
+	var unmet []string
+	if n := len([]rune(pw)); n < p.MinLength {
+		unmet = append(unmet, fmt.Sprintf("be at least %d characters long", p.MinLength))
+	}
+	if p.RequireUpper && !hasUpper {
+		unmet = append(unmet, "contain an uppercase letter")
+	}
+	if p.RequireLower && !hasLower {
+		unmet = append(unmet, "contain a lowercase letter")
+	}
+	if p.RequireDigit && !hasDigit {
+		unmet = append(unmet, "contain a digit")
+	}
+	if p.RequireSymbol && !hasSymbol {
+		unmet = append(unmet, "contain a symbol")
+	}
+
+	if len(unmet) > 0 {
+		return &WeakPasswordError{Unmet: unmet}
+	}
+	return nil
+}
+
+// validateField runs ValidateStrength on the request field named field,
+// reporting a weak password like any other invalid field.
+func (p PasswordPolicy) validateField(field, pw string) error {
+	err := p.ValidateStrength(pw)
+
+	var weak *WeakPasswordError
+	if errors.As(err, &weak) {
+		return &ValidationError{Fields: []FieldError{{Field: field, Message: "must " + strings.Join(weak.Unmet, ", ")}}}
+	}
+	return err
+}
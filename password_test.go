@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicyValidateStrength(t *testing.T) {
+	defaults := PasswordPolicy{MinLength: 8, RequireUpper: true, RequireLower: true, RequireDigit: true}
+	strict := PasswordPolicy{MinLength: 12, RequireUpper: true, RequireLower: true, RequireDigit: true, RequireSymbol: true}
+	lax := PasswordPolicy{MinLength: 4}
+
+	tests := []struct {
+		name   string
+		policy PasswordPolicy
+		pw     string
+		unmet  []string
+	}{
+		{"strong", defaults, "Passw0rd", nil},
+		{"strong unicode", defaults, "Ünïcöde9", nil},
+		{"too short", defaults, "Pa55", []string{"be at least 8 characters long"}},
+		{"no uppercase", defaults, "passw0rd", []string{"contain an uppercase letter"}},
+		{"no lowercase", defaults, "PASSW0RD", []string{"contain a lowercase letter"}},
+		{"no digit", defaults, "Password", []string{"contain a digit"}},
+		{"empty", defaults, "", []string{
+			"be at least 8 characters long", "contain an uppercase letter", "contain a lowercase letter", "contain a digit",
+		}},
+		{"strict strong", strict, "Passw0rd!Long", nil},
+		{"strict no symbol", strict, "Passw0rdLong", []string{"contain a symbol"}},
+		{"strict short", strict, "Passw0rd!", []string{"be at least 12 characters long"}},
+		{"lax", lax, "abcd", nil},
+		{"lax too short", lax, "abc", []string{"be at least 4 characters long"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.policy.ValidateStrength(tt.pw)
+			if tt.unmet == nil {
+				if err != nil {
+					t.Fatalf("ValidateStrength(%q) = %v, want nil", tt.pw, err)
+				}
+				return
+			}
+
+			var weak *WeakPasswordError
+			if !errors.As(err, &weak) {
+				t.Fatalf("ValidateStrength(%q) = %v, want a WeakPasswordError", tt.pw, err)
+			}
+			if !reflect.DeepEqual(weak.Unmet, tt.unmet) {
+				t.Errorf("ValidateStrength(%q) unmet %q, want %q", tt.pw, weak.Unmet, tt.unmet)
+			}
+		})
+	}
+}
+
+func TestLoadPasswordPolicy(t *testing.T) {
+	t.Setenv("PASSWORD_MIN_LENGTH", "10")
+	t.Setenv("PASSWORD_REQUIRE_SYMBOL", "true")
+	t.Setenv("PASSWORD_REQUIRE_DIGIT", "false")
+
+	got := testConfig(t).PasswordPolicy
+	want := PasswordPolicy{MinLength: 10, RequireUpper: true, RequireLower: true, RequireSymbol: true}
+	if got != want {
+		t.Errorf("PasswordPolicy = %+v, want %+v", got, want)
+	}
+}
+
+func TestCreateAccountAppliesServerPasswordPolicy(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.PasswordPolicy = PasswordPolicy{MinLength: 8, RequireSymbol: true}
+	s := NewAPIServer("", nil, cfg)
+
+	body := `{"first_name": "Ada", "last_name": "Lovelace", "email": "ada@example.com", "password": "Passw0rdLong"}`
+	req := httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	s.makeHTTPHandler(s.handleCreateAccount)(rec, req)
+
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "contain a symbol") {
+		t.Errorf("got %d %s, want 400 asking for a symbol", rec.Code, rec.Body)
+	}
+}
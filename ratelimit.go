@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrRateLimited is returned when a client made too many requests.
+var ErrRateLimited = errors.New("too many requests")
+
+// RateLimiter allows a client, identified by key, at most a number of requests
+// per sliding window. Every backend must behave the same, so that switching
+// backends doesn't change what clients see.
+type RateLimiter interface {
+	// Allow records a request of key if it is within the limit. Otherwise it
+	// reports how long until the next request would be.
+	Allow(ctx context.Context, key string) (allowed bool, retryAfter time.Duration, err error)
+}
+
+const (
+	RateLimitBackendMemory = "memory"
+	RateLimitBackendRedis  = "redis"
+)
+
+// loadRateLimiter reads RATE_LIMIT_REQUESTS, RATE_LIMIT_WINDOW and
+// RATE_LIMIT_BACKEND, plus REDIS_URL for the redis backend. Zero requests
+// disables rate limiting and returns nil.
+func loadRateLimiter(clock Clock) (RateLimiter, error) {
+	return loadLimiter("RATE_LIMIT_REQUESTS", 0, "RATE_LIMIT_WINDOW", time.Minute, clock)
+}
+
+// loadAccountCreationLimiter reads ACCOUNT_CREATION_LIMIT and
+// ACCOUNT_CREATION_WINDOW, the accounts one IP address may open per window.
+// It shares the backend of loadRateLimiter. Zero accounts disables the limit
+// and returns nil.
+func loadAccountCreationLimiter(clock Clock) (RateLimiter, error) {
+	return loadLimiter("ACCOUNT_CREATION_LIMIT", 10, "ACCOUNT_CREATION_WINDOW", time.Hour, clock)
+}
+
+// loadLimiter reads a limit and its window from the environment variables
+// limitKey and windowKey, and the backend from RATE_LIMIT_BACKEND.
+func loadLimiter(limitKey string, defaultLimit int, windowKey string, defaultWindow time.Duration, clock Clock) (RateLimiter, error) {
+	limit, err := envInt(limitKey, defaultLimit)
+	if err != nil || limit == 0 {
+		return nil, err
+	}
+	if limit < 0 {
+		return nil, fmt.Errorf("%s must not be negative", limitKey)
+	}
+
+	window, err := envDuration(windowKey, defaultWindow)
+	if err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return nil, fmt.Errorf("%s must be positive", windowKey)
+	}
+
+	switch backend := envString("RATE_LIMIT_BACKEND", RateLimitBackendMemory); backend {
+	case RateLimitBackendMemory:
+		return NewMemoryRateLimiter(limit, window, clock), nil
+	case RateLimitBackendRedis:
+		opts, err := redis.ParseURL(envString("REDIS_URL", "redis://localhost:6379/0"))
+		if err != nil {
+			return nil, fmt.Errorf("REDIS_URL: %w", err)
+		}
+		return NewRedisRateLimiter(redis.NewClient(opts), limit, window), nil
+	default:
+		return nil, fmt.Errorf("RATE_LIMIT_BACKEND must be %s or %s, got %q", RateLimitBackendMemory, RateLimitBackendRedis, backend)
+	}
+}
+
+// withRateLimit rejects the requests of clients over the limit with 429 Too
+// Many Requests and a Retry-After header. Clients are told apart by their IP
+// address.
+func (s *APIServer) withRateLimit(next http.Handler) http.Handler {
+	if s.cfg.RateLimiter == nil {
+		return next
+	}
+	return limitRequests(s.cfg.RateLimiter, "", next)
+}
+
+// withAccountCreationLimit rejects account creations from IP addresses that
+// opened too many accounts lately, like withRateLimit but with a limit of its
+// own, on top of the global one. It fails open like any limit: while the
+// Redis backend is unreachable, accounts can be opened without limit.
+func (s *APIServer) withAccountCreationLimit(fn http.HandlerFunc) http.HandlerFunc {
+	if s.cfg.AccountCreationLimiter == nil {
+		return fn
+	}
+	return limitRequests(s.cfg.AccountCreationLimiter, "create-account:", fn).ServeHTTP
+}
+
+// limitRequests lets through the requests that limiter allows, keyed by the
+// client IP after prefix, which keeps limiters sharing a Redis apart. It
+// fails open: should the limiter fail, requests are let through unlimited,
+// with the error logged, rather than taking the whole API down with it.
+func limitRequests(limiter RateLimiter, prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, retryAfter, err := limiter.Allow(r.Context(), prefix+clientIP(r))
+		if err != nil {
+			log.Printf("rate limiter (request %s): %v", getRequestID(r), err)
+		}
+		if err == nil && !allowed {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+			writeError(w, r, ErrRateLimited)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP returns the IP address the request came from. Forwarding headers
+// are ignored, since any client can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// memoryRateLimiter keeps the request times of every client in process, which
+// only works with a single server instance.
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	limit     int
+	window    time.Duration
+	hits      map[string][]time.Time // oldest first
+	lastSweep time.Time
+	clock     Clock
+}
+
+// NewMemoryRateLimiter allows limit requests per window to every client, as
+// timed by clock.
+func NewMemoryRateLimiter(limit int, window time.Duration, clock Clock) RateLimiter {
+	return &memoryRateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   make(map[string][]time.Time),
+		clock:  clock,
+	}
+}
+
+func (l *memoryRateLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	cutoff := now.Add(-l.window)
+	l.sweep(now, cutoff)
+
+	hits := l.hits[key]
+	for len(hits) > 0 && !hits[0].After(cutoff) {
+		hits = hits[1:]
+	}
+
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false, hits[0].Sub(cutoff), nil
+	}
+
+	l.hits[key] = append(hits, now)
+	return true, 0, nil
+}
+
+// sweep forgets the clients without a request in the window, at most once
+// per window, so that idle clients don't pile up.
+func (l *memoryRateLimiter) sweep(now, cutoff time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+
+	for key, hits := range l.hits {
+		if !hits[len(hits)-1].After(cutoff) {
+			delete(l.hits, key)
+		}
+	}
+}
+
+// redisRateLimiter keeps the request times of every client in a Redis sorted
+// set, shared by all server instances.
+type redisRateLimiter struct {
+	client *redis.Client
+	limit  int
+	window time.Duration
+}
+
+// NewRedisRateLimiter allows limit requests per window to every client,
+// counted across every server instance using client.
+func NewRedisRateLimiter(client *redis.Client, limit int, window time.Duration) RateLimiter {
+	return &redisRateLimiter{client: client, limit: limit, window: window}
+}
+
+// slidingWindowScript records a request unless the client is over the limit,
+// atomically. It uses the clock of Redis, so that instances with skewed
+// clocks agree. It returns 0 when the request is allowed, or else the
+// milliseconds until the oldest request leaves the window.
+//
+// KEYS[1] is the sorted set of the client; ARGV are the window in
+// microseconds, the limit and a unique member for the request.
+var slidingWindowScript = redis.NewScript(`
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+local window = tonumber(ARGV[1])
+local cutoff = now - window
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', cutoff)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+	local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+	return math.max(math.ceil((tonumber(oldest[2]) - cutoff) / 1000), 1)
+end
+
+redis.call('ZADD', KEYS[1], now, ARGV[3])
+redis.call('PEXPIRE', KEYS[1], math.ceil(window / 1000))
+return 0
+`)
+
+func (l *redisRateLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	wait, err := slidingWindowScript.Run(ctx, l.client, []string{"ratelimit:" + key},
+		l.window.Microseconds(), l.limit, randomHex(8)).Int64()
+	if err != nil {
+		return false, 0, err
+	}
+	if wait > 0 {
+		return false, time.Duration(wait) * time.Millisecond, nil
+	}
+	return true, 0, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// limiterBackends returns a limiter of every backend allowing limit requests
+// per window, each with a way to move its clock forward.
+func limiterBackends(t *testing.T, limit int, window time.Duration) map[string]func() (RateLimiter, func(time.Duration)) {
+	start := time.Date(2024, 1, 31, 9, 30, 0, 0, time.UTC)
+	return map[string]func() (RateLimiter, func(time.Duration)){
+		RateLimitBackendMemory: func() (RateLimiter, func(time.Duration)) {
+			clock := newFakeClock(start)
+			return NewMemoryRateLimiter(limit, window, clock), clock.Advance
+		},
+		RateLimitBackendRedis: func() (RateLimiter, func(time.Duration)) {
+			server := miniredis.RunT(t)
+			server.SetTime(start)
+			client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+			t.Cleanup(func() { client.Close() })
+
+			now := start
+			advance := func(d time.Duration) {
+				now = now.Add(d)
+				server.SetTime(now)
+			}
+			return NewRedisRateLimiter(client, limit, window), advance
+		},
+	}
+}
+
+func TestRateLimiterSlidingWindow(t *testing.T) {
+	for name, newLimiter := range limiterBackends(t, 2, time.Minute) {
+		t.Run(name, func(t *testing.T) {
+			limiter, advance := newLimiter()
+			ctx := context.Background()
+
+			allow := func(key string) (bool, time.Duration) {
+				t.Helper()
+				allowed, retryAfter, err := limiter.Allow(ctx, key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return allowed, retryAfter
+			}
+
+			if ok, _ := allow("a"); !ok {
+				t.Fatal("first request refused")
+			}
+			advance(20 * time.Second)
+			if ok, _ := allow("a"); !ok {
+				t.Fatal("second request refused")
+			}
+
+			ok, retryAfter := allow("a")
+			if ok {
+				t.Fatal("third request within the window allowed")
+			}
+			if retryAfter != 40*time.Second {
+				t.Errorf("retry after %s, want the 40s until the first request leaves the window", retryAfter)
+			}
+
+			// Other clients have limits of their own.
+			if ok, _ := allow("b"); !ok {
+				t.Error("another client was refused")
+			}
+
+			// Refused requests don't count, so the first one leaving the
+			// window makes room for exactly one more.
+			advance(40 * time.Second)
+			if ok, _ := allow("a"); !ok {
+				t.Fatal("request after the first one left the window refused")
+			}
+			if ok, _ := allow("a"); ok {
+				t.Error("request over the limit allowed")
+			}
+		})
+	}
+}
+
+func TestRedisRateLimiterFailsOpen(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr(), MaxRetries: -1})
+	defer client.Close()
+	limiter := NewRedisRateLimiter(client, 1, time.Minute)
+	server.Close()
+
+	if _, _, err := limiter.Allow(context.Background(), "a"); err == nil {
+		t.Fatal("Allow succeeded without Redis")
+	}
+
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	handler := limitRequests(limiter, "create-account:", ok)
+	for i := 0; i < 3; i++ {
+		if rec := serve(handler, http.MethodPost, "/account", "", nil); rec.Code != http.StatusNoContent {
+			t.Fatalf("request %d without Redis: got %d, want it let through", i, rec.Code)
+		}
+	}
+}
+
+func TestAccountCreationIsThrottledButReadsAreNot(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RateLimiter = nil
+	cfg.AccountCreationLimiter = NewMemoryRateLimiter(2, time.Hour, newFakeClock(time.Now()))
+	routes := NewAPIServer("", nil, cfg).routes()
+
+	request := func(method, target, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(`{}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Invalid requests count too, or they could be used to probe for free.
+	for i := 0; i < 2; i++ {
+		if rec := request(http.MethodPost, "/account", "192.0.2.1:1234"); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("account creation %d throttled within the limit", i)
+		}
+	}
+	rec := request(http.MethodPost, "/account", "192.0.2.1:5678")
+	if body := decodeError(t, rec); rec.Code != http.StatusTooManyRequests || body.Code != CodeRateLimited || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("account creation over the limit: got %d %s, want 429 with Retry-After", rec.Code, rec.Body)
+	}
+
+	// The same client reads as much as it likes, and others open accounts.
+	for i := 0; i < 5; i++ {
+		if rec := request(http.MethodGet, "/version", "192.0.2.1:1234"); rec.Code != http.StatusOK {
+			t.Fatalf("read %d after the account creation limit: got %d, want 200", i, rec.Code)
+		}
+	}
+	if rec := request(http.MethodPost, "/account", "198.51.100.1:1234"); rec.Code == http.StatusTooManyRequests {
+		t.Error("another client's account creation was throttled")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// transientErrorCodes are the Postgres error codes worth retrying: the
+// transaction was rolled back only because of contention with another one.
+var transientErrorCodes = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+}
+
+// isTransient reports whether err is a Postgres error that may succeed on retry.
+func isTransient(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && transientErrorCodes[pqErr.Code]
+}
+
+// retryPolicy retries transient failures with exponential backoff.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+}
+
+// do calls fn until it succeeds, fails with a non-transient error, or has been
+// tried maxAttempts times. fn must be safe to run again, e.g. a whole
+// transaction that was rolled back. The delay doubles after every attempt.
+func (p retryPolicy) do(fn func() error) error {
+	delay := p.baseDelay
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || !isTransient(err) || attempt >= p.maxAttempts {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
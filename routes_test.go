@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestUnknownRouteIsJSONNotFound(t *testing.T) {
+	routes := NewAPIServer("", nil, testConfig(t)).routes()
+
+	rec := serve(routes, http.MethodGet, "/no/such/route", "", nil)
+	if rec.Code != http.StatusNotFound || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("got %d %s %s, want a JSON 404", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	if body := decodeError(t, rec); body.Code != CodeRouteNotFound || !strings.Contains(body.Message, "GET /no/such/route") {
+		t.Errorf("got %s %q, want %s naming the method and path", body.Code, body.Message, CodeRouteNotFound)
+	}
+}
+
+func TestWrongMethodIsJSONMethodNotAllowed(t *testing.T) {
+	routes := NewAPIServer("", nil, testConfig(t)).routes()
+
+	rec := serve(routes, http.MethodDelete, "/login", "", nil)
+	if rec.Code != http.StatusMethodNotAllowed || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("got %d %s %s, want a JSON 405", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+	if body := decodeError(t, rec); body.Code != CodeMethodNotAllowed || !strings.Contains(body.Message, "DELETE /login") {
+		t.Errorf("got %s %q, want %s naming the method and path", body.Code, body.Message, CodeMethodNotAllowed)
+	}
+}
+
+func TestWrongMethodListsTheAllowedOnes(t *testing.T) {
+	routes := NewAPIServer("", nil, testConfig(t)).routes()
+
+	tests := []struct {
+		method, path string
+		allow        []string
+	}{
+		{http.MethodGet, "/login", []string{"POST"}},
+		{http.MethodPut, "/account", []string{"GET", "POST"}},
+		{http.MethodPost, "/account/1", []string{"DELETE", "GET", "HEAD", "PATCH", "PUT"}},
+		{http.MethodDelete, "/account/number/79927398713", []string{"GET"}},
+		{http.MethodGet, "/account/1/deposit", []string{"POST"}},
+		{http.MethodPut, "/account/1/statement/email", []string{"GET", "POST"}},
+		{http.MethodGet, "/transfer", []string{"POST"}},
+		{http.MethodPost, "/transfer/fees", []string{"GET"}},
+		{http.MethodPost, "/transfers", []string{"GET"}},
+		{http.MethodGet, "/transfer/1/confirm", []string{"POST"}},
+		{http.MethodDelete, "/customers/1/accounts", []string{"GET", "POST"}},
+		{http.MethodPost, "/me", []string{"GET"}},
+	}
+	for _, tt := range tests {
+		rec := serve(routes, tt.method, tt.path, "", nil)
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: got %d %s, want 405", tt.method, tt.path, rec.Code, rec.Body)
+			continue
+		}
+		allow := strings.Split(rec.Header().Get("Allow"), ", ")
+		slices.Sort(allow)
+		if !slices.Equal(allow, tt.allow) {
+			t.Errorf("%s %s: Allow %v, want %v", tt.method, tt.path, allow, tt.allow)
+		}
+	}
+}
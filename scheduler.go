@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// runScheduler executes due scheduled transfers every poll interval until ctx
+// is done. It is meant to run in its own goroutine, with a single instance per
+// deployment.
+func (s *APIServer) runScheduler(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.SchedulePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.runDueScheduledTransfers(s.clock.Now())
+		s.expirePendingTransfers()
+	}
+}
+
+// expirePendingTransfers releases the funds held by transfers that weren't
+// confirmed in time.
+func (s *APIServer) expirePendingTransfers() {
+	n, err := s.store.ExpirePendingTransfers()
+	if err != nil {
+		log.Println("expiring pending transfers:", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("Expired %d pending transfers", n)
+	}
+}
+
+func (s *APIServer) runDueScheduledTransfers(now time.Time) {
+	schedules, err := s.store.GetDueScheduledTransfers(now)
+	if err != nil {
+		log.Println("loading scheduled transfers:", err)
+		return
+	}
+
+	for _, st := range schedules {
+		_, runErr := s.store.Transfer(st.AccountID, st.ToAccount, st.Amount, TransactionLabels{})
+		s.advanceSchedule(st, runErr, now)
+
+		if err := s.store.RecordScheduledTransferRun(st, runErr); err != nil {
+			log.Printf("recording run of scheduled transfer %d: %v", st.ID, err)
+		}
+	}
+}
+
+// advanceSchedule moves st to its next occurrence after a successful run. A
+// failed run is retried after the retry delay until it has failed more than
+// the configured number of retries, then that occurrence is skipped. Retries
+// don't shift the schedule itself.
+func (s *APIServer) advanceSchedule(st *ScheduledTransfer, runErr error, now time.Time) {
+	if runErr == nil {
+		st.NextRun = NewTimestamp(st.Frequency.Next(st.NextRun.Time))
+		st.RetryAt = nil
+		st.Failures = 0
+		st.LastError = ""
+		return
+	}
+
+	st.Failures++
+	st.LastError = runErr.Error()
+	log.Printf("scheduled transfer %d failed (attempt %d): %v", st.ID, st.Failures, runErr)
+
+	if st.Failures > s.cfg.ScheduleMaxRetries {
+		st.NextRun = NewTimestamp(st.Frequency.Next(st.NextRun.Time))
+		st.RetryAt = nil
+		st.Failures = 0
+		return
+	}
+
+	retryAt := NewTimestamp(now.Add(s.cfg.ScheduleRetryDelay))
+	st.RetryAt = &retryAt
+}
+
+// handleCreateScheduledTransfer handles POST requests for setting up a standing order.
+func (s *APIServer) handleCreateScheduledTransfer(w http.ResponseWriter, r *http.Request) error {
+	req := &CreateScheduledTransferRequest{}
+	if err := decodeAndValidate(w, r, req); err != nil {
+		return err
+	}
+	if req.NextRun.Before(s.clock.Now()) {
+		return fmt.Errorf("next_run must be in the future")
+	}
+
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.store.GetAccountById(id)
+	if err != nil {
+		return err
+	}
+	if err := requireVerifiedEmail(account); err != nil {
+		return err
+	}
+	if _, err := s.store.GetAccountByNumber(req.ToAccount); err != nil {
+		return err
+	}
+
+	st := &ScheduledTransfer{
+		AccountID: id,
+		ToAccount: req.ToAccount,
+		Amount:    req.Amount,
+		Frequency: req.Frequency,
+		NextRun:   NewTimestamp(req.NextRun),
+		CreatedAt: NewTimestamp(s.clock.Now()),
+	}
+
+	if err := s.store.CreateScheduledTransfer(st); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, st)
+}
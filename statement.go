@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// statementDateLayout is the format of the from/to query parameters.
+const statementDateLayout = "2006-01-02"
+
+// handleStatement handles GET requests for downloading an account's statement.
+func (s *APIServer) handleStatement(w http.ResponseWriter, r *http.Request) error {
+	filter, err := getStatementPeriod(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "csv":
+		return s.writeCSVStatement(r.Context(), w, account, filter)
+	case "pdf":
+		return s.writePDFStatement(r.Context(), w, account, filter)
+	default:
+		return fmt.Errorf("unsupported statement format: %s", format)
+	}
+}
+
+// handleGetTransactions handles GET requests for an account's history, newest
+// first, using cursor pagination.
+func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	id, err := getId(r)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	filter := TransactionFilter{Category: query.Get("category")}
+
+	if str := query.Get("cursor"); str != "" {
+		filter.Before, err = strconv.Atoi(str)
+		if err != nil || filter.Before < 1 {
+			return fmt.Errorf("invalid cursor: %s", str)
+		}
+	}
+
+	limit, _, err := getPagination(r)
+	if err != nil {
+		return err
+	}
+
+	// Fetching one extra entry tells whether there is a next page.
+	transactions, err := s.store.GetTransactionsByAccount(r.Context(), id, filter, limit+1)
+	if err != nil {
+		return err
+	}
+
+	page := TransactionPage{Transactions: transactions}
+	if len(transactions) > limit {
+		page.Transactions = transactions[:limit]
+		page.NextCursor = &page.Transactions[limit-1].ID
+	}
+
+	// With cursors only the first and next pages can be linked to.
+	links := []string{pageLink(r, "first", map[string]string{"cursor": ""})}
+	if page.NextCursor != nil {
+		links = append(links, pageLink(r, "next", map[string]string{"cursor": strconv.Itoa(*page.NextCursor)}))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+
+	return WriteJSON(w, http.StatusOK, page)
+}
+
+// handleGetTransaction handles GET requests for a single ledger entry of the
+// authenticated account.
+func (s *APIServer) handleGetTransaction(w http.ResponseWriter, r *http.Request) error {
+	id, err := getTransactionID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	transaction, err := s.store.GetTransactionById(id)
+	if err != nil {
+		return err
+	}
+
+	if transaction.AccountID != account.ID {
+		return ErrPermissionDenied
+	}
+
+	return WriteJSON(w, http.StatusOK, transaction)
+}
+
+// getStatementPeriod reads the optional from/to dates. Both are inclusive
+// calendar days in UTC.
+func getStatementPeriod(r *http.Request) (TransactionFilter, error) {
+	var filter TransactionFilter
+	query := r.URL.Query()
+
+	if str := query.Get("from"); str != "" {
+		from, err := time.Parse(statementDateLayout, str)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from date: %s", str)
+		}
+		filter.From = from
+	}
+
+	if str := query.Get("to"); str != "" {
+		to, err := time.Parse(statementDateLayout, str)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to date: %s", str)
+		}
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	if !filter.From.IsZero() && !filter.To.IsZero() && !filter.From.Before(filter.To) {
+		return filter, fmt.Errorf("from must not be after to")
+	}
+
+	return filter, nil
+}
+
+// statementFilename builds the attachment name, e.g. "statement-12345678.csv".
+func statementFilename(account *Account, filter TransactionFilter, ext string) string {
+	name := fmt.Sprintf("statement-%d", account.Number)
+	if !filter.From.IsZero() {
+		name += "-from-" + filter.From.Format(statementDateLayout)
+	}
+	if !filter.To.IsZero() {
+		name += "-to-" + filter.To.AddDate(0, 0, -1).Format(statementDateLayout)
+	}
+	return name + "." + ext
+}
+
+// writeCSVStatement streams the account's transactions as CSV, one row per
+// ledger entry as it is read from the store.
+func (s *APIServer) writeCSVStatement(ctx context.Context, w http.ResponseWriter, account *Account, filter TransactionFilter) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", statementFilename(account, filter, "csv")))
+
+	// The headers are already sent at this point, so errors can only be logged.
+	if err := s.renderCSVStatement(ctx, w, account, filter); err != nil {
+		log.Println("writing statement:", err)
+	}
+	return nil
+}
+
+// renderCSVStatement writes the CSV statement of account to w.
+func (s *APIServer) renderCSVStatement(ctx context.Context, w io.Writer, account *Account, filter TransactionFilter) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"date", "type", "counterparty", "amount", "balance"})
+
+	err := s.store.ForEachTransaction(ctx, account.ID, filter, func(t *Transaction) error {
+		counterparty := ""
+		if t.Counterparty != 0 {
+			counterparty = fmt.Sprint(t.Counterparty)
+		}
+		return cw.Write([]string{
+			t.CreatedAt.UTC().Format(time.RFC3339),
+			string(t.Type),
+			counterparty,
+			t.Amount.decimal(),
+			t.Balance.decimal(),
+		})
+	})
+
+	cw.Flush()
+	if err == nil {
+		err = cw.Error()
+	}
+	return err
+}
+
+// statementPeriod describes the filter for humans, e.g. "2024-01-01 to 2024-01-31".
+func statementPeriod(filter TransactionFilter) string {
+	from, to := "account opening", "today"
+	if !filter.From.IsZero() {
+		from = filter.From.Format(statementDateLayout)
+	}
+	if !filter.To.IsZero() {
+		to = filter.To.AddDate(0, 0, -1).Format(statementDateLayout)
+	}
+	return from + " to " + to
+}
+
+// writePDFStatement renders the statement as a one-table PDF document.
+func (s *APIServer) writePDFStatement(ctx context.Context, w http.ResponseWriter, account *Account, filter TransactionFilter) error {
+	pdf, err := s.renderPDFStatement(ctx, account, filter)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", statementFilename(account, filter, "pdf")))
+
+	// The headers are already sent once the document starts streaming, so
+	// errors can only be logged.
+	if err := pdf.Output(w); err != nil {
+		log.Println("writing statement:", err)
+	}
+	return nil
+}
+
+// renderPDFStatement lays out the PDF statement of account, ready for output.
+func (s *APIServer) renderPDFStatement(ctx context.Context, account *Account, filter TransactionFilter) (*fpdf.Fpdf, error) {
+	opening, err := s.store.BalanceAt(ctx, account.ID, filter.From)
+	if err != nil {
+		return nil, err
+	}
+
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.AddPage()
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.Cell(0, 10, "Account statement")
+	pdf.Ln(12)
+
+	pdf.SetFont("Helvetica", "", 11)
+	pdf.Cell(0, 6, fmt.Sprintf("Account holder: %s %s", account.FirstName, account.LastName))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, fmt.Sprintf("Account number: %d", account.Number))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, "Period: "+statementPeriod(filter))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, "Opening balance: "+opening.String())
+	pdf.Ln(10)
+
+	widths := []float64{45, 35, 35, 35, 35}
+	pdf.SetFont("Helvetica", "B", 10)
+	for i, header := range []string{"Date", "Type", "Counterparty", "Amount", "Balance"} {
+		pdf.CellFormat(widths[i], 7, header, "1", 0, "C", false, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Helvetica", "", 10)
+	closing, count := opening, 0
+	err = s.store.ForEachTransaction(ctx, account.ID, filter, func(t *Transaction) error {
+		counterparty := ""
+		if t.Counterparty != 0 {
+			counterparty = fmt.Sprint(t.Counterparty)
+		}
+		pdf.CellFormat(widths[0], 6, t.CreatedAt.UTC().Format("2006-01-02 15:04"), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[1], 6, string(t.Type), "1", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[2], 6, counterparty, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(widths[3], 6, t.Amount.String(), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(widths[4], 6, t.Balance.String(), "1", 0, "R", false, 0, "")
+		pdf.Ln(-1)
+
+		closing = t.Balance
+		count++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if count == 0 {
+		pdf.CellFormat(185, 6, "No transactions in this period.", "1", 0, "C", false, 0, "")
+		pdf.Ln(-1)
+	}
+
+	pdf.Ln(4)
+	pdf.SetFont("Helvetica", "B", 11)
+	pdf.Cell(0, 6, "Closing balance: "+closing.String())
+
+	return pdf, pdf.Error()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// maxStatementEmailAttempts is how many times a statement email is tried,
+	// once every poll, before it is marked failed.
+	maxStatementEmailAttempts = 3
+
+	// statementEmailBatchSize bounds the statement emails sent every poll.
+	statementEmailBatchSize = 20
+
+	// statementEmailTimeout bounds rendering and sending one statement.
+	statementEmailTimeout = time.Minute
+)
+
+// StatementEmailStatus tells what became of a statement queued for email.
+type StatementEmailStatus string
+
+const (
+	StatementEmailPending StatementEmailStatus = "pending"
+	StatementEmailSent    StatementEmailStatus = "sent"
+	StatementEmailFailed  StatementEmailStatus = "failed"
+)
+
+// StatementEmail is a statement queued for email to the holder of an account,
+// and how its delivery went.
+type StatementEmail struct {
+	ID        int                  `json:"id"`
+	AccountID int                  `json:"account_id"`
+	Email     string               `json:"email"`
+	Format    string               `json:"format"`
+	From      *Timestamp           `json:"from,omitempty"` // inclusive, omitted from account opening
+	To        *Timestamp           `json:"to,omitempty"`   // exclusive, omitted up to the sending
+	Status    StatementEmailStatus `json:"status"`
+	Attempts  int                  `json:"attempts"`
+	Error     string               `json:"error,omitempty"` // of the last failed attempt
+	CreatedAt Timestamp            `json:"created_at"`
+	SentAt    *Timestamp           `json:"sent_at,omitempty"`
+}
+
+// filter is the period of the statement as a TransactionFilter.
+func (e *StatementEmail) filter() TransactionFilter {
+	var filter TransactionFilter
+	if e.From != nil {
+		filter.From = e.From.Time
+	}
+	if e.To != nil {
+		filter.To = e.To.Time
+	}
+	return filter
+}
+
+// handleEmailStatement handles POST requests for emailing an account's
+// statement to its verified email address. It takes the from, to and format
+// query parameters of downloads. The email is only queued here; GET requests
+// on the same path tell how it went.
+func (s *APIServer) handleEmailStatement(w http.ResponseWriter, r *http.Request) error {
+	filter, err := getStatementPeriod(r)
+	if err != nil {
+		return err
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = "csv"
+	case "csv", "pdf":
+	default:
+		return fmt.Errorf("unsupported statement format: %s", format)
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+	if account.Email == "" {
+		return errors.New("account has no email address")
+	}
+	if err := requireVerifiedEmail(account); err != nil {
+		return err
+	}
+
+	email := &StatementEmail{AccountID: account.ID, Email: account.Email, Format: format}
+	if !filter.From.IsZero() {
+		from := NewTimestamp(filter.From)
+		email.From = &from
+	}
+	if !filter.To.IsZero() {
+		to := NewTimestamp(filter.To)
+		email.To = &to
+	}
+
+	if err := s.store.CreateStatementEmail(email); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusAccepted, email)
+}
+
+// handleGetStatementEmails handles GET requests for the statement emails of an
+// account, newest first.
+func (s *APIServer) handleGetStatementEmails(w http.ResponseWriter, r *http.Request) error {
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	limit, _, err := getPagination(r)
+	if err != nil {
+		return err
+	}
+
+	emails, err := s.store.GetStatementEmails(r.Context(), account.ID, limit)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, emails)
+}
+
+// runStatementEmails sends the statements queued for email every poll
+// interval until ctx is done. It is meant to run in its own goroutine, with a
+// single instance per deployment.
+func (s *APIServer) runStatementEmails(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.StatementEmailPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.sendPendingStatementEmails()
+	}
+}
+
+func (s *APIServer) sendPendingStatementEmails() {
+	emails, err := s.store.GetPendingStatementEmails(statementEmailBatchSize)
+	if err != nil {
+		log.Println("loading statement emails:", err)
+		return
+	}
+
+	for _, email := range emails {
+		sendErr := s.sendStatementEmail(email)
+		if sendErr != nil {
+			log.Printf("sending statement email %d, attempt %d: %v", email.ID, email.Attempts+1, sendErr)
+		}
+		if err := s.store.RecordStatementEmailAttempt(email.ID, sendErr, maxStatementEmailAttempts); err != nil {
+			log.Printf("recording statement email %d: %v", email.ID, err)
+		}
+	}
+}
+
+// sendStatementEmail renders the statement of email and sends it as an
+// attachment.
+func (s *APIServer) sendStatementEmail(email *StatementEmail) error {
+	ctx, cancel := context.WithTimeout(context.Background(), statementEmailTimeout)
+	defer cancel()
+
+	account, err := s.store.GetAccountById(email.AccountID)
+	if err != nil {
+		return err
+	}
+
+	filter := email.filter()
+	attachment := &Attachment{Filename: statementFilename(account, filter, email.Format)}
+
+	var buf bytes.Buffer
+	switch email.Format {
+	case "pdf":
+		pdf, err := s.renderPDFStatement(ctx, account, filter)
+		if err != nil {
+			return err
+		}
+		if err := pdf.Output(&buf); err != nil {
+			return err
+		}
+		attachment.ContentType = "application/pdf"
+	default:
+		if err := s.renderCSVStatement(ctx, &buf, account, filter); err != nil {
+			return err
+		}
+		attachment.ContentType = "text/csv"
+	}
+	attachment.Data = buf.Bytes()
+
+	return s.emails.Send(&Email{
+		To:      email.Email,
+		Subject: "Your account statement",
+		Body: fmt.Sprintf("Hello %s,\n\nAttached is the statement of account %d for %s.\n",
+			account.FirstName, account.Number, statementPeriod(filter)),
+		Attachments: []*Attachment{attachment},
+	})
+}
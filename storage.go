@@ -2,52 +2,331 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+// ErrAccountNotFound is returned when no account matches a lookup.
+var ErrAccountNotFound = errors.New("account not found")
+
+// ErrEmailTaken is returned when an account with the same email already exists.
+var ErrEmailTaken = errors.New("email already in use")
+
+// ErrStaleUpdate is returned when an account changed since the version the
+// client read.
+var ErrStaleUpdate = errors.New("account was modified concurrently, reload it and retry")
+
+// ErrAccountFrozen and ErrAccountClosed are returned when money would move in
+// or out of an account that isn't active.
+var (
+	ErrAccountFrozen = errors.New("account is frozen")
+	ErrAccountClosed = errors.New("account is closed")
+)
+
+// ErrDailyLimitExceeded is matched by every DailyLimitError.
+var ErrDailyLimitExceeded = errors.New("daily transfer limit exceeded")
+
+// DailyLimitError reports a transfer that would take an account past its
+// daily transfer limit.
+type DailyLimitError struct {
+	Limit     Money
+	Remaining Money // what may still be sent today
+}
+
+func (e *DailyLimitError) Error() string {
+	return fmt.Sprintf("daily transfer limit of %s exceeded, %s remaining today", e.Limit, e.Remaining)
+}
+
+func (e *DailyLimitError) Is(target error) bool {
+	return target == ErrDailyLimitExceeded
+}
+
+func (e *DailyLimitError) Details() map[string]interface{} {
+	return map[string]interface{}{"limit": e.Limit, "remaining": e.Remaining}
+}
+
+// ErrNonZeroBalance, ErrScheduledTransfersPending and ErrPendingTransfers
+// prevent closing an account.
+var (
+	ErrNonZeroBalance            = errors.New("account balance must be zero to close it")
+	ErrScheduledTransfersPending = errors.New("account has scheduled transfers")
+	ErrPendingTransfers          = errors.New("account has pending transfers awaiting confirmation")
+)
+
+// ErrTransferNotFound is returned when no pending transfer matches a lookup.
+var ErrTransferNotFound = errors.New("transfer not found")
+
+// ErrTransferNotPending is returned when confirming a transfer that was
+// already confirmed or has expired.
+var ErrTransferNotPending = errors.New("transfer is no longer pending")
+
+// ErrTransactionNotFound is returned when no ledger entry matches a lookup.
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+// ErrAlreadyReversed is returned when reversing a transfer twice.
+var ErrAlreadyReversed = errors.New("transfer was already reversed")
+
+// ErrInsufficientFunds is matched by every InsufficientFundsError.
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// InsufficientFundsError reports a withdrawal or transfer that would take an
+// account below its minimum balance.
+type InsufficientFundsError struct {
+	Attempted Money // amount the caller tried to move
+	Available Money // amount that could have been moved
+}
+
+func (e *InsufficientFundsError) Error() string {
+	return fmt.Sprintf("insufficient funds: attempted %s, available %s", e.Attempted, e.Available)
+}
+
+func (e *InsufficientFundsError) Is(target error) bool {
+	return target == ErrInsufficientFunds
+}
+
+func (e *InsufficientFundsError) Details() map[string]interface{} {
+	return map[string]interface{}{"attempted": e.Attempted, "available": e.Available}
+}
+
+// Storage persists accounts and their ledger. The reads that may scan many
+// rows take a context and abort their query once it is done, such as when the
+// client of the request disconnects.
 type Storage interface {
 	CreateAccount(*Account) error
+	CreateAccounts([]*Account) error
+	ImportAccounts([]*Account) ([]error, error)
 	DeleteAccount(int) error
 	UpdateAccount(id int, account *UpdateAccountRequest) error
-	GetAccounts() ([]*Account, error)
+	GetAccounts(ctx context.Context, opts AccountListOptions) ([]*Account, error)
+	CountAccounts(ctx context.Context, opts AccountListOptions) (int, error)
 	GetAccountById(int) (*Account, error)
+	SearchAccounts(ctx context.Context, query string, limit, offset int) ([]*AccountSearchResult, error)
+	GetAccountByNumber(number int64) (*Account, error)
+	GetAccountByEmail(email string) (*Account, error)
+	GetAccountsByCustomer(ctx context.Context, customerID int) ([]*Account, error)
+	GetAccountsByIds(ctx context.Context, ids []int64) ([]*Account, error)
+	HasAdmin() (bool, error)
+	Deposit(id int, amount Money) (*Account, error)
+	Withdraw(id int, amount Money, labels TransactionLabels) (*Account, error)
+	Transfer(fromID int, toNumber int64, amount Money, labels TransactionLabels) (Money, error)
+	PreviewTransfer(fromID int, toNumber int64, amount Money) (*TransferPreview, error)
+	TransferBatch(fromID int, items []*BatchTransferItem) ([]*BatchTransferResult, error)
+	CreatePendingTransfer(fromID int, toNumber int64, amount Money, labels TransactionLabels, ttl time.Duration) (*PendingTransfer, error)
+	ConfirmTransfer(id, fromID int) (*PendingTransfer, error)
+	ReverseTransfer(transactionID int) (*Transaction, error)
+	ExpirePendingTransfers() (int, error)
+	ForEachTransaction(ctx context.Context, accountID int, filter TransactionFilter, fn func(*Transaction) error) error
+	GetTransactionsByAccount(ctx context.Context, accountID int, filter TransactionFilter, limit int) ([]*Transaction, error)
+	GetLedgerTransfers(ctx context.Context, filter LedgerTransferFilter, limit int) ([]*LedgerTransfer, error)
+	GetTransactionById(id int) (*Transaction, error)
+	BalanceAt(ctx context.Context, accountID int, at time.Time) (Money, error)
+	SumByCategory(ctx context.Context, accountID int, filter TransactionFilter) ([]*CategoryTotal, error)
+	SummarizeTransactions(ctx context.Context, accountID int, filter TransactionFilter) (*AccountSummary, error)
+	CreateScheduledTransfer(*ScheduledTransfer) error
+	GetDueScheduledTransfers(now time.Time) ([]*ScheduledTransfer, error)
+	GetScheduledTransfersByAccount(ctx context.Context, accountID int) ([]*ScheduledTransfer, error)
+	RecordScheduledTransferRun(st *ScheduledTransfer, runErr error) error
+	CreateStatementEmail(email *StatementEmail) error
+	GetStatementEmails(ctx context.Context, accountID, limit int) ([]*StatementEmail, error)
+	GetPendingStatementEmails(limit int) ([]*StatementEmail, error)
+	RecordStatementEmailAttempt(id int, sendErr error, maxAttempts int) error
+	AccrueInterest(day time.Time) (int, error)
+	UpdateAccountStatus(id int, from, to AccountStatus) (*Account, error)
+	TransferOwnership(id int, holder *TransferOwnershipRequest, encryptedPassword string, actorID int) (*Account, error)
+	CloseAccount(id int, sweepTo int64) (*Account, error)
+	CloseDormantAccounts(inactiveSince time.Time, dryRun bool, actorID int) (int, error)
+	CreateWebhook(*Webhook) error
+	GetWebhooksForEvent(accountNumber int64, event TransactionType) ([]*Webhook, error)
+	RecordWebhookDelivery(*WebhookDelivery) error
+	GetOutboxEvents(limit int, skipAccounts []int64) ([]*OutboxEvent, error)
+	MarkOutboxEventPublished(id int64) error
+	GetLoginLock(accountID int) (time.Time, error)
+	RecordLoginFailure(accountID, maxFailures int, lockout time.Duration) (time.Time, error)
+	ResetLoginFailures(accountID int) error
+	GetTOTPSecret(accountID int) (secret string, enabled bool, err error)
+	SetTOTPSecret(accountID int, secret string) error
+	EnableTOTP(accountID int) error
+	UseTOTPStep(accountID int, step int64) (bool, error)
+	RevokeTokens(accountID int) error
+	ChangePassword(accountID int, encryptedPassword string) (*Account, error)
+	SetEmailVerificationToken(accountID int, tokenHash string, expiresAt time.Time) error
+	VerifyEmail(tokenHash string) (*Account, error)
+	// Primary returns a view of the store that reads from the primary too,
+	// for reading back what the same request just wrote.
+	Primary() Storage
+	Close() error
 }
 
 type PostgresStore struct {
 	db *sql.DB
+	// reader serves account and transaction reads that may lag behind a
+	// little. It is db itself when no replica is configured.
+	reader        *sql.DB
+	minBalances   map[AccountType]Money
+	dailyLimits   map[AccountType]Money
+	interestRates map[AccountType]float64
+	retry         retryPolicy
+	fees          FeeSchedule
+	rates         RateProvider
+	numberFormat  AccountNumberFormat
+	// clock tells the time of expiries, locks and limits. Row timestamps
+	// such as created_at are still the database's NOW().
+	clock Clock
+}
+
+func NewPostgresStore(cfg *Config) (*PostgresStore, error) {
+	db, err := openDB(cfg, cfg.DatabaseURL)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Database pool: max open conns %d, max idle conns %d, conn max lifetime %s",
+		cfg.DBMaxOpenConns, cfg.DBMaxIdleConns, cfg.DBConnMaxLifetime)
+
+	registerDBMetrics(db)
+
+	reader := db
+	if cfg.DBReplicaURL != "" {
+		if reader, err = openDB(cfg, cfg.DBReplicaURL); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("read replica: %w", err)
+		}
+		log.Println("Reading accounts and transactions from the replica")
+	}
+
+	return &PostgresStore{
+		db:            db,
+		reader:        reader,
+		minBalances:   cfg.MinBalances,
+		dailyLimits:   cfg.DailyTransferLimits,
+		interestRates: cfg.InterestRates,
+		retry:         retryPolicy{maxAttempts: cfg.DBRetryAttempts, baseDelay: cfg.DBRetryDelay},
+		rates:         NewStaticRateProvider(cfg.FXRates),
+		fees:          cfg.TransferFees,
+		numberFormat:  cfg.AccountNumberFormat,
+		clock:         cfg.Clock,
+	}, nil
 }
 
-func NewPostgresStore() (*PostgresStore, error) {
-	connStr := "user=postgres dbname=postgres password=admin sslmode=disable"
-	db, err := sql.Open("postgres", connStr)
+// openDB opens and pings a connection pool to url, sized by cfg.
+func openDB(cfg *Config, url string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", url)
 	if err != nil {
 		return nil, err
 	}
 
+	db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+	db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+	db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+
 	if err := db.Ping(); err != nil {
+		db.Close()
 		return nil, err
 	}
+	return db, nil
+}
+
+// Primary returns a copy of the store reading from the primary, so that reads
+// right after a write never miss it because of replica lag.
+func (s *PostgresStore) Primary() Storage {
+	primary := *s
+	primary.reader = s.db
+	return &primary
+}
 
-	return &PostgresStore{db: db}, nil
+// Close closes the database pools. It is safe to call more than once.
+func (s *PostgresStore) Close() error {
+	if s.reader != s.db {
+		s.reader.Close()
+	}
+	return s.db.Close()
 }
 
-// Init initializes the PostgresStore.
+// Init creates the tables missing from the database and migrates the others.
 func (s *PostgresStore) Init() error {
-	return s.createAccountTable()
+	if err := s.createCustomerTable(); err != nil {
+		return err
+	}
+	if err := s.createAccountTable(); err != nil {
+		return err
+	}
+	if err := s.createTransactionTable(); err != nil {
+		return err
+	}
+	if err := s.createPendingTransferTable(); err != nil {
+		return err
+	}
+	if err := s.createScheduledTransferTables(); err != nil {
+		return err
+	}
+	if err := s.createInterestAccrualTable(); err != nil {
+		return err
+	}
+	if err := s.createWebhookTables(); err != nil {
+		return err
+	}
+	if err := s.createOutboxTable(); err != nil {
+		return err
+	}
+	if err := s.createLoginFailureTable(); err != nil {
+		return err
+	}
+	if err := s.createAuditLogTable(); err != nil {
+		return err
+	}
+	if err := s.createTOTPTable(); err != nil {
+		return err
+	}
+	if err := s.createEmailVerificationTable(); err != nil {
+		return err
+	}
+	if err := s.createStatementEmailTable(); err != nil {
+		return err
+	}
+	return s.migrate()
+}
+
+// createCustomerTable creates the table of customers, the holders of one or
+// more accounts, if it does not exist.
+func (s *PostgresStore) createCustomerTable() error {
+	query := `CREATE TABLE IF NOT EXISTS customers (
+		id SERIAL PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.db.Exec(query)
+
+	return err
 }
 
 // createAccountTable creates the accounts table if it does not exist.
 func (s *PostgresStore) createAccountTable() error {
 	query := `CREATE TABLE IF NOT EXISTS accounts (
 		id SERIAL PRIMARY KEY,
+		customer_id INTEGER NOT NULL REFERENCES customers (id),
 		first_name VARCHAR(50) NOT NULL,
 		last_name VARCHAR(50) NOT NULL,
 		number BIGINT NOT NULL UNIQUE,
 		balance BIGINT NOT NULL,
+		held_balance BIGINT NOT NULL DEFAULT 0,
+		currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+		email VARCHAR(255) UNIQUE,
+		encrypted_password VARCHAR(100) NOT NULL,
+		account_type VARCHAR(20) NOT NULL DEFAULT 'checking',
+		status VARCHAR(10) NOT NULL DEFAULT 'active',
+		interest_rate DOUBLE PRECISION NOT NULL DEFAULT 0,
+		is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+		version INTEGER NOT NULL DEFAULT 1,
+		token_version INTEGER NOT NULL DEFAULT 1,
+		email_verified BOOLEAN NOT NULL DEFAULT FALSE,
 		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
 		updated_at TIMESTAMP NOT NULL DEFAULT NOW()
 	)`
@@ -57,25 +336,349 @@ func (s *PostgresStore) createAccountTable() error {
 	return err
 }
 
+// createTransactionTable creates the ledger table if it does not exist. Entries
+// outlive their account so the ledger can always be reconciled, and are stamped
+// with a time zone so that day boundaries don't depend on the session's.
+func (s *PostgresStore) createTransactionTable() error {
+	query := `CREATE TABLE IF NOT EXISTS transactions (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL,
+		type VARCHAR(20) NOT NULL,
+		amount BIGINT NOT NULL,
+		currency VARCHAR(3) NOT NULL DEFAULT 'USD',
+		balance BIGINT NOT NULL,
+		counterparty BIGINT,
+		fx_amount BIGINT,
+		fx_currency VARCHAR(3),
+		fx_rate DOUBLE PRECISION,
+		reversal_of INTEGER REFERENCES transactions (id),
+		reversed BOOLEAN NOT NULL DEFAULT FALSE,
+		category VARCHAR(50),
+		tags JSONB NOT NULL DEFAULT '[]',
+		created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	);
+	CREATE INDEX IF NOT EXISTS transactions_account_id_idx ON transactions (account_id, id);
+	CREATE INDEX IF NOT EXISTS transactions_transfers_idx ON transactions (created_at) WHERE type = '` + string(TransactionTransferOut) + `'`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+// createPendingTransferTable creates the table of transfers awaiting
+// confirmation.
+func (s *PostgresStore) createPendingTransferTable() error {
+	query := `CREATE TABLE IF NOT EXISTS pending_transfers (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL,
+		to_account BIGINT NOT NULL,
+		amount BIGINT NOT NULL,
+		fee BIGINT NOT NULL DEFAULT 0,
+		category VARCHAR(50),
+		tags JSONB NOT NULL DEFAULT '[]',
+		status VARCHAR(10) NOT NULL DEFAULT 'pending',
+		expires_at TIMESTAMP NOT NULL,
+		confirmed_at TIMESTAMP,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+// createScheduledTransferTables creates the standing order table and the log
+// of every attempt to execute one.
+func (s *PostgresStore) createScheduledTransferTables() error {
+	query := `CREATE TABLE IF NOT EXISTS scheduled_transfers (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL,
+		to_account BIGINT NOT NULL,
+		amount BIGINT NOT NULL,
+		frequency VARCHAR(10) NOT NULL,
+		next_run TIMESTAMP NOT NULL,
+		retry_at TIMESTAMP,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS scheduled_transfer_runs (
+		id SERIAL PRIMARY KEY,
+		scheduled_transfer_id INTEGER NOT NULL REFERENCES scheduled_transfers (id) ON DELETE CASCADE,
+		run_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		error TEXT
+	)`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+// createInterestAccrualTable creates the table remembering which days each
+// account has already been credited interest for.
+func (s *PostgresStore) createInterestAccrualTable() error {
+	query := `CREATE TABLE IF NOT EXISTS interest_accruals (
+		account_id INTEGER NOT NULL,
+		day DATE NOT NULL,
+		PRIMARY KEY (account_id, day)
+	)`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+// createWebhookTables creates the webhook subscriptions and the log of every
+// delivery attempt.
+func (s *PostgresStore) createWebhookTables() error {
+	query := `CREATE TABLE IF NOT EXISTS webhooks (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		secret VARCHAR(64) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		webhook_id INTEGER NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+		event_id VARCHAR(32) NOT NULL,
+		event_type VARCHAR(20) NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER,
+		error TEXT,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+// createOutboxTable creates the table of events waiting to be delivered to
+// webhooks. They are written in the transaction of the ledger entry they
+// describe, so that committing one without the other is impossible.
+func (s *PostgresStore) createOutboxTable() error {
+	query := `CREATE TABLE IF NOT EXISTS outbox (
+		id BIGSERIAL PRIMARY KEY,
+		account_number BIGINT NOT NULL,
+		payload TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		published_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS outbox_unpublished ON outbox (id) WHERE published_at IS NULL`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+func (s *PostgresStore) createLoginFailureTable() error {
+	query := `CREATE TABLE IF NOT EXISTS login_failures (
+		account_id INTEGER PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		locked_until TIMESTAMP
+	)`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+// createAuditLogTable creates the log of sensitive changes made to accounts.
+// details holds a JSON description of the change.
+func (s *PostgresStore) createAuditLogTable() error {
+	query := `CREATE TABLE IF NOT EXISTS audit_log (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL,
+		action VARCHAR(50) NOT NULL,
+		actor_id INTEGER NOT NULL,
+		details TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+func (s *PostgresStore) createTOTPTable() error {
+	query := `CREATE TABLE IF NOT EXISTS account_totp (
+		account_id INTEGER PRIMARY KEY,
+		secret TEXT NOT NULL,
+		enabled BOOLEAN NOT NULL DEFAULT FALSE,
+		last_step BIGINT,
+		created_at TIMESTAMP NOT NULL DEFAULT NOW()
+	)`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+// createEmailVerificationTable creates the table of pending email
+// verifications, one per account at most. Tokens are stored as SHA-256
+// hashes, so a leaked table can't verify anything.
+func (s *PostgresStore) createEmailVerificationTable() error {
+	query := `CREATE TABLE IF NOT EXISTS email_verifications (
+		account_id INTEGER PRIMARY KEY REFERENCES accounts (id) ON DELETE CASCADE,
+		token_hash CHAR(64) NOT NULL UNIQUE,
+		expires_at TIMESTAMP NOT NULL
+	)`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+// createStatementEmailTable creates the queue of statements to email, which
+// also records how their delivery went.
+func (s *PostgresStore) createStatementEmailTable() error {
+	query := `CREATE TABLE IF NOT EXISTS statement_emails (
+		id SERIAL PRIMARY KEY,
+		account_id INTEGER NOT NULL REFERENCES accounts (id) ON DELETE CASCADE,
+		email VARCHAR(255) NOT NULL,
+		format VARCHAR(3) NOT NULL,
+		period_from TIMESTAMP,
+		period_to TIMESTAMP,
+		status VARCHAR(10) NOT NULL DEFAULT 'pending',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+		sent_at TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS statement_emails_pending ON statement_emails (id) WHERE status = 'pending';
+	CREATE INDEX IF NOT EXISTS statement_emails_account_id_idx ON statement_emails (account_id, id)`
+
+	_, err := s.db.Exec(query)
+
+	return err
+}
+
+// CreateAccount inserts account, giving it the default interest rate of its
+// type. A positive balance is recorded as an opening deposit.
 func (s *PostgresStore) CreateAccount(account *Account) error {
-	query := `INSERT INTO accounts (first_name, last_name, number, balance, created_at, updated_at) 
-	VALUES ($1, $2, $3, $4)`
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	resp, err := s.db.Exec(
-		query,
-		account.FirstName,
-		account.LastName,
-		account.Number,
-		account.Balance,
-		account.CreatedAt,
-		account.UpdatedAt)
+	if err := s.insertAccount(tx, account); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
 
+// CreateAccounts inserts all accounts in a single transaction, so either all
+// of them are created or none. A failing insert is reported as a
+// BatchItemError carrying its index.
+func (s *PostgresStore) CreateAccounts(accounts []*Account) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	fmt.Printf("%+v\n", resp)
+	for i, account := range accounts {
+		if err := s.insertAccount(tx, account); err != nil {
+			return &BatchItemError{Index: i, Err: err}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ImportAccounts inserts accounts in a single transaction, skipping those
+// whose email is already taken. The returned errors say why each account was
+// skipped, and are nil for those created. Any other error rolls back the
+// whole import.
+func (s *PostgresStore) ImportAccounts(accounts []*Account) ([]error, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// A failing insert aborts the transaction, unless rolled back to a
+	// savepoint before it.
+	skipped := make([]error, len(accounts))
+	for i, account := range accounts {
+		if _, err := tx.Exec("SAVEPOINT import_account"); err != nil {
+			return nil, err
+		}
+
+		err := s.insertAccount(tx, account)
+		if errors.Is(err, ErrEmailTaken) {
+			skipped[i] = err
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT import_account"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, &BatchItemError{Index: i, Err: err}
+		}
+	}
+
+	return skipped, tx.Commit()
+}
+
+// maxAccountNumberAttempts bounds the numbers insertAccount tries for an
+// account. Running out means the number space is nearly full.
+const maxAccountNumberAttempts = 10
+
+// insertAccount inserts account inside tx. An account without a customer
+// gets a new one. A positive opening balance is recorded in the ledger as a
+// deposit.
+func (s *PostgresStore) insertAccount(tx *sql.Tx, account *Account) error {
+	account.InterestRate = s.interestRates[account.Type]
 
+	if account.CustomerID == 0 {
+		if err := tx.QueryRow("INSERT INTO customers DEFAULT VALUES RETURNING id").Scan(&account.CustomerID); err != nil {
+			return err
+		}
+	}
+
+	// A number already taken is replaced by a new one. Conflicts are skipped
+	// rather than raised, which would abort the whole transaction.
+	query := `INSERT INTO accounts (customer_id, first_name, last_name, number, balance, currency, email, encrypted_password, account_type, status, interest_rate, is_admin, email_verified, created_at, updated_at) 
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, NOW(), NOW())
+	ON CONFLICT (number) DO NOTHING
+	RETURNING id, version, token_version, created_at, updated_at`
+
+	for attempt := 1; ; attempt++ {
+		err := tx.QueryRow(
+			query,
+			account.CustomerID,
+			account.FirstName,
+			account.LastName,
+			account.Number,
+			account.Balance,
+			account.Currency,
+			sql.NullString{String: account.Email, Valid: account.Email != ""},
+			account.EncryptedPassword,
+			account.Type,
+			account.Status,
+			account.InterestRate,
+			account.IsAdmin,
+			account.EmailVerified).Scan(&account.ID, &account.Version, &account.TokenVersion, &account.CreatedAt, &account.UpdatedAt)
+		if err == nil {
+			break
+		}
+		if err != sql.ErrNoRows {
+			return translateError(err)
+		}
+		if attempt == maxAccountNumberAttempts {
+			return fmt.Errorf("no free account number found in %d attempts", attempt)
+		}
+		account.Number = s.numberFormat.newNumber()
+	}
+
+	if account.Balance > 0 {
+		return recordTransaction(tx, account, TransactionDeposit, account.Balance, 0)
+	}
 	return nil
 }
 
@@ -98,59 +701,148 @@ func (s *PostgresStore) UpdateAccount(id int, account *UpdateAccountRequest) err
 	var queryBuffer bytes.Buffer
 	queryBuffer.WriteString("UPDATE accounts SET ")
 
-	// Keep track if any field is updated
+	// Keep track of the values for the placeholders, in order
 	var updatedFields []interface{}
 
-	// Keep track if any field is provided in the request
-	var hasFieldsToUpdate bool
+	// setField appends "column = $n, " with n being the next placeholder index
+	setField := func(column string, value interface{}) {
+		updatedFields = append(updatedFields, value)
+		fmt.Fprintf(&queryBuffer, "%s = $%d, ", column, len(updatedFields))
+	}
 
 	// Check if first name is provided
-	if account.FirstName != "" {
-		queryBuffer.WriteString("first_name = $1, ")
-		updatedFields = append(updatedFields, account.FirstName)
-		hasFieldsToUpdate = true
+	if account.FirstName != nil {
+		setField("first_name", *account.FirstName)
 	}
 
 	// Check if last name is provided
-	if account.LastName != "" {
-		queryBuffer.WriteString("last_name = $2, ")
-		updatedFields = append(updatedFields, account.LastName)
-		hasFieldsToUpdate = true
+	if account.LastName != nil {
+		setField("last_name", *account.LastName)
 	}
 
-	// Remove trailing comma and space
-	if hasFieldsToUpdate {
-		query := queryBuffer.String()[:queryBuffer.Len()-2] // Remove the last comma and space
-		query += "updated_at = NOW() WHERE id = $3"         // Append the WHERE clause
+	// Check if email is provided, an empty one being stored as NULL. A new
+	// address needs to be verified again.
+	if account.Email != nil {
+		setField("email", sql.NullString{String: *account.Email, Valid: *account.Email != ""})
+		fmt.Fprintf(&queryBuffer, "email_verified = email_verified AND email IS NOT DISTINCT FROM $%d, ", len(updatedFields))
+	}
 
-		// Execute the dynamic query
-		_, err := s.db.Exec(query, append(updatedFields, id)...)
-		if err != nil {
-			return err
-		}
-		return nil
+	// Check if account type is provided, which also resets the interest rate
+	if account.Type != nil {
+		setField("account_type", *account.Type)
+		setField("interest_rate", s.interestRates[*account.Type])
 	}
 
 	// If no fields are provided in the request
-	return errors.New("no fields provided for update")
+	if len(updatedFields) == 0 {
+		return errors.New("no fields provided for update")
+	}
+
+	// Append the timestamp, the version bump and the WHERE clause matching the
+	// id and the version the client read
+	updatedFields = append(updatedFields, id, account.Version)
+	fmt.Fprintf(&queryBuffer, "updated_at = NOW(), version = version + 1 WHERE id = $%d AND version = $%d",
+		len(updatedFields)-1, len(updatedFields))
+
+	// Execute the dynamic query
+	result, err := s.db.Exec(queryBuffer.String(), updatedFields...)
+	if err != nil {
+		return translateError(err)
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	// No row matched: either the account is gone or its version moved on.
+	if _, err := s.Primary().GetAccountById(id); err != nil {
+		return err
+	}
+	return ErrStaleUpdate
 }
 
 func (s *PostgresStore) GetAccountById(id int) (*Account, error) {
-	rows, err := s.db.Query("SELECT * FROM accounts WHERE id = $1", id)
+	rows, err := s.reader.Query("SELECT "+accountColumns+" FROM accounts WHERE id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		return scanIntoAccount(rows)
+	}
+	return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+}
+
+// sortableAccountColumns whitelists the columns accounts may be sorted by, so
+// that user input never ends up in the query text.
+var sortableAccountColumns = map[string]string{
+	"id":         "id",
+	"balance":    "balance",
+	"created_at": "created_at",
+}
+
+func (s *PostgresStore) GetAccountByNumber(number int64) (*Account, error) {
+	rows, err := s.db.Query("SELECT "+accountColumns+" FROM accounts WHERE number = $1", number)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		return scanIntoAccount(rows)
+	}
+	return nil, accountNumberNotFound(number)
+}
+
+// accountNumberNotFound reports that no account is numbered number, hinting
+// at a typo when the number fails its check digit. Accounts numbered before
+// check digits were introduced fail it too, so the check only shapes the
+// message and never rejects a number that exists.
+func accountNumberNotFound(number int64) error {
+	if !ValidAccountNumber(number) {
+		return fmt.Errorf("%w: number %d, check it for typos", ErrAccountNotFound, number)
+	}
+	return fmt.Errorf("%w: number %d", ErrAccountNotFound, number)
+}
+
+func (s *PostgresStore) GetAccountByEmail(email string) (*Account, error) {
+	rows, err := s.db.Query("SELECT "+accountColumns+" FROM accounts WHERE email = $1", email)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	for rows.Next() {
 		return scanIntoAccount(rows)
 	}
-	return nil, fmt.Errorf("account with id %d not found", id)
+	return nil, fmt.Errorf("%w: email %s", ErrAccountNotFound, email)
 }
 
-func (s *PostgresStore) GetAccounts() ([]*Account, error) {
-	rows, err := s.db.Query("SELECT * FROM accounts")
+func (s *PostgresStore) GetAccounts(ctx context.Context, opts AccountListOptions) ([]*Account, error) {
+	column, ok := sortableAccountColumns[opts.Sort]
+	if !ok {
+		return nil, fmt.Errorf("invalid sort column: %s", opts.Sort)
+	}
+
+	direction := "ASC"
+	if opts.Order == "desc" {
+		direction = "DESC"
+	}
+
+	var queryBuffer bytes.Buffer
+	queryBuffer.WriteString("SELECT " + accountColumns + " FROM accounts")
+	args := accountListFilter(&queryBuffer, opts)
+
+	// Sort by id as a tie-breaker so pages are stable.
+	fmt.Fprintf(&queryBuffer, " ORDER BY %s %s, id %s", column, direction, direction)
+
+	args = append(args, opts.Limit, opts.Offset)
+	fmt.Fprintf(&queryBuffer, " LIMIT $%d OFFSET $%d", len(args)-1, len(args))
+
+	rows, err := s.reader.QueryContext(ctx, queryBuffer.String(), args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
 	accounts := []*Account{}
 	for rows.Next() {
 		account, err := scanIntoAccount(rows)
@@ -159,19 +851,1966 @@ func (s *PostgresStore) GetAccounts() ([]*Account, error) {
 		}
 		accounts = append(accounts, account)
 	}
-	return accounts, nil
+	return accounts, rows.Err()
 }
 
-func scanIntoAccount(rows *sql.Rows) (*Account, error) {
-	account := &Account{}
-	err := rows.Scan(
-		&account.ID,
-		&account.FirstName,
-		&account.LastName,
-		&account.Number,
+// GetAccountsByCustomer returns the accounts of a customer, oldest first.
+func (s *PostgresStore) GetAccountsByCustomer(ctx context.Context, customerID int) ([]*Account, error) {
+	rows, err := s.reader.QueryContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE customer_id = $1 ORDER BY id", customerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// GetAccountsByIds returns the accounts among ids that exist, by id.
+func (s *PostgresStore) GetAccountsByIds(ctx context.Context, ids []int64) ([]*Account, error) {
+	rows, err := s.reader.QueryContext(ctx, "SELECT "+accountColumns+" FROM accounts WHERE id = ANY($1) ORDER BY id", pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// CountAccounts returns how many accounts match the filter of opts, ignoring
+// its sorting and pagination.
+func (s *PostgresStore) CountAccounts(ctx context.Context, opts AccountListOptions) (int, error) {
+	var queryBuffer bytes.Buffer
+	queryBuffer.WriteString("SELECT COUNT(*) FROM accounts")
+	args := accountListFilter(&queryBuffer, opts)
+
+	var count int
+	err := s.reader.QueryRowContext(ctx, queryBuffer.String(), args...).Scan(&count)
+	return count, err
+}
+
+// accountListFilter appends the WHERE clause for the filter of opts to
+// queryBuffer and returns its arguments.
+func accountListFilter(queryBuffer *bytes.Buffer, opts AccountListOptions) []interface{} {
+	var args []interface{}
+	if opts.LastName != "" {
+		args = append(args, opts.LastName)
+		fmt.Fprintf(queryBuffer, " WHERE last_name = $%d", len(args))
+	}
+	return args
+}
+
+// likeEscaper escapes the LIKE wildcards so user input matches literally.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SearchAccounts finds the accounts whose first or last name contains query,
+// ignoring case, ordered by name.
+func (s *PostgresStore) SearchAccounts(ctx context.Context, query string, limit, offset int) ([]*AccountSearchResult, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, first_name, last_name, number FROM accounts
+		WHERE first_name ILIKE $1 OR last_name ILIKE $1
+		ORDER BY last_name, first_name, id
+		LIMIT $2 OFFSET $3`,
+		"%"+likeEscaper.Replace(query)+"%", limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*AccountSearchResult{}
+	for rows.Next() {
+		result := &AccountSearchResult{}
+		if err := rows.Scan(&result.ID, &result.FirstName, &result.LastName, &result.Number); err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *PostgresStore) Deposit(id int, amount Money) (*Account, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	account, err := scanIntoAccount(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkActive(account); err != nil {
+		return nil, err
+	}
+
+	if err := adjustBalance(tx, account, amount); err != nil {
+		return nil, err
+	}
+
+	if err := recordTransaction(tx, account, TransactionDeposit, amount, 0); err != nil {
+		return nil, err
+	}
+
+	return account, tx.Commit()
+}
+
+func (s *PostgresStore) Withdraw(id int, amount Money, labels TransactionLabels) (*Account, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	account, err := scanIntoAccount(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkActive(account); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkMinBalance(account, amount); err != nil {
+		return nil, err
+	}
+
+	if err := adjustBalance(tx, account, -amount); err != nil {
+		return nil, err
+	}
+
+	if err := recordTransaction(tx, account, TransactionWithdrawal, -amount, 0); err != nil {
+		return nil, err
+	}
+
+	if err := labelLatestEntry(tx, account.ID, TransactionWithdrawal, labels); err != nil {
+		return nil, err
+	}
+
+	return account, tx.Commit()
+}
+
+// Transfer moves amount from the account with id fromID to the account with
+// number toNumber. Both rows are locked for the duration of the transaction,
+// which is retried if it loses a serialization conflict or deadlock. The debit,
+// the credit and both ledger entries commit together or not at all: any failure
+// along the way rolls the whole transaction back. The labels are set on the
+// debit of the sender. It returns the fee charged on top of amount.
+func (s *PostgresStore) Transfer(fromID int, toNumber int64, amount Money, labels TransactionLabels) (Money, error) {
+	var fee Money
+	err := s.retry.do(func() error {
+		var err error
+		fee, err = s.transfer(fromID, toNumber, amount, labels)
+		return err
+	})
+	return fee, err
+}
+
+func (s *PostgresStore) transfer(fromID int, toNumber int64, amount Money, labels TransactionLabels) (Money, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	_, _, _, fee, err := s.transferTx(tx, fromID, toNumber, amount)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := labelLatestEntry(tx, fromID, TransactionTransferOut, labels); err != nil {
+		return 0, err
+	}
+
+	return fee, tx.Commit()
+}
+
+// PreviewTransfer runs a transfer with all its checks and rolls it back,
+// reporting what it would have done. Like Transfer it is retried on
+// serialization conflicts.
+func (s *PostgresStore) PreviewTransfer(fromID int, toNumber int64, amount Money) (*TransferPreview, error) {
+	var preview *TransferPreview
+	err := s.retry.do(func() error {
+		var err error
+		preview, err = s.previewTransfer(fromID, toNumber, amount)
+		return err
+	})
+	return preview, err
+}
+
+func (s *PostgresStore) previewTransfer(fromID int, toNumber int64, amount Money) (*TransferPreview, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	from, to, credited, fee, err := s.transferTx(tx, fromID, toNumber, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the difference is reported for the destination, its balance isn't
+	// the sender's business.
+	return &TransferPreview{
+		DryRun:      true,
+		ToAccount:   to.Number,
+		Amount:      amount,
+		Credited:    credited,
+		Currency:    to.Currency,
+		Fee:         fee,
+		FromBalance: from.Balance,
+	}, nil
+}
+
+// transferTx executes a transfer inside tx, returning both accounts as they
+// are afterwards, the amount credited to the destination, in its currency,
+// and the fee charged to the source.
+func (s *PostgresStore) transferTx(tx *sql.Tx, fromID int, toNumber int64, amount Money) (from, to *Account, credited, fee Money, err error) {
+	from, to, err = lockTransferAccounts(tx, fromID, toNumber)
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	fee = s.fees.Fee(from, amount)
+	if err := s.checkMinBalance(from, amount+fee); err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	if err := s.checkDailyLimit(tx, from, amount); err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	before := to.Balance
+	if err := s.moveMoney(tx, from, to, amount); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	credited = to.Balance - before
+
+	if err := s.chargeFee(tx, from, fee); err != nil {
+		return nil, nil, 0, 0, err
+	}
+
+	return from, to, credited, fee, nil
+}
+
+// TransferBatch executes every transfer of items from the account with id
+// fromID in one transaction: either all of them happen or none does, and the
+// error names the index of the first failing item. The minimum balance and
+// daily limit are checked against the total, fees included for the former,
+// before anything moves.
+func (s *PostgresStore) TransferBatch(fromID int, items []*BatchTransferItem) ([]*BatchTransferResult, error) {
+	var results []*BatchTransferResult
+	err := s.retry.do(func() error {
+		var err error
+		results, err = s.transferBatch(fromID, items)
+		return err
+	})
+	return results, err
+}
+
+func (s *PostgresStore) transferBatch(fromID int, items []*BatchTransferItem) ([]*BatchTransferResult, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	numbers := make([]int64, len(items))
+	var total Money
+	for i, item := range items {
+		if item.Amount <= 0 || item.Amount > maxAmount {
+			return nil, &BatchItemError{Index: i, Err: fmt.Errorf("amount must be greater than 0 and at most %s", maxAmount.decimal())}
+		}
+		numbers[i] = item.ToAccount
+		var ok bool
+		if total, ok = addMoney(total, item.Amount); !ok {
+			return nil, errors.New("the total of the batch is too large")
+		}
+	}
+
+	from, to, err := lockBatchAccounts(tx, fromID, numbers)
+	if err != nil {
+		return nil, err
+	}
+
+	fees := make([]Money, len(items))
+	var totalFees Money
+	for i, item := range items {
+		fees[i] = s.fees.Fee(from, item.Amount)
+		var ok bool
+		if totalFees, ok = addMoney(totalFees, fees[i]); !ok {
+			return nil, errors.New("the total of the batch is too large")
+		}
+	}
+
+	totalDebit, ok := addMoney(total, totalFees)
+	if !ok {
+		return nil, errors.New("the total of the batch is too large")
+	}
+	if err := s.checkMinBalance(from, totalDebit); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkDailyLimit(tx, from, total); err != nil {
+		return nil, err
+	}
+
+	results := make([]*BatchTransferResult, len(items))
+	for i, item := range items {
+		recipient, ok := to[item.ToAccount]
+		if !ok {
+			return nil, &BatchItemError{Index: i, Err: accountNumberNotFound(item.ToAccount)}
+		}
+		if recipient.ID == from.ID {
+			return nil, &BatchItemError{Index: i, Err: errors.New("cannot transfer to the same account")}
+		}
+
+		// The total was checked already; checking every item as well keeps
+		// the balance above the floor whatever the total said.
+		if err := s.checkMinBalance(from, item.Amount+fees[i]); err != nil {
+			return nil, &BatchItemError{Index: i, Err: err}
+		}
+
+		if err := s.moveMoney(tx, from, recipient, item.Amount); err != nil {
+			return nil, &BatchItemError{Index: i, Err: err}
+		}
+
+		if err := s.chargeFee(tx, from, fees[i]); err != nil {
+			return nil, &BatchItemError{Index: i, Err: err}
+		}
+
+		results[i] = &BatchTransferResult{ToAccount: recipient.Number, Amount: item.Amount, Fee: fees[i], Balance: from.Balance}
+	}
+
+	return results, tx.Commit()
+}
+
+// lockBatchAccounts locks the source of a batch transfer and all its
+// destinations, returned by number. Destinations that don't exist are simply
+// missing from the map.
+func lockBatchAccounts(tx *sql.Tx, fromID int, toNumbers []int64) (from *Account, to map[int64]*Account, err error) {
+	// Locking in id order, like lockTransferAccounts, avoids deadlocks.
+	rows, err := tx.Query("SELECT "+accountColumns+" FROM accounts WHERE id = $1 OR number = ANY($2) ORDER BY id FOR UPDATE", fromID, pq.Array(toNumbers))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	to = make(map[int64]*Account, len(toNumbers))
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if account.ID == fromID {
+			from = account
+		}
+		to[account.Number] = account
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if from == nil {
+		return nil, nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, fromID)
+	}
+
+	return from, to, nil
+}
+
+// CreatePendingTransfer holds amount and its fee on the account with id fromID
+// for a transfer to the account numbered toNumber. The money only moves once
+// the transfer is confirmed, within ttl; until then it can't be spent
+// otherwise. The fee is charged as held, whatever the fees are by then, and
+// the labels are set on the debit of the sender once it is confirmed.
+func (s *PostgresStore) CreatePendingTransfer(fromID int, toNumber int64, amount Money, labels TransactionLabels, ttl time.Duration) (*PendingTransfer, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	from, to, err := lockTransferAccounts(tx, fromID, toNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkActive(from); err != nil {
+		return nil, err
+	}
+	if err := checkActive(to); err != nil {
+		return nil, err
+	}
+
+	fee := s.fees.Fee(from, amount)
+	if err := s.checkMinBalance(from, amount+fee); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkDailyLimit(tx, from, amount); err != nil {
+		return nil, err
+	}
+
+	if err := adjustHold(tx, from, amount+fee); err != nil {
+		return nil, err
+	}
+
+	tags, err := json.Marshal(labels.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if labels.Tags == nil {
+		tags = []byte("[]")
+	}
+
+	pt, err := scanIntoPendingTransfer(tx.QueryRow(
+		`INSERT INTO pending_transfers (account_id, to_account, amount, fee, category, tags, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7)
+		RETURNING `+pendingTransferColumns,
+		from.ID, to.Number, amount, fee, labels.Category, string(tags), s.clock.Now().Add(ttl)))
+	if err != nil {
+		return nil, err
+	}
+
+	return pt, tx.Commit()
+}
+
+// ConfirmTransfer executes the pending transfer id of the account fromID,
+// releasing its hold and labelling the debit as the transfer was. Like Transfer it is retried on serialization conflicts.
+func (s *PostgresStore) ConfirmTransfer(id, fromID int) (*PendingTransfer, error) {
+	var pt *PendingTransfer
+	err := s.retry.do(func() error {
+		var err error
+		pt, err = s.confirmTransfer(id, fromID)
+		return err
+	})
+	return pt, err
+}
+
+func (s *PostgresStore) confirmTransfer(id, fromID int) (*PendingTransfer, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Claiming the row first makes concurrent confirmations of the same
+	// transfer fail instead of moving the money twice.
+	pt, err := scanIntoPendingTransfer(tx.QueryRow(
+		`UPDATE pending_transfers SET status = $1, confirmed_at = NOW()
+		WHERE id = $2 AND account_id = $3 AND status = $4 AND expires_at > $5
+		RETURNING `+pendingTransferColumns,
+		TransferStatusConfirmed, id, fromID, TransferStatusPending, s.clock.Now()))
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM pending_transfers WHERE id = $1 AND account_id = $2)", id, fromID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, fmt.Errorf("%w: id %d", ErrTransferNotFound, id)
+		}
+		return nil, fmt.Errorf("%w: id %d", ErrTransferNotPending, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	from, to, err := lockTransferAccounts(tx, pt.AccountID, pt.ToAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := adjustHold(tx, from, -(pt.Amount + pt.Fee)); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkMinBalance(from, pt.Amount+pt.Fee); err != nil {
+		return nil, err
+	}
+
+	if err := s.checkDailyLimit(tx, from, pt.Amount); err != nil {
+		return nil, err
+	}
+
+	if err := s.moveMoney(tx, from, to, pt.Amount); err != nil {
+		return nil, err
+	}
+
+	if err := s.chargeFee(tx, from, pt.Fee); err != nil {
+		return nil, err
+	}
+
+	if err := labelLatestEntry(tx, from.ID, TransactionTransferOut, pt.TransactionLabels); err != nil {
+		return nil, err
+	}
+
+	return pt, tx.Commit()
+}
+
+// ReverseTransfer undoes the transfer recorded by the transfer_out ledger
+// entry transactionID: the recipient gives back what it was credited and the
+// sender is refunded what it was debited, without converting at today's
+// rate. Both sides are recorded as reversal entries referencing the original,
+// which is flagged reversed. The recipient's minimum balance still applies.
+// It returns the sender's reversal entry.
+func (s *PostgresStore) ReverseTransfer(transactionID int) (*Transaction, error) {
+	var reversal *Transaction
+	err := s.retry.do(func() error {
+		var err error
+		reversal, err = s.reverseTransfer(transactionID)
+		return err
+	})
+	return reversal, err
+}
+
+func (s *PostgresStore) reverseTransfer(transactionID int) (*Transaction, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Claiming the entry first makes concurrent reversals of the same
+	// transfer fail instead of moving the money back twice.
+	original, err := scanIntoTransaction(tx.QueryRow(
+		"UPDATE transactions SET reversed = TRUE WHERE id = $1 AND type = $2 AND NOT reversed RETURNING "+transactionColumns,
+		transactionID, TransactionTransferOut))
+	if err == sql.ErrNoRows {
+		var kind TransactionType
+		err := tx.QueryRow("SELECT type FROM transactions WHERE id = $1", transactionID).Scan(&kind)
+		switch {
+		case err == sql.ErrNoRows:
+			return nil, fmt.Errorf("%w: id %d", ErrTransactionNotFound, transactionID)
+		case err != nil:
+			return nil, err
+		case kind != TransactionTransferOut:
+			return nil, fmt.Errorf("transaction %d is a %s, only sent transfers can be reversed", transactionID, kind)
+		default:
+			return nil, fmt.Errorf("%w: id %d", ErrAlreadyReversed, transactionID)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sender, recipient, err := lockTransferAccounts(tx, original.AccountID, original.Counterparty)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkActive(sender); err != nil {
+		return nil, err
+	}
+	if err := checkActive(recipient); err != nil {
+		return nil, err
+	}
+
+	refunded, credited := -original.Amount, -original.Amount
+	var senderFX, recipientFX *FXDetails
+	if original.FX != nil {
+		credited = original.FX.Amount
+		senderFX = &FXDetails{Amount: credited, Currency: recipient.Currency, Rate: original.FX.Rate}
+		recipientFX = &FXDetails{Amount: refunded, Currency: sender.Currency, Rate: original.FX.Rate}
+	}
+
+	if err := s.checkMinBalance(recipient, credited); err != nil {
+		return nil, err
+	}
+
+	if err := adjustBalance(tx, recipient, -credited); err != nil {
+		return nil, fmt.Errorf("debiting account %d: %w", recipient.Number, err)
+	}
+
+	if err := adjustBalance(tx, sender, refunded); err != nil {
+		return nil, fmt.Errorf("crediting account %d: %w", sender.Number, err)
+	}
+
+	if _, err := insertTransaction(tx, recipient, TransactionReversal, -credited, sender.Number, recipientFX, original.ID); err != nil {
+		return nil, err
+	}
+
+	reversal, err := insertTransaction(tx, sender, TransactionReversal, refunded, recipient.Number, senderFX, original.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return reversal, tx.Commit()
+}
+
+// ExpirePendingTransfers releases the holds of the pending transfers that
+// weren't confirmed in time, returning how many expired.
+func (s *PostgresStore) ExpirePendingTransfers() (int, error) {
+	var expired int
+	err := s.db.QueryRow(`WITH expired AS (
+			UPDATE pending_transfers SET status = $1
+			WHERE status = $2 AND expires_at <= $3
+			RETURNING account_id, amount + fee AS held
+		), released AS (
+			UPDATE accounts SET held_balance = held_balance - e.total, updated_at = NOW()
+			FROM (SELECT account_id, SUM(held) AS total FROM expired GROUP BY account_id) e
+			WHERE accounts.id = e.account_id
+		)
+		SELECT COUNT(*) FROM expired`,
+		TransferStatusExpired, TransferStatusPending, s.clock.Now()).Scan(&expired)
+	return expired, err
+}
+
+// lockTransferAccounts locks the source and destination rows of a transfer.
+func lockTransferAccounts(tx *sql.Tx, fromID int, toNumber int64) (from, to *Account, err error) {
+	// Lock both accounts in id order so concurrent transfers can't deadlock.
+	rows, err := tx.Query("SELECT "+accountColumns+" FROM accounts WHERE id = $1 OR number = $2 ORDER BY id FOR UPDATE", fromID, toNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		if account.ID == fromID {
+			from = account
+		}
+		if account.Number == toNumber {
+			to = account
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if from == nil {
+		return nil, nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, fromID)
+	}
+	if to == nil {
+		return nil, nil, accountNumberNotFound(toNumber)
+	}
+	if from.ID == to.ID {
+		return nil, nil, errors.New("cannot transfer to the same account")
+	}
+
+	return from, to, nil
+}
+
+// moveMoney debits from and credits to inside tx, recording both sides in the
+// ledger. Between accounts of different currencies the credited amount is
+// converted at the current rate, and each entry keeps the other side's amount.
+// Minimum balances are up to the caller.
+func (s *PostgresStore) moveMoney(tx *sql.Tx, from, to *Account, amount Money) error {
+	return s.move(tx, from, to, amount, TransactionTransferOut, TransactionTransferIn)
+}
+
+// chargeFee moves fee from the account from to the fee account, recording
+// both sides as fee entries. The fee account is locked after the accounts of
+// the transfer, so this may deadlock with a concurrent transfer; callers run
+// inside s.retry.do, which retries deadlocks.
+func (s *PostgresStore) chargeFee(tx *sql.Tx, from *Account, fee Money) error {
+	if fee == 0 {
+		return nil
+	}
+
+	house, err := scanIntoAccount(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE number = $1 FOR UPDATE", s.fees.Account))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("fee account %d does not exist", s.fees.Account)
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.move(tx, from, house, fee, TransactionFee, TransactionFee)
+}
+
+// move is moveMoney with the types of the debit and credit ledger entries
+// given by the caller.
+func (s *PostgresStore) move(tx *sql.Tx, from, to *Account, amount Money, debitKind, creditKind TransactionType) error {
+	if err := checkActive(from); err != nil {
+		return err
+	}
+	if err := checkActive(to); err != nil {
+		return err
+	}
+
+	rate, err := s.rates.Rate(from.Currency, to.Currency)
+	if err != nil {
+		return err
+	}
+	credited := Money(math.Round(float64(amount) * rate))
+
+	if err := adjustBalance(tx, from, -amount); err != nil {
+		return fmt.Errorf("debiting account %d: %w", from.Number, err)
+	}
+
+	if err := adjustBalance(tx, to, credited); err != nil {
+		return fmt.Errorf("crediting account %d: %w", to.Number, err)
+	}
+
+	var debitFX, creditFX *FXDetails
+	if from.Currency != to.Currency {
+		debitFX = &FXDetails{Amount: credited, Currency: to.Currency, Rate: rate}
+		creditFX = &FXDetails{Amount: amount, Currency: from.Currency, Rate: rate}
+	}
+
+	if err := recordTransferTransaction(tx, from, debitKind, -amount, to.Number, debitFX); err != nil {
+		return err
+	}
+
+	return recordTransferTransaction(tx, to, creditKind, credited, from.Number, creditFX)
+}
+
+// CloseAccount marks an account closed. Any remaining positive balance is
+// first swept to the account numbered sweepTo; without one the balance must
+// already be zero. Accounts with scheduled transfers can't be closed.
+func (s *PostgresStore) CloseAccount(id int, sweepTo int64) (*Account, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var account, sweepAccount *Account
+	if sweepTo != 0 {
+		account, sweepAccount, err = lockTransferAccounts(tx, id, sweepTo)
+	} else {
+		account, err = scanIntoAccount(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE id = $1 FOR UPDATE", id))
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkActive(account); err != nil {
+		return nil, err
+	}
+
+	var scheduled int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM scheduled_transfers WHERE account_id = $1", id).Scan(&scheduled); err != nil {
+		return nil, err
+	}
+	if scheduled > 0 {
+		return nil, fmt.Errorf("%w: %d", ErrScheduledTransfersPending, scheduled)
+	}
+
+	if account.HeldBalance > 0 {
+		return nil, fmt.Errorf("%w: %s held", ErrPendingTransfers, account.HeldBalance)
+	}
+
+	if account.Balance < 0 || (account.Balance > 0 && sweepAccount == nil) {
+		return nil, fmt.Errorf("%w: %s", ErrNonZeroBalance, account.Balance)
+	}
+
+	if account.Balance > 0 {
+		if err := s.moveMoney(tx, account, sweepAccount, account.Balance); err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.QueryRow(
+		"UPDATE accounts SET status = $1, updated_at = NOW() WHERE id = $2 RETURNING status, updated_at",
+		AccountStatusClosed, id).Scan(&account.Status, &account.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return account, tx.Commit()
+}
+
+// CloseDormantAccounts closes, in one transaction, the active accounts with
+// neither balance nor held funds, no scheduled transfers and no ledger entry
+// since inactiveSince, returning how many. Admin accounts and the fee account
+// are left alone. Every closure is recorded in the audit log under actorID.
+// A dry run only counts them.
+func (s *PostgresStore) CloseDormantAccounts(inactiveSince time.Time, dryRun bool, actorID int) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	details, err := json.Marshal(map[string]interface{}{"inactive_since": NewTimestamp(inactiveSince)})
+	if err != nil {
+		return 0, err
+	}
+
+	// The balance is checked again on the locked rows, so an account that
+	// receives money concurrently is never closed.
+	var closed int
+	err = tx.QueryRow(`WITH closed AS (
+			UPDATE accounts SET status = $1, updated_at = NOW()
+			WHERE status = $2 AND balance = 0 AND held_balance = 0 AND NOT is_admin AND number <> $3
+				AND created_at < $4
+				AND NOT EXISTS (SELECT 1 FROM transactions t WHERE t.account_id = accounts.id AND t.created_at >= $4)
+				AND NOT EXISTS (SELECT 1 FROM scheduled_transfers st WHERE st.account_id = accounts.id)
+			RETURNING id
+		), audited AS (
+			INSERT INTO audit_log (account_id, action, actor_id, details)
+			SELECT id, 'close_dormant', $5, $6 FROM closed
+		)
+		SELECT COUNT(*) FROM closed`,
+		AccountStatusClosed, AccountStatusActive, s.fees.Account, inactiveSince, actorID, string(details)).Scan(&closed)
+	if err != nil {
+		return 0, err
+	}
+
+	if dryRun {
+		return closed, nil
+	}
+	return closed, tx.Commit()
+}
+
+// checkActive returns an error if money may not move in or out of account.
+func checkActive(account *Account) error {
+	switch account.Status {
+	case AccountStatusFrozen:
+		return fmt.Errorf("%w: %d", ErrAccountFrozen, account.Number)
+	case AccountStatusClosed:
+		return fmt.Errorf("%w: %d", ErrAccountClosed, account.Number)
+	default:
+		return nil
+	}
+}
+
+// checkMinBalance returns an InsufficientFundsError if taking amount out of
+// account would leave it below the minimum balance for its type, not counting
+// funds held by pending transfers.
+func (s *PostgresStore) checkMinBalance(account *Account, amount Money) error {
+	available := account.Available() - s.minBalances[account.Type]
+	if amount > available {
+		if available < 0 {
+			available = 0
+		}
+		return &InsufficientFundsError{Attempted: amount, Available: available}
+	}
+	return nil
+}
+
+// checkDailyLimit returns a DailyLimitError if sending amount would take the
+// total sent by account today past the limit of its type. Days start at
+// midnight UTC.
+func (s *PostgresStore) checkDailyLimit(tx *sql.Tx, account *Account, amount Money) error {
+	limit := s.dailyLimits[account.Type]
+	if limit == 0 {
+		return nil
+	}
+
+	// The account row is locked, so no concurrent transfer can slip in
+	// between this sum and the debit. The day starts at midnight UTC of the
+	// clock's now, whatever the time zone of the session.
+	var sent Money
+	err := tx.QueryRow(
+		`SELECT COALESCE(-SUM(amount), 0)::BIGINT FROM transactions
+		WHERE account_id = $1 AND type = $2
+		AND created_at >= date_trunc('day', $3::TIMESTAMPTZ AT TIME ZONE 'UTC') AT TIME ZONE 'UTC'`,
+		account.ID, TransactionTransferOut, s.clock.Now()).Scan(&sent)
+	if err != nil {
+		return err
+	}
+
+	if sent+amount > limit {
+		remaining := limit - sent
+		if remaining < 0 {
+			remaining = 0
+		}
+		return &DailyLimitError{Limit: limit, Remaining: remaining}
+	}
+	return nil
+}
+
+// adjustBalance adds delta to the balance of a locked account row and keeps
+// the in-memory copy in sync.
+func adjustBalance(tx *sql.Tx, account *Account, delta Money) error {
+	// A missing row surfaces as sql.ErrNoRows rather than a silent no-op, so
+	// the caller's transaction never commits half a transfer.
+	return tx.QueryRow(
+		"UPDATE accounts SET balance = balance + $1, updated_at = NOW() WHERE id = $2 RETURNING balance, updated_at",
+		delta, account.ID).Scan(&account.Balance, &account.UpdatedAt)
+}
+
+// adjustHold adds delta to the funds held on a locked account row and keeps
+// the in-memory copy in sync.
+func adjustHold(tx *sql.Tx, account *Account, delta Money) error {
+	return tx.QueryRow(
+		"UPDATE accounts SET held_balance = held_balance + $1, updated_at = NOW() WHERE id = $2 RETURNING held_balance, updated_at",
+		delta, account.ID).Scan(&account.HeldBalance, &account.UpdatedAt)
+}
+
+// recordTransaction appends a ledger entry for a balance change that was just
+// applied to account. A zero counterparty is stored as NULL.
+func recordTransaction(tx *sql.Tx, account *Account, kind TransactionType, amount Money, counterparty int64) error {
+	return recordTransferTransaction(tx, account, kind, amount, counterparty, nil)
+}
+
+// recordTransferTransaction is recordTransaction with the conversion details
+// of a transfer between currencies, if any.
+func recordTransferTransaction(tx *sql.Tx, account *Account, kind TransactionType, amount Money, counterparty int64, fx *FXDetails) error {
+	_, err := insertTransaction(tx, account, kind, amount, counterparty, fx, 0)
+	return err
+}
+
+// labelLatestEntry sets labels on the latest ledger entry of kind of an
+// account, which the caller just recorded inside tx. The account row is
+// locked by then, so no other entry of it can come in between.
+func labelLatestEntry(tx *sql.Tx, accountID int, kind TransactionType, labels TransactionLabels) error {
+	if labels.Category == "" && len(labels.Tags) == 0 {
+		return nil
+	}
+
+	tags, err := json.Marshal(labels.Tags)
+	if err != nil {
+		return err
+	}
+	if labels.Tags == nil {
+		tags = []byte("[]")
+	}
+
+	_, err = tx.Exec(
+		`UPDATE transactions SET category = NULLIF($1, ''), tags = $2
+		WHERE id = (SELECT MAX(id) FROM transactions WHERE account_id = $3 AND type = $4)`,
+		labels.Category, string(tags), accountID, kind)
+	return err
+}
+
+// insertTransaction appends a ledger entry and returns it, along with the
+// outbox event for webhooks if its type is one they may subscribe to. A zero
+// reversalOf is stored as NULL. The entry is stamped by NOW(), the time of the
+// database transaction like the balance change it records, rather than with
+// the account's updated_at, which is a TIMESTAMP without a time zone.
+func insertTransaction(tx *sql.Tx, account *Account, kind TransactionType, amount Money, counterparty int64, fx *FXDetails, reversalOf int) (*Transaction, error) {
+	var (
+		fxAmount   sql.NullInt64
+		fxCurrency sql.NullString
+		fxRate     sql.NullFloat64
+	)
+	if fx != nil {
+		fxAmount = sql.NullInt64{Int64: int64(fx.Amount), Valid: true}
+		fxCurrency = sql.NullString{String: fx.Currency, Valid: true}
+		fxRate = sql.NullFloat64{Float64: fx.Rate, Valid: true}
+	}
+
+	transaction, err := scanIntoTransaction(tx.QueryRow(
+		`INSERT INTO transactions (account_id, type, amount, currency, balance, counterparty, fx_amount, fx_currency, fx_rate, reversal_of, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), $7, $8, $9, NULLIF($10, 0), NOW())
+		RETURNING `+transactionColumns,
+		account.ID, kind, amount, account.Currency, account.Balance, counterparty, fxAmount, fxCurrency, fxRate, reversalOf))
+	if err != nil || !webhookEventTypes[kind] {
+		return transaction, err
+	}
+
+	if amount < 0 {
+		amount = -amount
+	}
+	event := &WebhookEvent{
+		ID:            newEventID(),
+		Type:          kind,
+		AccountNumber: account.Number,
+		Amount:        amount,
+		Counterparty:  counterparty,
+		OccurredAt:    transaction.CreatedAt,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec("INSERT INTO outbox (account_number, payload) VALUES ($1, $2)", account.Number, string(payload)); err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// ForEachTransaction calls fn for every ledger entry of an account matching
+// filter, oldest first, without loading them all in memory.
+func (s *PostgresStore) ForEachTransaction(ctx context.Context, accountID int, filter TransactionFilter, fn func(*Transaction) error) error {
+	query, args := transactionQuery(accountID, filter)
+
+	rows, err := s.reader.QueryContext(ctx, query+" ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		transaction, err := scanIntoTransactionView(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(transaction); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetTransactionsByAccount returns up to limit ledger entries of an account,
+// newest first. Paging uses filter.Before as a keyset cursor on the id rather
+// than an offset, so it stays fast on long histories and pages don't shift
+// when new entries are inserted concurrently.
+func (s *PostgresStore) GetTransactionsByAccount(ctx context.Context, accountID int, filter TransactionFilter, limit int) ([]*Transaction, error) {
+	query, args := transactionQuery(accountID, filter)
+
+	args = append(args, limit)
+	rows, err := s.reader.QueryContext(ctx, fmt.Sprintf("%s ORDER BY id DESC LIMIT $%d", query, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []*Transaction{}
+	for rows.Next() {
+		transaction, err := scanIntoTransactionView(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, transaction)
+	}
+	return transactions, rows.Err()
+}
+
+// GetTransactionById returns a single ledger entry, whatever account it
+// belongs to.
+func (s *PostgresStore) GetTransactionById(id int) (*Transaction, error) {
+	transaction, err := scanIntoTransactionView(s.reader.QueryRow("SELECT "+transactionViewColumns+" FROM transactions WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: id %d", ErrTransactionNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+// GetLedgerTransfers returns up to limit transfers of any accounts matching
+// filter, newest first.
+func (s *PostgresStore) GetLedgerTransfers(ctx context.Context, filter LedgerTransferFilter, limit int) ([]*LedgerTransfer, error) {
+	var queryBuffer bytes.Buffer
+	queryBuffer.WriteString(`SELECT t.id, t.account_id, a.number, t.counterparty, -t.amount, t.currency, t.reversed, t.created_at
+		FROM transactions t LEFT JOIN accounts a ON a.id = t.account_id
+		WHERE t.type = $1 AND t.created_at >= $2`)
+
+	args := []interface{}{TransactionTransferOut, filter.Since}
+	if filter.MinAmount != 0 {
+		args = append(args, filter.MinAmount)
+		fmt.Fprintf(&queryBuffer, " AND -t.amount >= $%d", len(args))
+	}
+	if filter.Before != 0 {
+		args = append(args, filter.Before)
+		fmt.Fprintf(&queryBuffer, " AND t.id < $%d", len(args))
+	}
+	args = append(args, limit)
+	fmt.Fprintf(&queryBuffer, " ORDER BY t.id DESC LIMIT $%d", len(args))
+
+	rows, err := s.reader.QueryContext(ctx, queryBuffer.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []*LedgerTransfer{}
+	for rows.Next() {
+		transfer := &LedgerTransfer{}
+		var from sql.NullInt64
+		if err := rows.Scan(&transfer.ID, &transfer.FromAccountID, &from, &transfer.ToAccount,
+			&transfer.Amount, &transfer.Currency, &transfer.Reversed, &transfer.CreatedAt); err != nil {
+			return nil, err
+		}
+		transfer.FromAccount = from.Int64
+		transfers = append(transfers, transfer)
+	}
+
+	return transfers, rows.Err()
+}
+
+// transactionQuery builds the SELECT and its arguments for the entries of an
+// account matching filter, without any ordering.
+func transactionQuery(accountID int, filter TransactionFilter) (string, []interface{}) {
+	conditions, args := transactionConditions(accountID, filter)
+	return "SELECT " + transactionViewColumns + " FROM transactions WHERE " + conditions, args
+}
+
+// transactionConditions builds the WHERE clause selecting the entries of an
+// account matching filter, and its arguments.
+func transactionConditions(accountID int, filter TransactionFilter) (string, []interface{}) {
+	var queryBuffer bytes.Buffer
+	queryBuffer.WriteString("account_id = $1")
+
+	args := []interface{}{accountID}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		fmt.Fprintf(&queryBuffer, " AND created_at >= $%d", len(args))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		fmt.Fprintf(&queryBuffer, " AND created_at < $%d", len(args))
+	}
+	if filter.Before != 0 {
+		args = append(args, filter.Before)
+		fmt.Fprintf(&queryBuffer, " AND id < $%d", len(args))
+	}
+	if filter.Category != "" {
+		args = append(args, filter.Category)
+		fmt.Fprintf(&queryBuffer, " AND category = $%d", len(args))
+	}
+
+	return queryBuffer.String(), args
+}
+
+// SumByCategory totals the categorized ledger entries of an account matching
+// filter, by category in alphabetical order.
+func (s *PostgresStore) SumByCategory(ctx context.Context, accountID int, filter TransactionFilter) ([]*CategoryTotal, error) {
+	conditions, args := transactionConditions(accountID, filter)
+
+	rows, err := s.reader.QueryContext(ctx,
+		"SELECT category, SUM(amount), COUNT(*) FROM transactions WHERE "+conditions+" AND category IS NOT NULL GROUP BY category ORDER BY category",
+		args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []*CategoryTotal{}
+	for rows.Next() {
+		total := &CategoryTotal{}
+		if err := rows.Scan(&total.Category, &total.Amount, &total.Count); err != nil {
+			return nil, err
+		}
+		totals = append(totals, total)
+	}
+	return totals, rows.Err()
+}
+
+// SummarizeTransactions totals the ledger entries of an account matching
+// filter by type. No entries at all give a zero summary.
+func (s *PostgresStore) SummarizeTransactions(ctx context.Context, accountID int, filter TransactionFilter) (*AccountSummary, error) {
+	conditions, args := transactionConditions(accountID, filter)
+	args = append(args, TransactionDeposit, TransactionWithdrawal, TransactionTransferIn, TransactionTransferOut)
+	n := len(args)
+
+	summary := &AccountSummary{}
+	err := s.reader.QueryRowContext(ctx, fmt.Sprintf(`SELECT
+		COALESCE(SUM(amount) FILTER (WHERE type = $%[1]d), 0),
+		COALESCE(-SUM(amount) FILTER (WHERE type = $%[2]d), 0),
+		COALESCE(SUM(amount) FILTER (WHERE type = $%[3]d), 0),
+		COALESCE(-SUM(amount) FILTER (WHERE type = $%[4]d), 0),
+		COALESCE(SUM(amount) FILTER (WHERE type NOT IN ($%[1]d, $%[2]d, $%[3]d, $%[4]d)), 0),
+		COALESCE(SUM(amount), 0),
+		COUNT(*)
+		FROM transactions WHERE %[5]s`, n-3, n-2, n-1, n, conditions),
+		args...).Scan(
+		&summary.Deposits,
+		&summary.Withdrawals,
+		&summary.TransfersIn,
+		&summary.TransfersOut,
+		&summary.Other,
+		&summary.NetChange,
+		&summary.Count)
+	if err != nil {
+		return nil, err
+	}
+	return summary, nil
+}
+
+// BalanceAt returns the balance an account had just before at, according to the
+// ledger. A zero at means the opening balance of the account.
+func (s *PostgresStore) BalanceAt(ctx context.Context, accountID int, at time.Time) (Money, error) {
+	var balance Money
+	if at.IsZero() {
+		return balance, nil
+	}
+
+	err := s.reader.QueryRowContext(ctx,
+		"SELECT balance FROM transactions WHERE account_id = $1 AND created_at < $2 ORDER BY id DESC LIMIT 1",
+		accountID, at).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return balance, err
+}
+
+func (s *PostgresStore) CreateScheduledTransfer(st *ScheduledTransfer) error {
+	query := `INSERT INTO scheduled_transfers (account_id, to_account, amount, frequency, next_run, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id`
+
+	return s.db.QueryRow(
+		query,
+		st.AccountID,
+		st.ToAccount,
+		st.Amount,
+		st.Frequency,
+		st.NextRun,
+		st.CreatedAt).Scan(&st.ID)
+}
+
+// GetDueScheduledTransfers returns the schedules whose next run, or pending
+// retry, is not after now.
+func (s *PostgresStore) GetDueScheduledTransfers(now time.Time) ([]*ScheduledTransfer, error) {
+	rows, err := s.db.Query("SELECT "+scheduledTransferColumns+" FROM scheduled_transfers WHERE COALESCE(retry_at, next_run) <= $1 ORDER BY next_run", now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []*ScheduledTransfer{}
+	for rows.Next() {
+		st, err := scanIntoScheduledTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, st)
+	}
+	return schedules, rows.Err()
+}
+
+// GetScheduledTransfersByAccount returns the schedules of an account, oldest
+// first.
+func (s *PostgresStore) GetScheduledTransfersByAccount(ctx context.Context, accountID int) ([]*ScheduledTransfer, error) {
+	rows, err := s.reader.QueryContext(ctx, "SELECT "+scheduledTransferColumns+" FROM scheduled_transfers WHERE account_id = $1 ORDER BY id", accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []*ScheduledTransfer{}
+	for rows.Next() {
+		st, err := scanIntoScheduledTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, st)
+	}
+	return schedules, rows.Err()
+}
+
+// RecordScheduledTransferRun logs an attempt and saves the schedule's new
+// next_run, retry_at, failures and last_error, which the caller has already updated.
+func (s *PostgresStore) RecordScheduledTransferRun(st *ScheduledTransfer, runErr error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var errText sql.NullString
+	if runErr != nil {
+		errText = sql.NullString{String: runErr.Error(), Valid: true}
+	}
+
+	if _, err := tx.Exec("INSERT INTO scheduled_transfer_runs (scheduled_transfer_id, error) VALUES ($1, $2)", st.ID, errText); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE scheduled_transfers SET next_run = $1, retry_at = $2, failures = $3, last_error = $4 WHERE id = $5",
+		st.NextRun, st.RetryAt, st.Failures, st.LastError, st.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AccrueInterest credits one day of interest to every savings account with a
+// positive balance that hasn't been credited for day yet, and returns how many
+// accounts were credited. Running it again for the same day credits nothing.
+func (s *PostgresStore) AccrueInterest(day time.Time) (int, error) {
+	rows, err := s.db.Query(
+		`SELECT id FROM accounts a
+		WHERE account_type = $1 AND interest_rate > 0 AND balance > 0
+		AND NOT EXISTS (SELECT 1 FROM interest_accruals i WHERE i.account_id = a.id AND i.day = $2)`,
+		AccountTypeSavings, day)
+	if err != nil {
+		return 0, err
+	}
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	credited := 0
+	for _, id := range ids {
+		ok, err := s.accrueAccountInterest(id, day)
+		if err != nil {
+			return credited, err
+		}
+		if ok {
+			credited++
+		}
+	}
+	return credited, nil
+}
+
+// accrueAccountInterest credits a single account inside its own transaction.
+// The interest_accruals row is what makes the accrual idempotent: if it
+// already exists for day, nothing is credited.
+func (s *PostgresStore) accrueAccountInterest(id int, day time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	account, err := scanIntoAccount(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE id = $1 FOR UPDATE", id))
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := tx.Exec("INSERT INTO interest_accruals (account_id, day) VALUES ($1, $2) ON CONFLICT DO NOTHING", id, day)
+	if err != nil {
+		return false, err
+	}
+	if n, err := resp.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+
+	interest := Money(math.Round(float64(account.Balance) * account.InterestRate / 365))
+	if interest > 0 {
+		if err := adjustBalance(tx, account, interest); err != nil {
+			return false, err
+		}
+		if err := recordTransaction(tx, account, TransactionInterest, interest, 0); err != nil {
+			return false, err
+		}
+	}
+
+	return interest > 0, tx.Commit()
+}
+
+// UpdateAccountStatus moves an account from status from to status to, failing
+// if it isn't currently in status from.
+func (s *PostgresStore) UpdateAccountStatus(id int, from, to AccountStatus) (*Account, error) {
+	row := s.db.QueryRow(
+		"UPDATE accounts SET status = $1, updated_at = NOW() WHERE id = $2 AND status = $3 RETURNING "+accountColumns,
+		to, id, from)
+
+	account, err := scanIntoAccount(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: id %d with status %s", ErrAccountNotFound, id, from)
+	}
+	return account, err
+}
+
+// TransferOwnership hands the account id over to a new holder, keeping its
+// number, balance and history. The previous holder loses every way in: the
+// password is replaced, two-factor authentication is removed and all issued
+// tokens are invalidated, and the account moves to a new customer. The change
+// is recorded in the audit log along with the admin actorID who made it.
+func (s *PostgresStore) TransferOwnership(id int, holder *TransferOwnershipRequest, encryptedPassword string, actorID int) (*Account, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	previous, err := scanIntoAccount(tx.QueryRow("SELECT "+accountColumns+" FROM accounts WHERE id = $1 FOR UPDATE", id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// The new holder is another customer, who mustn't reach the previous
+	// holder's other accounts.
+	var customerID int
+	if err := tx.QueryRow("INSERT INTO customers DEFAULT VALUES RETURNING id").Scan(&customerID); err != nil {
+		return nil, err
+	}
+
+	account, err := scanIntoAccount(tx.QueryRow(
+		`UPDATE accounts SET customer_id = $1, first_name = $2, last_name = $3, email = $4, encrypted_password = $5,
+		email_verified = email_verified AND email IS NOT DISTINCT FROM $4, version = version + 1, token_version = token_version + 1, updated_at = NOW()
+		WHERE id = $6 RETURNING `+accountColumns,
+		customerID, holder.FirstName, holder.LastName, holder.Email, encryptedPassword, id))
+	if err != nil {
+		return nil, translateError(err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM account_totp WHERE account_id = $1", id); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM login_failures WHERE account_id = $1", id); err != nil {
+		return nil, err
+	}
+
+	type holderDetails struct {
+		FirstName string `json:"first_name"`
+		LastName  string `json:"last_name"`
+		Email     string `json:"email"`
+	}
+	details, err := json.Marshal(map[string]holderDetails{
+		"previous": {previous.FirstName, previous.LastName, previous.Email},
+		"new":      {account.FirstName, account.LastName, account.Email},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO audit_log (account_id, action, actor_id, details) VALUES ($1, $2, $3, $4)",
+		id, "transfer_ownership", actorID, string(details)); err != nil {
+		return nil, err
+	}
+
+	return account, tx.Commit()
+}
+
+// CreateStatementEmail queues email for sending, filling in its id, status and
+// creation time.
+func (s *PostgresStore) CreateStatementEmail(email *StatementEmail) error {
+	return s.db.QueryRow(
+		`INSERT INTO statement_emails (account_id, email, format, period_from, period_to)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, status, created_at`,
+		email.AccountID, email.Email, email.Format, email.From, email.To,
+	).Scan(&email.ID, &email.Status, &email.CreatedAt)
+}
+
+// GetStatementEmails returns the latest statement emails of an account, newest
+// first.
+func (s *PostgresStore) GetStatementEmails(ctx context.Context, accountID, limit int) ([]*StatementEmail, error) {
+	rows, err := s.reader.QueryContext(ctx,
+		"SELECT "+statementEmailColumns+" FROM statement_emails WHERE account_id = $1 ORDER BY id DESC LIMIT $2",
+		accountID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanStatementEmails(rows)
+}
+
+// GetPendingStatementEmails returns up to limit statement emails left to send,
+// oldest first.
+func (s *PostgresStore) GetPendingStatementEmails(limit int) ([]*StatementEmail, error) {
+	rows, err := s.db.Query(
+		"SELECT "+statementEmailColumns+" FROM statement_emails WHERE status = $1 ORDER BY id LIMIT $2",
+		StatementEmailPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanStatementEmails(rows)
+}
+
+// RecordStatementEmailAttempt records an attempt to send the statement email
+// id, which failed unless sendErr is nil. The email stays pending until its
+// maxAttempts-th failure.
+func (s *PostgresStore) RecordStatementEmailAttempt(id int, sendErr error, maxAttempts int) error {
+	var errText string
+	if sendErr != nil {
+		errText = sendErr.Error()
+	}
+
+	_, err := s.db.Exec(
+		`UPDATE statement_emails SET attempts = attempts + 1, error = $1,
+		status = CASE WHEN NOT $2 THEN 'sent' WHEN attempts + 1 >= $3 THEN 'failed' ELSE 'pending' END,
+		sent_at = CASE WHEN NOT $2 THEN NOW() END
+		WHERE id = $4`,
+		errText, sendErr != nil, maxAttempts, id)
+	return err
+}
+
+func (s *PostgresStore) CreateWebhook(webhook *Webhook) error {
+	query := `INSERT INTO webhooks (account_id, url, events, secret, created_at)
+	VALUES ($1, $2, $3, $4, $5)
+	RETURNING id`
+
+	return s.db.QueryRow(
+		query,
+		webhook.AccountID,
+		webhook.URL,
+		pq.Array(webhook.Events),
+		webhook.Secret,
+		webhook.CreatedAt).Scan(&webhook.ID)
+}
+
+// GetWebhooksForEvent returns the webhooks of an account subscribed to event.
+func (s *PostgresStore) GetWebhooksForEvent(accountNumber int64, event TransactionType) ([]*Webhook, error) {
+	rows, err := s.db.Query(
+		`SELECT w.id, w.account_id, w.url, w.events, w.secret, w.created_at
+		FROM webhooks w JOIN accounts a ON a.id = w.account_id
+		WHERE a.number = $1 AND $2 = ANY (w.events)`,
+		accountNumber, event)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		webhook := &Webhook{}
+		var events []string
+		if err := rows.Scan(&webhook.ID, &webhook.AccountID, &webhook.URL, pq.Array(&events), &webhook.Secret, &webhook.CreatedAt); err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			webhook.Events = append(webhook.Events, TransactionType(e))
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *PostgresStore) RecordWebhookDelivery(delivery *WebhookDelivery) error {
+	_, err := s.db.Exec(
+		`INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, attempt, status_code, error)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), NULLIF($6, ''))`,
+		delivery.WebhookID, delivery.EventID, delivery.EventType, delivery.Attempt, delivery.StatusCode, delivery.Error)
+	return err
+}
+
+// GetOutboxEvents returns up to limit unpublished events, oldest first, leaving
+// out those of the accounts in skipAccounts.
+func (s *PostgresStore) GetOutboxEvents(limit int, skipAccounts []int64) ([]*OutboxEvent, error) {
+	// A nil slice would be NULL, matching nothing.
+	if skipAccounts == nil {
+		skipAccounts = []int64{}
+	}
+
+	rows, err := s.db.Query(
+		`SELECT id, payload FROM outbox
+		WHERE published_at IS NULL AND account_number <> ALL ($1)
+		ORDER BY id LIMIT $2`,
+		pq.Array(skipAccounts), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*OutboxEvent{}
+	for rows.Next() {
+		event := &OutboxEvent{Event: &WebhookEvent{}}
+		var payload string
+		if err := rows.Scan(&event.ID, &payload); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(payload), event.Event); err != nil {
+			return nil, fmt.Errorf("outbox event %d: %w", event.ID, err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// MarkOutboxEventPublished records that an event went out to its webhooks,
+// whether or not they accepted it, so that it isn't read from the outbox again.
+func (s *PostgresStore) MarkOutboxEventPublished(id int64) error {
+	_, err := s.db.Exec("UPDATE outbox SET published_at = NOW() WHERE id = $1", id)
+	return err
+}
+
+// HasAdmin reports whether at least one admin account exists.
+func (s *PostgresStore) HasAdmin() (bool, error) {
+	var exists bool
+	err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM accounts WHERE is_admin)").Scan(&exists)
+	return exists, err
+}
+
+// GetLoginLock returns until when logins to the account are locked, or the
+// zero time if they aren't.
+func (s *PostgresStore) GetLoginLock(accountID int) (time.Time, error) {
+	var until time.Time
+	err := s.db.QueryRow(
+		"SELECT locked_until FROM login_failures WHERE account_id = $1 AND locked_until > $2",
+		accountID, s.clock.Now()).Scan(&until)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	return until, err
+}
+
+// RecordLoginFailure counts a failed login. The maxFailures-th consecutive
+// failure locks the account for lockout and starts the count over; the end of
+// the lock is returned, or the zero time if the account isn't locked yet.
+func (s *PostgresStore) RecordLoginFailure(accountID, maxFailures int, lockout time.Duration) (time.Time, error) {
+	var failures int
+	err := s.db.QueryRow(`INSERT INTO login_failures (account_id, failures) VALUES ($1, 1)
+		ON CONFLICT (account_id) DO UPDATE SET failures = login_failures.failures + 1
+		RETURNING failures`, accountID).Scan(&failures)
+	if err != nil || failures < maxFailures {
+		return time.Time{}, err
+	}
+
+	var until time.Time
+	err = s.db.QueryRow(
+		"UPDATE login_failures SET failures = 0, locked_until = $2 WHERE account_id = $1 RETURNING locked_until",
+		accountID, s.clock.Now().Add(lockout)).Scan(&until)
+	return until, err
+}
+
+// ResetLoginFailures clears the failure count after a successful login.
+func (s *PostgresStore) ResetLoginFailures(accountID int) error {
+	_, err := s.db.Exec("DELETE FROM login_failures WHERE account_id = $1", accountID)
+	return err
+}
+
+// GetTOTPSecret returns the encrypted TOTP secret of an account and whether
+// its setup was verified. The secret is "" if setup never started.
+func (s *PostgresStore) GetTOTPSecret(accountID int) (string, bool, error) {
+	var (
+		secret  string
+		enabled bool
+	)
+	err := s.db.QueryRow("SELECT secret, enabled FROM account_totp WHERE account_id = $1", accountID).Scan(&secret, &enabled)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	return secret, enabled, err
+}
+
+// SetTOTPSecret stores a new, not yet verified, encrypted TOTP secret,
+// replacing any pending one. It fails with ErrTwoFactorEnabled once a secret
+// was verified.
+func (s *PostgresStore) SetTOTPSecret(accountID int, secret string) error {
+	result, err := s.db.Exec(`INSERT INTO account_totp (account_id, secret) VALUES ($1, $2)
+		ON CONFLICT (account_id) DO UPDATE SET secret = $2, last_step = NULL, created_at = NOW()
+		WHERE NOT account_totp.enabled`, accountID, secret)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	return ErrTwoFactorEnabled
+}
+
+// EnableTOTP marks the account's TOTP secret as verified.
+func (s *PostgresStore) EnableTOTP(accountID int) error {
+	_, err := s.db.Exec("UPDATE account_totp SET enabled = TRUE WHERE account_id = $1", accountID)
+	return err
+}
+
+// UseTOTPStep records that the code of period step was accepted for the
+// account, reporting false if the code of that period or a later one already
+// was. Concurrent uses of the same code can't both succeed.
+func (s *PostgresStore) UseTOTPStep(accountID int, step int64) (bool, error) {
+	result, err := s.db.Exec(`UPDATE account_totp SET last_step = $2
+		WHERE account_id = $1 AND (last_step IS NULL OR last_step < $2)`, accountID, step)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RevokeTokens bumps the token version of an account and the other accounts
+// of its customer, which invalidates every token issued for them so far: a
+// token for one account of a customer reaches all of them.
+func (s *PostgresStore) RevokeTokens(accountID int) error {
+	result, err := s.db.Exec(
+		"UPDATE accounts SET token_version = token_version + 1 WHERE customer_id = (SELECT customer_id FROM accounts WHERE id = $1)",
+		accountID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("%w: id %d", ErrAccountNotFound, accountID)
+	}
+	return nil
+}
+
+// ChangePassword stores a new password hash for an account and, like
+// RevokeTokens, invalidates the tokens issued for it so far. The accounts of
+// a customer share their password, so all of them are changed.
+func (s *PostgresStore) ChangePassword(accountID int, encryptedPassword string) (*Account, error) {
+	rows, err := s.db.Query(
+		`UPDATE accounts SET encrypted_password = $1, token_version = token_version + 1, updated_at = NOW()
+		WHERE customer_id = (SELECT customer_id FROM accounts WHERE id = $2) RETURNING `+accountColumns,
+		encryptedPassword, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changed *Account
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		if account.ID == accountID {
+			changed = account
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if changed == nil {
+		return nil, fmt.Errorf("%w: id %d", ErrAccountNotFound, accountID)
+	}
+	return changed, nil
+}
+
+// SetEmailVerificationToken replaces the pending email verification of an
+// account.
+func (s *PostgresStore) SetEmailVerificationToken(accountID int, tokenHash string, expiresAt time.Time) error {
+	_, err := s.db.Exec(
+		`INSERT INTO email_verifications (account_id, token_hash, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (account_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, expires_at = EXCLUDED.expires_at`,
+		accountID, tokenHash, expiresAt)
+	return err
+}
+
+// VerifyEmail marks verified the email of the account a pending verification
+// token belongs to, consuming the token.
+func (s *PostgresStore) VerifyEmail(tokenHash string) (*Account, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var accountID int
+	err = tx.QueryRow(
+		"DELETE FROM email_verifications WHERE token_hash = $1 AND expires_at > $2 RETURNING account_id",
+		tokenHash, s.clock.Now()).Scan(&accountID)
+	if err == sql.ErrNoRows {
+		return nil, ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := scanIntoAccount(tx.QueryRow(
+		"UPDATE accounts SET email_verified = TRUE, updated_at = NOW() WHERE id = $1 RETURNING "+accountColumns,
+		accountID))
+	if err != nil {
+		return nil, err
+	}
+
+	return account, tx.Commit()
+}
+
+// translateError maps constraint violations onto the errors the API knows how to report.
+func translateError(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "accounts_email_key" {
+		return ErrEmailTaken
+	}
+	return err
+}
+
+// accountColumns lists the columns read by scanIntoAccount, in scan order.
+const accountColumns = "id, customer_id, first_name, last_name, number, balance, held_balance, currency, email, encrypted_password, account_type, status, interest_rate, is_admin, version, token_version, email_verified, created_at, updated_at"
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanIntoAccount(rows rowScanner) (*Account, error) {
+	account := &Account{}
+	var email sql.NullString
+	err := rows.Scan(
+		&account.ID,
+		&account.CustomerID,
+		&account.FirstName,
+		&account.LastName,
+		&account.Number,
 		&account.Balance,
+		&account.HeldBalance,
+		&account.Currency,
+		&email,
+		&account.EncryptedPassword,
+		&account.Type,
+		&account.Status,
+		&account.InterestRate,
+		&account.IsAdmin,
+		&account.Version,
+		&account.TokenVersion,
+		&account.EmailVerified,
 		&account.CreatedAt,
 		&account.UpdatedAt)
+	account.Email = email.String
 
 	return account, err
 }
+
+// transactionColumns lists the columns read by scanIntoTransaction, in scan order.
+const transactionColumns = "id, account_id, type, amount, currency, balance, counterparty, fx_amount, fx_currency, fx_rate, reversal_of, reversed, category, tags, created_at"
+
+// transactionViewColumns adds to transactionColumns the name of the
+// counterparty, read by scanIntoTransactionView. It is looked up when read
+// rather than stored, so that it is gone with the account. Ledger entries are
+// never edited for it.
+const transactionViewColumns = transactionColumns + `, (SELECT CASE WHEN a.status = '` + string(AccountStatusClosed) + `' THEN NULL ELSE a.first_name || ' ' || a.last_name END
+	FROM accounts a WHERE a.number = transactions.counterparty)`
+
+// scanIntoTransactionView scans a row of transactionViewColumns.
+func scanIntoTransactionView(rows rowScanner) (*Transaction, error) {
+	var name sql.NullString
+	transaction, err := scanIntoTransaction(rows, &name)
+	if transaction.Counterparty != 0 {
+		transaction.CounterpartyName = formerHolderName
+		if name.Valid {
+			transaction.CounterpartyName = name.String
+		}
+	}
+	return transaction, err
+}
+
+// scanIntoTransaction scans a row of transactionColumns, followed by the
+// columns scanned into extra, if any.
+func scanIntoTransaction(rows rowScanner, extra ...interface{}) (*Transaction, error) {
+	transaction := &Transaction{}
+	var (
+		counterparty sql.NullInt64
+		fxAmount     sql.NullInt64
+		fxCurrency   sql.NullString
+		fxRate       sql.NullFloat64
+		reversalOf   sql.NullInt64
+		category     sql.NullString
+		tags         []byte
+	)
+	dest := []interface{}{
+		&transaction.ID,
+		&transaction.AccountID,
+		&transaction.Type,
+		&transaction.Amount,
+		&transaction.Currency,
+		&transaction.Balance,
+		&counterparty,
+		&fxAmount,
+		&fxCurrency,
+		&fxRate,
+		&reversalOf,
+		&transaction.Reversed,
+		&category,
+		&tags,
+		&transaction.CreatedAt,
+	}
+	err := rows.Scan(append(dest, extra...)...)
+	if err != nil {
+		return transaction, err
+	}
+	transaction.Counterparty = counterparty.Int64
+	transaction.Category = category.String
+	if err := json.Unmarshal(tags, &transaction.Tags); err != nil {
+		return transaction, err
+	}
+	transaction.ReversalOf = int(reversalOf.Int64)
+	if fxAmount.Valid {
+		transaction.FX = &FXDetails{Amount: Money(fxAmount.Int64), Currency: fxCurrency.String, Rate: fxRate.Float64}
+	}
+
+	return transaction, err
+}
+
+// scheduledTransferColumns lists the columns read by scanIntoScheduledTransfer, in scan order.
+const scheduledTransferColumns = "id, account_id, to_account, amount, frequency, next_run, retry_at, failures, last_error, created_at"
+
+// statementEmailColumns lists the columns read by scanIntoStatementEmail, in scan order.
+const statementEmailColumns = "id, account_id, email, format, period_from, period_to, status, attempts, error, created_at, sent_at"
+
+func scanIntoStatementEmail(rows rowScanner) (*StatementEmail, error) {
+	email := &StatementEmail{}
+	err := rows.Scan(
+		&email.ID,
+		&email.AccountID,
+		&email.Email,
+		&email.Format,
+		&email.From,
+		&email.To,
+		&email.Status,
+		&email.Attempts,
+		&email.Error,
+		&email.CreatedAt,
+		&email.SentAt)
+
+	return email, err
+}
+
+func scanStatementEmails(rows *sql.Rows) ([]*StatementEmail, error) {
+	defer rows.Close()
+
+	emails := []*StatementEmail{}
+	for rows.Next() {
+		email, err := scanIntoStatementEmail(rows)
+		if err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+func scanIntoScheduledTransfer(rows rowScanner) (*ScheduledTransfer, error) {
+	st := &ScheduledTransfer{}
+	err := rows.Scan(
+		&st.ID,
+		&st.AccountID,
+		&st.ToAccount,
+		&st.Amount,
+		&st.Frequency,
+		&st.NextRun,
+		&st.RetryAt,
+		&st.Failures,
+		&st.LastError,
+		&st.CreatedAt)
+
+	return st, err
+}
+
+// pendingTransferColumns lists the columns read by scanIntoPendingTransfer, in scan order.
+const pendingTransferColumns = "id, account_id, to_account, amount, fee, category, tags, status, expires_at, confirmed_at, created_at"
+
+func scanIntoPendingTransfer(rows rowScanner) (*PendingTransfer, error) {
+	pt := &PendingTransfer{}
+	var (
+		category sql.NullString
+		tags     []byte
+	)
+	err := rows.Scan(
+		&pt.ID,
+		&pt.AccountID,
+		&pt.ToAccount,
+		&pt.Amount,
+		&pt.Fee,
+		&category,
+		&tags,
+		&pt.Status,
+		&pt.ExpiresAt,
+		&pt.ConfirmedAt,
+		&pt.CreatedAt)
+	if err != nil {
+		return pt, err
+	}
+	pt.Category = category.String
+	err = json.Unmarshal(tags, &pt.Tags)
+
+	return pt, err
+}
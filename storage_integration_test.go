@@ -0,0 +1,551 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The integration tests run against a Postgres in Docker, started once for
+// all of them. Run them with:
+//
+//	go test -tags integration ./...
+var (
+	postgresURL string // of the maintenance database of the container
+	databases   atomic.Int64
+)
+
+func TestMain(m *testing.M) {
+	ctx := context.Background()
+	container, err := postgres.RunContainer(ctx,
+		testcontainers.WithImage("postgres:16-alpine"),
+		postgres.WithDatabase("postgres"),
+		postgres.WithUsername("postgres"),
+		postgres.WithPassword("postgres"),
+		testcontainers.WithWaitStrategy(wait.ForLog("database system is ready to accept connections").
+			WithOccurrence(2).WithStartupTimeout(time.Minute)),
+	)
+	if err != nil {
+		log.Fatal("starting postgres: ", err)
+	}
+
+	postgresURL, err = container.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	if err := container.Terminate(ctx); err != nil {
+		log.Println("stopping postgres:", err)
+	}
+	os.Exit(code)
+}
+
+// newTestStore returns an initialized store on a database of its own, dropped
+// at the end of the test.
+func newTestStore(t *testing.T) *PostgresStore {
+	t.Helper()
+
+	store := newEmptyTestStore(t)
+	if err := store.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// newEmptyTestStore returns a store on an empty database of its own, dropped
+// at the end of the test.
+func newEmptyTestStore(t *testing.T) *PostgresStore {
+	t.Helper()
+
+	admin, err := sql.Open("postgres", postgresURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	name := fmt.Sprintf("test_%d", databases.Add(1))
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := admin.Exec("DROP DATABASE " + name + " WITH (FORCE)"); err != nil {
+			t.Log("dropping test database:", err)
+		}
+	})
+
+	dbURL, err := url.Parse(postgresURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbURL.Path = "/" + name
+
+	cfg := testConfig(t)
+	cfg.DatabaseURL = dbURL.String()
+	store, err := NewPostgresStore(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+// createTestAccount stores a new checking account holding balance.
+func createTestAccount(t *testing.T, store Storage, firstName, lastName string, balance Money) *Account {
+	t.Helper()
+
+	cfg := testConfig(t)
+	cfg.BcryptCost = bcrypt.MinCost
+	account, err := NewAccount(firstName, lastName, "", "Passw0rd!", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account.Balance = balance
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+func TestOpenDBAppliesPoolSettings(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.DBMaxOpenConns = 3
+	cfg.DBMaxIdleConns = 1
+	cfg.DBConnMaxLifetime = 100 * time.Millisecond
+
+	db, err := openDB(cfg, postgresURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if got := db.Stats().MaxOpenConnections; got != 3 {
+		t.Errorf("max open connections %d, want 3", got)
+	}
+
+	// With every connection taken, the next one waits.
+	ctx := context.Background()
+	conns := make([]*sql.Conn, 3)
+	for i := range conns {
+		if conns[i], err = db.Conn(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := db.Conn(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("a fourth connection: err = %v, want to wait past the deadline", err)
+	}
+
+	// Only one of them is kept idle once released.
+	for _, conn := range conns {
+		conn.Close()
+	}
+	if stats := db.Stats(); stats.Idle != 1 || stats.MaxIdleClosed != 2 {
+		t.Errorf("%d idle and %d closed connections, want 1 and 2", stats.Idle, stats.MaxIdleClosed)
+	}
+
+	// And it is closed rather than reused once too old.
+	time.Sleep(2 * cfg.DBConnMaxLifetime)
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if closed := db.Stats().MaxLifetimeClosed; closed == 0 {
+		t.Error("no connection was closed for its age")
+	}
+}
+
+func TestPostgresStoreLookupsReleaseConnections(t *testing.T) {
+	store := newTestStore(t)
+	store.db.SetMaxOpenConns(2)
+	email := "ada@example.com"
+	account := createTestAccount(t, store, "Ada", "Lovelace", 0)
+	if err := store.UpdateAccount(account.ID, &UpdateAccountRequest{Email: &email, Version: account.Version}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Far more lookups than the pool has connections, found or not: one
+	// keeping its connection would make the rest wait forever.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if _, err := store.GetAccountById(account.ID); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := store.GetAccountById(-1); !errors.Is(err, ErrAccountNotFound) {
+				t.Errorf("GetAccountById of a missing account: err = %v, want ErrAccountNotFound", err)
+				return
+			}
+			if _, err := store.GetAccountByEmail(email); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := store.GetAccountByEmail("nobody@example.com"); !errors.Is(err, ErrAccountNotFound) {
+				t.Errorf("GetAccountByEmail of a missing account: err = %v, want ErrAccountNotFound", err)
+				return
+			}
+			if _, err := store.GetAccountByNumber(account.Number); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("lookups stalled with %d connections in use", store.db.Stats().InUse)
+	}
+
+	if inUse := store.db.Stats().InUse; inUse != 0 {
+		t.Errorf("%d connections still in use after the lookups", inUse)
+	}
+}
+
+func TestPostgresStoreCreateAndGetAccount(t *testing.T) {
+	store := newTestStore(t)
+
+	created := createTestAccount(t, store, "Ada", "Lovelace", 12_34)
+	if created.ID == 0 || created.CustomerID == 0 {
+		t.Fatalf("CreateAccount left ID %d and CustomerID %d unset", created.ID, created.CustomerID)
+	}
+
+	got, err := store.GetAccountById(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != "Ada" || got.LastName != "Lovelace" || got.Number != created.Number ||
+		got.Balance != 12_34 || got.CustomerID != created.CustomerID || got.Version != 1 {
+		t.Errorf("GetAccountById = %+v, want the created account %+v", got, created)
+	}
+	if got.CreatedAt.IsZero() {
+		t.Error("created_at was not set")
+	}
+
+	var deposits int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM transactions WHERE account_id = $1 AND type = $2 AND amount = $3",
+		created.ID, TransactionDeposit, Money(12_34)).Scan(&deposits); err != nil {
+		t.Fatal(err)
+	}
+	if deposits != 1 {
+		t.Errorf("found %d opening deposits in the ledger, want 1", deposits)
+	}
+
+	if _, err := store.GetAccountById(created.ID + 1000); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("GetAccountById of a missing id: err = %v, want ErrAccountNotFound", err)
+	}
+}
+
+func TestPostgresStoreGetAccounts(t *testing.T) {
+	store := newTestStore(t)
+
+	createTestAccount(t, store, "Grace", "Hopper", 0)
+	createTestAccount(t, store, "Alan", "Turing", 0)
+	createTestAccount(t, store, "Edsger", "Dijkstra", 0)
+
+	accounts, err := store.GetAccounts(context.Background(), AccountListOptions{Sort: "last_name", Order: "asc", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 || accounts[0].LastName != "Dijkstra" || accounts[1].LastName != "Hopper" {
+		t.Errorf("first page = %v, want Dijkstra and Hopper", lastNames(accounts))
+	}
+
+	accounts, err = store.GetAccounts(context.Background(), AccountListOptions{Sort: "last_name", Order: "asc", Limit: 2, Offset: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].LastName != "Turing" {
+		t.Errorf("second page = %v, want Turing", lastNames(accounts))
+	}
+
+	opts := AccountListOptions{LastName: "Turing", Sort: "id", Order: "asc", Limit: 10}
+	accounts, err = store.GetAccounts(context.Background(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 || accounts[0].FirstName != "Alan" {
+		t.Errorf("filtered by last name = %v, want Turing only", lastNames(accounts))
+	}
+	if n, err := store.CountAccounts(context.Background(), opts); err != nil || n != 1 {
+		t.Errorf("CountAccounts = %d, %v, want 1", n, err)
+	}
+}
+
+func TestPostgresStoreGetAccountsCancelled(t *testing.T) {
+	store := newTestStore(t)
+	createTestAccount(t, store, "Ada", "Lovelace", 0)
+
+	// Another transaction locking the table stalls the query until cancelled.
+	lock, err := store.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Rollback()
+	if _, err := lock.Exec("LOCK TABLE accounts IN ACCESS EXCLUSIVE MODE"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = store.GetAccounts(ctx, AccountListOptions{Sort: "id", Order: "asc", Limit: 10})
+	if err == nil {
+		t.Fatal("GetAccounts succeeded through the lock")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("GetAccounts returned %s after the cancellation, want it aborted", elapsed)
+	}
+}
+
+func TestPostgresStoreUpdateAccount(t *testing.T) {
+	first, last := "Augusta", "Lovelace"
+	tests := []struct {
+		name                string
+		first, last         *string
+		wantFirst, wantLast string
+	}{
+		{"first name only", &first, nil, "Augusta", "Byron"},
+		{"last name only", nil, &last, "Ada", "Lovelace"},
+		{"both names", &first, &last, "Augusta", "Lovelace"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			account := createTestAccount(t, store, "Ada", "Byron", 0)
+
+			req := &UpdateAccountRequest{FirstName: tt.first, LastName: tt.last, Version: account.Version}
+			if err := store.UpdateAccount(account.ID, req); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := store.GetAccountById(account.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.FirstName != tt.wantFirst || got.LastName != tt.wantLast || got.Version != account.Version+1 {
+				t.Errorf("after update: %s %s version %d, want %s %s version %d",
+					got.FirstName, got.LastName, got.Version, tt.wantFirst, tt.wantLast, account.Version+1)
+			}
+			if !got.UpdatedAt.After(account.UpdatedAt.Time) {
+				t.Error("updated_at was not advanced")
+			}
+		})
+	}
+}
+
+func TestPostgresStoreConcurrentUpdatesConflict(t *testing.T) {
+	store := newTestStore(t)
+	account := createTestAccount(t, store, "Ada", "Byron", 0)
+
+	// Two clients that read the same version of the account both update it.
+	names := []string{"Augusta", "Annabella"}
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.UpdateAccount(account.ID, &UpdateAccountRequest{FirstName: &names[i], Version: account.Version})
+		}(i)
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && winner == -1:
+			winner = i
+		case !errors.Is(err, ErrStaleUpdate):
+			t.Fatalf("update %d: err = %v, want one success and one ErrStaleUpdate", i, err)
+		}
+	}
+	if winner == -1 {
+		t.Fatal("neither update went through")
+	}
+
+	got, err := store.GetAccountById(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != names[winner] || got.Version != account.Version+1 {
+		t.Errorf("after the updates: %s version %d, want %s version %d", got.FirstName, got.Version, names[winner], account.Version+1)
+	}
+}
+
+func TestPostgresStoreSetsTimestamps(t *testing.T) {
+	store := newTestStore(t)
+	start := time.Now().Add(-time.Minute) // allowing for clock skew with the database
+
+	cfg := testConfig(t)
+	cfg.BcryptCost = bcrypt.MinCost
+	account, err := NewAccount("Ada", "Lovelace", "", "Passw0rd!", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := NewTimestamp(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+	account.CreatedAt, account.UpdatedAt = past, past
+	if err := store.CreateAccount(account); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.GetAccountById(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CreatedAt.Before(start) || got.UpdatedAt.Before(start) {
+		t.Errorf("created at %s and updated at %s, want the time of creation", got.CreatedAt, got.UpdatedAt)
+	}
+
+	first := "Augusta"
+	if err := store.UpdateAccount(account.ID, &UpdateAccountRequest{FirstName: &first, Version: got.Version}); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := store.GetAccountById(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.CreatedAt.Equal(got.CreatedAt.Time) || updated.UpdatedAt.Before(got.UpdatedAt.Time) {
+		t.Errorf("after update: created at %s and updated at %s, want %s and later than %s",
+			updated.CreatedAt, updated.UpdatedAt, got.CreatedAt, got.UpdatedAt)
+	}
+}
+
+func TestPostgresStoreUpdateAccountClearsEmail(t *testing.T) {
+	store := newTestStore(t)
+	account := createTestAccount(t, store, "Ada", "Byron", 0)
+	email := "ada@example.com"
+	if err := store.UpdateAccount(account.ID, &UpdateAccountRequest{Email: &email, Version: account.Version}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Clearing the email leaves the fields that aren't set alone.
+	cleared := ""
+	if err := store.UpdateAccount(account.ID, &UpdateAccountRequest{Email: &cleared, Version: account.Version + 1}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetAccountById(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != "" || got.FirstName != "Ada" || got.LastName != "Byron" {
+		t.Errorf("after clearing the email: %s %s <%s>, want Ada Byron without an email", got.FirstName, got.LastName, got.Email)
+	}
+
+	var stored sql.NullString
+	if err := store.db.QueryRow("SELECT email FROM accounts WHERE id = $1", account.ID).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Valid {
+		t.Errorf("cleared email stored as %q, want NULL", stored.String)
+	}
+
+	// Without any field set there is nothing to update.
+	if err := store.UpdateAccount(account.ID, &UpdateAccountRequest{Version: got.Version}); err == nil {
+		t.Error("UpdateAccount without fields succeeded")
+	}
+}
+
+func TestPostgresStoreDeleteAccount(t *testing.T) {
+	store := newTestStore(t)
+	doomed := createTestAccount(t, store, "Ada", "Lovelace", 0)
+	kept := createTestAccount(t, store, "Alan", "Turing", 0)
+
+	if err := store.DeleteAccount(doomed.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetAccountById(doomed.ID); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("GetAccountById of the deleted account: err = %v, want ErrAccountNotFound", err)
+	}
+	if _, err := store.GetAccountById(kept.ID); err != nil {
+		t.Errorf("the other account is gone too: %v", err)
+	}
+}
+
+func TestPostgresStoreCreateAccountRenumbersTakenNumbers(t *testing.T) {
+	store := newTestStore(t)
+	// 90 possible numbers, so that a few dozen accounts collide often.
+	store.numberFormat = AccountNumberFormat{Digits: 3}
+	cfg := testConfig(t)
+	cfg.BcryptCost = bcrypt.MinCost
+	cfg.AccountNumberFormat = store.numberFormat
+
+	taken := make(map[int64]bool)
+	for i := 0; i < 30; i++ {
+		account, err := NewAccount("Ada", fmt.Sprint("Lovelace", i), "", "Passw0rd!", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Half of them ask for a number already taken on purpose.
+		if i%2 == 1 {
+			for number := range taken {
+				account.Number = number
+				break
+			}
+		}
+		if err := store.CreateAccount(account); err != nil {
+			t.Fatal(err)
+		}
+
+		if taken[account.Number] {
+			t.Fatalf("account %d got the taken number %d", i, account.Number)
+		}
+		if account.Number < 100 || account.Number > 999 || !ValidAccountNumber(account.Number) {
+			t.Fatalf("account %d got the number %d, not 3 digits with a check digit", i, account.Number)
+		}
+		taken[account.Number] = true
+	}
+}
+
+func TestPostgresStoreUseTOTPStep(t *testing.T) {
+	store := newTestStore(t)
+	account := createTestAccount(t, store, "Ada", "Lovelace", 0)
+	if err := store.SetTOTPSecret(account.ID, "secret"); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		step int64
+		used bool
+	}{
+		{100, true},
+		{100, false}, // replayed
+		{99, false},  // older than the last accepted
+		{101, true},
+	}
+	for _, tt := range steps {
+		used, err := store.UseTOTPStep(account.ID, tt.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used != tt.used {
+			t.Errorf("UseTOTPStep(%d) = %t, want %t", tt.step, used, tt.used)
+		}
+	}
+}
+
+func lastNames(accounts []*Account) []string {
+	names := make([]string, len(accounts))
+	for i, a := range accounts {
+		names[i] = a.LastName
+	}
+	return names
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestPostgresStoreCloseTwice(t *testing.T) {
+	// sql.Open doesn't connect, so no database is needed to close the pools.
+	db, err := sql.Open("postgres", "postgres://localhost/bank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := sql.Open("postgres", "postgres://replica/bank")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &PostgresStore{db: db, reader: replica}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("first Close: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if err := replica.Ping(); err == nil {
+		t.Error("expected the replica pool to be closed")
+	}
+}
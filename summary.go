@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// AccountSummary totals the ledger of an account over a period. Deposits,
+// withdrawals and transfers are positive amounts; Other nets interest, fees
+// and reversals, so that NetChange is the sum of all the rest.
+type AccountSummary struct {
+	From         *Timestamp `json:"from,omitempty"` // inclusive, omitted from account opening
+	To           *Timestamp `json:"to,omitempty"`   // exclusive, omitted up to now
+	Deposits     Money      `json:"deposits"`
+	Withdrawals  Money      `json:"withdrawals"`
+	TransfersIn  Money      `json:"transfers_in"`
+	TransfersOut Money      `json:"transfers_out"`
+	Other        Money      `json:"other"`
+	NetChange    Money      `json:"net_change"`
+	Count        int        `json:"count"` // number of ledger entries
+}
+
+// handleGetSummary handles GET requests for the totals of an account's history
+// over either the current week, month (the default) or year in UTC, given as
+// period, or the from/to dates of statements.
+func (s *APIServer) handleGetSummary(w http.ResponseWriter, r *http.Request) error {
+	query := r.URL.Query()
+
+	var filter TransactionFilter
+	if query.Has("from") || query.Has("to") {
+		if query.Has("period") {
+			return fmt.Errorf("period can't be combined with from and to")
+		}
+		var err error
+		if filter, err = getStatementPeriod(r); err != nil {
+			return err
+		}
+	} else {
+		var err error
+		if filter.From, filter.To, err = currentPeriod(query.Get("period"), s.clock.Now()); err != nil {
+			return err
+		}
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	summary, err := s.store.SummarizeTransactions(r.Context(), account.ID, filter)
+	if err != nil {
+		return err
+	}
+
+	if !filter.From.IsZero() {
+		from := NewTimestamp(filter.From)
+		summary.From = &from
+	}
+	if !filter.To.IsZero() {
+		to := NewTimestamp(filter.To)
+		summary.To = &to
+	}
+
+	return WriteJSON(w, http.StatusOK, summary)
+}
+
+// currentPeriod returns the bounds of the calendar week (starting on Monday),
+// month or year in UTC that now is in. An empty period means month.
+func currentPeriod(period string, now time.Time) (from, to time.Time, err error) {
+	now = now.UTC()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+
+	switch period {
+	case "week":
+		from = today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+		return from, from.AddDate(0, 0, 7), nil
+	case "", "month":
+		from = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(0, 1, 0), nil
+	case "year":
+		from = time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+		return from, from.AddDate(1, 0, 0), nil
+	default:
+		return from, to, fmt.Errorf("period must be week, month or year, got %q", period)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// timestampLayout is RFC 3339 with exactly three fractional digits, e.g.
+// "2024-01-31T09:30:00.000Z". Timestamps are always formatted in UTC.
+const timestampLayout = "2006-01-02T15:04:05.000Z07:00"
+
+// Timestamp is a point in time that travels over JSON in timestampLayout, so
+// that every timestamp of the API has the same shape whatever its precision
+// in the database. It is stored as a TIMESTAMP. Parsing accepts any RFC 3339
+// time.
+type Timestamp struct {
+	time.Time
+}
+
+// NewTimestamp wraps t.
+func NewTimestamp(t time.Time) Timestamp {
+	return Timestamp{Time: t}
+}
+
+func (t Timestamp) String() string {
+	return t.UTC().Format(timestampLayout)
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("invalid timestamp: %s", data)
+	}
+
+	parsed, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %q", str)
+	}
+
+	t.Time = parsed
+	return nil
+}
+
+// Value implements driver.Valuer.
+func (t Timestamp) Value() (driver.Value, error) {
+	return t.Time, nil
+}
+
+// Scan implements sql.Scanner.
+func (t *Timestamp) Scan(src interface{}) error {
+	v, ok := src.(time.Time)
+	if !ok {
+		return fmt.Errorf("cannot scan %T into Timestamp", src)
+	}
+	t.Time = v
+	return nil
+}
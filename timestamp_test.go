@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTimestampWireFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		time time.Time
+		want string
+	}{
+		{"whole seconds", time.Date(2024, 1, 31, 9, 30, 0, 0, time.UTC), `"2024-01-31T09:30:00.000Z"`},
+		{"nanoseconds", time.Date(2024, 1, 31, 9, 30, 0, 123456789, time.UTC), `"2024-01-31T09:30:00.123Z"`},
+		{"other zone", time.Date(2024, 1, 31, 10, 30, 0, 0, time.FixedZone("CET", 3600)), `"2024-01-31T09:30:00.000Z"`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(NewTimestamp(tt.time))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAccountResponseTimestamps(t *testing.T) {
+	created := NewTimestamp(time.Date(2024, 1, 31, 9, 30, 0, 987654321, time.Local))
+	account := &Account{CreatedAt: created, UpdatedAt: created}
+
+	got, err := json.Marshal(toAccountResponse(account))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(got, &fields); err != nil {
+		t.Fatal(err)
+	}
+	want := created.UTC().Format("2006-01-02T15:04:05") + ".987Z"
+	for _, name := range []string{"created_at", "updated_at"} {
+		if fields[name] != want {
+			t.Errorf("%s = %v, want %s", name, fields[name], want)
+		}
+	}
+}
+
+func TestTimestampUnmarshalJSON(t *testing.T) {
+	var ts Timestamp
+	if err := json.Unmarshal([]byte(`"2024-01-31T10:30:00.5+01:00"`), &ts); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 31, 9, 30, 0, 500_000_000, time.UTC); !ts.Equal(want) {
+		t.Errorf("parsed %s, want %s", ts, want)
+	}
+
+	for _, data := range []string{`"2024-01-31"`, `"yesterday"`, `1706693400`} {
+		if err := json.Unmarshal([]byte(data), &ts); err == nil {
+			t.Errorf("Unmarshal(%s) succeeded", data)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// minJWTSecretLength is the shortest accepted JWT_SECRET, matching the
+// 256-bit output of HS256.
+const minJWTSecretLength = 32
+
+// maxJWTTTL caps JWT_TTL: tokens can't be revoked one by one, so they
+// shouldn't live long.
+const maxJWTTTL = 7 * 24 * time.Hour
+
+// TokenKeys signs and verifies API tokens with a single configured algorithm.
+// With RS256 the verify key is public, so other services can check tokens
+// without being able to issue them.
+type TokenKeys struct {
+	method    jwt.SigningMethod
+	signKey   interface{}
+	verifyKey interface{}
+	ttl       time.Duration // lifetime of issued tokens
+	clock     Clock
+}
+
+// loadTokenKeys reads the algorithm selected by JWT_ALG and its keys:
+// JWT_SECRET for HS256, the PEM files JWT_PRIVATE_KEY_FILE and
+// JWT_PUBLIC_KEY_FILE for RS256. Tokens live for JWT_TTL, by clock.
+func loadTokenKeys(clock Clock) (*TokenKeys, error) {
+	ttl, err := envDuration("JWT_TTL", 72*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if ttl > maxJWTTTL {
+		return nil, fmt.Errorf("JWT_TTL must be at most %s", maxJWTTTL)
+	}
+
+	keys, err := loadSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	keys.ttl = ttl
+	keys.clock = clock
+	return keys, nil
+}
+
+func loadSigningKeys() (*TokenKeys, error) {
+	switch alg := envString("JWT_ALG", "HS256"); alg {
+	case "HS256":
+		secret := []byte(os.Getenv("JWT_SECRET"))
+		if len(secret) < minJWTSecretLength {
+			return nil, fmt.Errorf("JWT_SECRET must be set to at least %d bytes", minJWTSecretLength)
+		}
+		return &TokenKeys{method: jwt.SigningMethodHS256, signKey: secret, verifyKey: secret}, nil
+
+	case "RS256":
+		privatePEM, err := readKeyFile("JWT_PRIVATE_KEY_FILE")
+		if err != nil {
+			return nil, err
+		}
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(privatePEM)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_PRIVATE_KEY_FILE: %w", err)
+		}
+
+		publicPEM, err := readKeyFile("JWT_PUBLIC_KEY_FILE")
+		if err != nil {
+			return nil, err
+		}
+		publicKey, err := jwt.ParseRSAPublicKeyFromPEM(publicPEM)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_PUBLIC_KEY_FILE: %w", err)
+		}
+
+		return &TokenKeys{method: jwt.SigningMethodRS256, signKey: privateKey, verifyKey: publicKey}, nil
+
+	default:
+		return nil, fmt.Errorf("JWT_ALG: unsupported algorithm %q, expected HS256 or RS256", alg)
+	}
+}
+
+func readKeyFile(key string) ([]byte, error) {
+	path := os.Getenv(key)
+	if path == "" {
+		return nil, fmt.Errorf("%s must be set when JWT_ALG is RS256", key)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", key, err)
+	}
+	return data, nil
+}
+
+// TTL is how long issued tokens are valid for.
+func (k *TokenKeys) TTL() time.Duration {
+	return k.ttl
+}
+
+// Now is the time tokens are issued and expire by.
+func (k *TokenKeys) Now() time.Time {
+	return k.clock.Now()
+}
+
+// Sign issues a token carrying claims.
+func (k *TokenKeys) Sign(claims jwt.Claims) (string, error) {
+	return jwt.NewWithClaims(k.method, claims).SignedString(k.signKey)
+}
+
+// Parse verifies token, rejecting any whose alg header isn't the configured
+// algorithm.
+func (k *TokenKeys) Parse(token string) (*jwt.Token, error) {
+	return jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		return k.verifyKey, nil
+	}, jwt.WithValidMethods([]string{k.method.Alg()}), jwt.WithTimeFunc(k.clock.Now))
+}
@@ -0,0 +1,393 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestTransferRollsBackWhenCreditFails(t *testing.T) {
+	store := newTestStore(t)
+	from := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+	to := createTestAccount(t, store, "Alan", "Turing", 5_00)
+
+	// Fail the credit step: raising any error once the debit went through
+	// must leave no trace of it.
+	if _, err := store.db.Exec(`CREATE FUNCTION fail_credit() RETURNS trigger AS $$
+		BEGIN RAISE EXCEPTION 'credit failed'; END $$ LANGUAGE plpgsql`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec(fmt.Sprintf(`CREATE TRIGGER fail_credit BEFORE UPDATE ON accounts
+		FOR EACH ROW WHEN (NEW.id = %d AND NEW.balance > OLD.balance) EXECUTE FUNCTION fail_credit()`, to.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	entriesBefore := countTransactions(t, store)
+
+	_, err := store.Transfer(from.ID, to.Number, 40_00, TransactionLabels{})
+	if err == nil || !strings.Contains(err.Error(), "credit failed") {
+		t.Fatalf("Transfer: err = %v, want the injected credit failure", err)
+	}
+
+	assertBalance(t, store, from.ID, 100_00)
+	assertBalance(t, store, to.ID, 5_00)
+	if n := countTransactions(t, store); n != entriesBefore {
+		t.Errorf("the ledger holds %d entries, want the %d from before the transfer", n, entriesBefore)
+	}
+}
+
+func TestPreviewTransferRetriesSerializationFailures(t *testing.T) {
+	store := newTestStore(t)
+	store.retry = retryPolicy{maxAttempts: 3, baseDelay: time.Millisecond}
+	from := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+	to := createTestAccount(t, store, "Alan", "Turing", 0)
+
+	// Fail the first debit as if another transaction had interfered. The
+	// sequence counts attempts across the rollbacks.
+	if _, err := store.db.Exec(`CREATE SEQUENCE debit_attempts;
+		CREATE FUNCTION fail_first_debit() RETURNS trigger AS $$
+		BEGIN
+			IF nextval('debit_attempts') = 1 THEN
+				RAISE EXCEPTION 'could not serialize access' USING ERRCODE = 'serialization_failure';
+			END IF;
+			RETURN NEW;
+		END $$ LANGUAGE plpgsql`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.db.Exec(fmt.Sprintf(`CREATE TRIGGER fail_first_debit BEFORE UPDATE ON accounts
+		FOR EACH ROW WHEN (NEW.id = %d AND NEW.balance < OLD.balance) EXECUTE FUNCTION fail_first_debit()`, from.ID)); err != nil {
+		t.Fatal(err)
+	}
+
+	preview, err := store.PreviewTransfer(from.ID, to.Number, 40_00)
+	if err != nil {
+		t.Fatalf("PreviewTransfer wasn't retried: %v", err)
+	}
+	if preview.Credited != 40_00 {
+		t.Errorf("preview credits %s, want 40.00", preview.Credited)
+	}
+	assertBalance(t, store, from.ID, 100_00)
+}
+
+func TestDailyLimitStartsAtMidnightUTC(t *testing.T) {
+	store := newTestStore(t)
+	store.dailyLimits = map[AccountType]Money{AccountTypeChecking: 50_00}
+	from := createTestAccount(t, store, "Ada", "Lovelace", 200_00)
+	to := createTestAccount(t, store, "Alan", "Turing", 0)
+
+	// A session far ahead of UTC, whose own midnight isn't the limit's.
+	store.db.SetMaxOpenConns(1)
+	if _, err := store.db.Exec("SET TIME ZONE 'Pacific/Kiritimati'"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Transfer(from.ID, to.Number, 40_00, TransactionLabels{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Moving that transfer to just before midnight UTC frees the limit again.
+	if _, err := store.db.Exec(`UPDATE transactions SET created_at =
+		date_trunc('day', NOW() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' - INTERVAL '1 minute'`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Transfer(from.ID, to.Number, 40_00, TransactionLabels{}); err != nil {
+		t.Fatalf("a transfer of yesterday counted towards today's limit: %v", err)
+	}
+
+	var limitErr *DailyLimitError
+	_, err := store.Transfer(from.ID, to.Number, 40_00, TransactionLabels{})
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("Transfer: err = %v, want a DailyLimitError", err)
+	}
+	if limitErr.Remaining != 10_00 {
+		t.Errorf("remaining limit %s, want 10.00", limitErr.Remaining)
+	}
+}
+
+func assertBalance(t *testing.T, store *PostgresStore, id int, want Money) {
+	t.Helper()
+
+	account, err := store.GetAccountById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Balance != want || account.HeldBalance != 0 {
+		t.Errorf("account %d: balance %s, held %s, want %s and nothing held", id, account.Balance, account.HeldBalance, want)
+	}
+}
+
+func countTransactions(t *testing.T, store *PostgresStore) int {
+	t.Helper()
+
+	var n int
+	if err := store.db.QueryRow("SELECT COUNT(*) FROM transactions").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestTransferConvertsBetweenCurrencies(t *testing.T) {
+	store := newTestStore(t)
+	store.rates = NewStaticRateProvider(map[string]float64{"USD/EUR": 0.92})
+	from := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+
+	cfg := testConfig(t)
+	cfg.BcryptCost = bcrypt.MinCost
+	to, err := NewAccount("Alan", "Turing", "", "Passw0rd!", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to.Currency = "EUR"
+	if err := store.CreateAccount(to); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Transfer(from.ID, to.Number, 50_00, TransactionLabels{}); err != nil {
+		t.Fatal(err)
+	}
+	assertBalance(t, store, from.ID, 50_00)
+	assertBalance(t, store, to.ID, 46_00)
+
+	// Both sides of the ledger record what left and what arrived.
+	debit := lastTransaction(t, store, from.ID)
+	if debit.Amount != -50_00 || debit.Currency != "USD" || debit.FX == nil ||
+		debit.FX.Amount != 46_00 || debit.FX.Currency != "EUR" || debit.FX.Rate != 0.92 {
+		t.Errorf("debit %s %s with FX %+v, want -50.00 USD converted to 46.00 EUR at 0.92", debit.Amount, debit.Currency, debit.FX)
+	}
+	credit := lastTransaction(t, store, to.ID)
+	if credit.Amount != 46_00 || credit.Currency != "EUR" || credit.FX == nil ||
+		credit.FX.Amount != 50_00 || credit.FX.Currency != "USD" || credit.FX.Rate != 0.92 {
+		t.Errorf("credit %s %s with FX %+v, want 46.00 EUR converted from 50.00 USD at 0.92", credit.Amount, credit.Currency, credit.FX)
+	}
+
+	// The opposite way uses the inverse rate.
+	if _, err := store.Transfer(to.ID, from.Number, 46_00, TransactionLabels{}); err != nil {
+		t.Fatal(err)
+	}
+	assertBalance(t, store, from.ID, 100_00)
+	assertBalance(t, store, to.ID, 0)
+}
+
+func TestTransferWithoutExchangeRateFails(t *testing.T) {
+	store := newTestStore(t)
+	store.rates = NewStaticRateProvider(nil)
+	from := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+	to := createTestAccount(t, store, "Alan", "Turing", 0)
+	if _, err := store.db.Exec("UPDATE accounts SET currency = 'GBP' WHERE id = $1", to.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.Transfer(from.ID, to.Number, 50_00, TransactionLabels{}); err == nil {
+		t.Fatal("Transfer to a currency without a rate succeeded")
+	}
+	assertBalance(t, store, from.ID, 100_00)
+	assertBalance(t, store, to.ID, 0)
+}
+
+func TestGoneCounterpartiesAreAnonymized(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(store *PostgresStore, account *Account) error
+	}{
+		{"deleted", func(store *PostgresStore, account *Account) error {
+			return store.DeleteAccount(account.ID)
+		}},
+		{"closed", func(store *PostgresStore, account *Account) error {
+			_, err := store.CloseAccount(account.ID, 0)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore(t)
+			from := createTestAccount(t, store, "Ada", "Lovelace", 30_00)
+			to := createTestAccount(t, store, "Alan", "Turing", 0)
+
+			if _, err := store.Transfer(from.ID, to.Number, 30_00, TransactionLabels{}); err != nil {
+				t.Fatal(err)
+			}
+			if credit := lastTransaction(t, store, to.ID); credit.CounterpartyName != "Ada Lovelace" {
+				t.Fatalf("counterparty %q, want Ada Lovelace while the account is open", credit.CounterpartyName)
+			}
+
+			if err := tt.remove(store, from); err != nil {
+				t.Fatal(err)
+			}
+
+			credit := lastTransaction(t, store, to.ID)
+			if credit.Amount != 30_00 || credit.Balance != 30_00 || credit.Counterparty != from.Number {
+				t.Errorf("credit of %s leaving %s from %d, want 30.00 leaving 30.00 from %d",
+					credit.Amount, credit.Balance, credit.Counterparty, from.Number)
+			}
+			if credit.CounterpartyName != formerHolderName {
+				t.Errorf("counterparty %q, want %q", credit.CounterpartyName, formerHolderName)
+			}
+			body, err := json.Marshal(credit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Contains(string(body), "Ada") || strings.Contains(string(body), "Lovelace") {
+				t.Errorf("the ledger of others still names the holder: %s", body)
+			}
+			assertBalance(t, store, to.ID, 30_00)
+		})
+	}
+}
+
+func lastTransaction(t *testing.T, store *PostgresStore, accountID int) *Transaction {
+	t.Helper()
+
+	transactions, err := store.GetTransactionsByAccount(context.Background(), accountID, TransactionFilter{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transactions) == 0 {
+		t.Fatalf("account %d has no transactions", accountID)
+	}
+	return transactions[0]
+}
+
+func TestLedgerTimestampsIgnoreTheSessionTimeZone(t *testing.T) {
+	store := newTestStore(t)
+	from := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+	to := createTestAccount(t, store, "Alan", "Turing", 0)
+
+	store.db.SetMaxOpenConns(1)
+	if _, err := store.db.Exec("SET TIME ZONE 'Pacific/Kiritimati'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Transfer(from.ID, to.Number, 40_00, TransactionLabels{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fourteen hours ahead of UTC, entries stamped in local time would be
+	// off by as much.
+	var offBy float64
+	if err := store.db.QueryRow(`SELECT MAX(ABS(EXTRACT(EPOCH FROM created_at - NOW()))) FROM transactions
+		WHERE type IN ($1, $2)`, TransactionTransferOut, TransactionTransferIn).Scan(&offBy); err != nil {
+		t.Fatal(err)
+	}
+	if offBy > 60 {
+		t.Errorf("transfer entries stamped %s away from now", time.Duration(offBy*float64(time.Second)))
+	}
+}
+
+func TestPendingTransferHoldsTheFee(t *testing.T) {
+	store := newTestStore(t)
+	store.minBalances = nil // no overdraft
+	house := createTestAccount(t, store, "Bank", "Fees", 0)
+	store.fees = FeeSchedule{Flat: 1_00, Account: house.Number}
+	from := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+	to := createTestAccount(t, store, "Alan", "Turing", 0)
+
+	// The amount alone fits the balance, but not with its fee.
+	if _, err := store.CreatePendingTransfer(from.ID, to.Number, 100_00, TransactionLabels{}, time.Hour); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("CreatePendingTransfer of the whole balance: err = %v, want ErrInsufficientFunds", err)
+	}
+
+	pt, err := store.CreatePendingTransfer(from.ID, to.Number, 60_00, TransactionLabels{}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pt.Fee != 1_00 {
+		t.Errorf("pending transfer fee %s, want 1.00", pt.Fee)
+	}
+	assertHeld(t, store, from.ID, 61_00)
+
+	// What is held can't be spent on a second transfer.
+	if _, err := store.CreatePendingTransfer(from.ID, to.Number, 38_50, TransactionLabels{}, time.Hour); !errors.Is(err, ErrInsufficientFunds) {
+		t.Fatalf("CreatePendingTransfer spending held funds: err = %v, want ErrInsufficientFunds", err)
+	}
+
+	if _, err := store.ConfirmTransfer(pt.ID, from.ID); err != nil {
+		t.Fatal(err)
+	}
+	assertBalance(t, store, from.ID, 39_00)
+	assertBalance(t, store, to.ID, 60_00)
+	assertBalance(t, store, house.ID, 1_00)
+}
+
+func TestTransferReturnsTheFeeCharged(t *testing.T) {
+	store := newTestStore(t)
+	house := createTestAccount(t, store, "Bank", "Fees", 0)
+	store.fees = FeeSchedule{Flat: 1_00, Account: house.Number}
+	from := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+	to := createTestAccount(t, store, "Alan", "Turing", 0)
+
+	fee, err := store.Transfer(from.ID, to.Number, 40_00, TransactionLabels{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fee != 1_00 {
+		t.Errorf("Transfer charged %s, want 1.00", fee)
+	}
+	assertBalance(t, store, from.ID, 59_00)
+	assertBalance(t, store, house.ID, 1_00)
+}
+
+func TestExpiredPendingTransferReleasesTheFee(t *testing.T) {
+	store := newTestStore(t)
+	store.minBalances = nil // no overdraft
+	house := createTestAccount(t, store, "Bank", "Fees", 0)
+	store.fees = FeeSchedule{Flat: 1_00, Account: house.Number}
+	clock := newFakeClock(time.Now())
+	store.clock = clock
+	from := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+	to := createTestAccount(t, store, "Alan", "Turing", 0)
+
+	if _, err := store.CreatePendingTransfer(from.ID, to.Number, 60_00, TransactionLabels{}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Hour)
+	if n, err := store.ExpirePendingTransfers(); err != nil || n != 1 {
+		t.Fatalf("ExpirePendingTransfers = %d, %v, want 1 expired", n, err)
+	}
+	assertBalance(t, store, from.ID, 100_00)
+}
+
+func TestConfirmedTransferKeepsItsLabels(t *testing.T) {
+	store := newTestStore(t)
+	from := createTestAccount(t, store, "Ada", "Lovelace", 100_00)
+	to := createTestAccount(t, store, "Alan", "Turing", 0)
+
+	labels := TransactionLabels{Category: "rent", Tags: []string{"flat", "march"}}
+	pt, err := store.CreatePendingTransfer(from.ID, to.Number, 60_00, labels, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pt.TransactionLabels, labels) {
+		t.Errorf("pending transfer labels %+v, want %+v", pt.TransactionLabels, labels)
+	}
+
+	if _, err := store.ConfirmTransfer(pt.ID, from.ID); err != nil {
+		t.Fatal(err)
+	}
+	debit := lastTransaction(t, store, from.ID)
+	if debit.Type != TransactionTransferOut {
+		t.Fatalf("last entry of the sender is %s, want %s", debit.Type, TransactionTransferOut)
+	}
+	if debit.Category != labels.Category || !reflect.DeepEqual(debit.Tags, labels.Tags) {
+		t.Errorf("debit labelled %q %v, want %q %v", debit.Category, debit.Tags, labels.Category, labels.Tags)
+	}
+}
+
+func assertHeld(t *testing.T, store *PostgresStore, id int, want Money) {
+	t.Helper()
+
+	account, err := store.GetAccountById(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.HeldBalance != want {
+		t.Errorf("account %d holds %s, want %s", id, account.HeldBalance, want)
+	}
+}
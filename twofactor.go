@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// totpIssuer names the service in authenticator apps.
+const totpIssuer = "go-bank-api"
+
+// totpValidateOpts accepts the codes of the previous and next 30 second
+// period too, to tolerate clock skew between server and phone. Each period's
+// code is accepted only once per account, so a code seen over someone's
+// shoulder can't be used again.
+var totpValidateOpts = totp.ValidateOpts{
+	Period:    30,
+	Skew:      1,
+	Digits:    otp.DigitsSix,
+	Algorithm: otp.AlgorithmSHA1,
+}
+
+// ErrTOTPRequired is returned by login when the account has two-factor
+// authentication enabled and no code was sent.
+var ErrTOTPRequired = errors.New("totp code required")
+
+// ErrTwoFactorEnabled is returned when enabling two-factor authentication on
+// an account that already has it.
+var ErrTwoFactorEnabled = errors.New("two-factor authentication is already enabled")
+
+// ErrTwoFactorNotConfigured is returned when TOTP_ENCRYPTION_KEY isn't set.
+var ErrTwoFactorNotConfigured = errors.New("two-factor authentication is not configured")
+
+// TwoFactorSetup is what an authenticator app needs to start producing codes.
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URL    string `json:"otpauth_url"`
+	QRCode string `json:"qr_code"` // base64 encoded PNG of URL
+}
+
+// VerifyTOTPRequest confirms the setup with a code from the app.
+type VerifyTOTPRequest struct {
+	Code string `json:"code" validate:"required,len=6,numeric"`
+}
+
+// handleEnableTwoFactor handles POST requests for starting the two-factor
+// setup. It only takes effect once a first code is verified.
+func (s *APIServer) handleEnableTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	if s.cfg.TOTPEncryptionKey == nil {
+		return ErrTwoFactorNotConfigured
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      totpIssuer,
+		AccountName: fmt.Sprint(account.Number),
+	})
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := encryptSecret(s.cfg.TOTPEncryptionKey, key.Secret())
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.SetTOTPSecret(account.ID, encrypted); err != nil {
+		return err
+	}
+
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return err
+	}
+	var qr bytes.Buffer
+	if err := png.Encode(&qr, img); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, TwoFactorSetup{
+		Secret: key.Secret(),
+		URL:    key.URL(),
+		QRCode: base64.StdEncoding.EncodeToString(qr.Bytes()),
+	})
+}
+
+// handleVerifyTwoFactor handles POST requests for confirming the two-factor
+// setup, after which logins require a code. Wrong codes count as failed
+// logins, so that the code can't be guessed with a stolen token.
+func (s *APIServer) handleVerifyTwoFactor(w http.ResponseWriter, r *http.Request) error {
+	req := &VerifyTOTPRequest{}
+	if err := decodeAndValidate(w, r, req); err != nil {
+		return err
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	lockedUntil, err := s.store.GetLoginLock(account.ID)
+	if err != nil {
+		return err
+	}
+	if !lockedUntil.IsZero() {
+		return s.accountLocked(w, lockedUntil)
+	}
+
+	secret, enabled, err := s.totpSecret(account.ID)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		return ErrTwoFactorEnabled
+	}
+	if secret == "" {
+		return fmt.Errorf("two-factor setup was not started")
+	}
+
+	if err := s.useTOTPCode(account, req.Code, secret); errors.Is(err, ErrInvalidCredentials) {
+		return s.loginFailed(w, account)
+	} else if err != nil {
+		return err
+	}
+
+	if err := s.store.EnableTOTP(account.ID); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, toAccountResponse(account))
+}
+
+// checkTOTP enforces two-factor authentication on login for accounts that
+// have it enabled.
+func (s *APIServer) checkTOTP(account *Account, code string) error {
+	secret, enabled, err := s.totpSecret(account.ID)
+	if err != nil || !enabled {
+		return err
+	}
+
+	if code == "" {
+		return ErrTOTPRequired
+	}
+	return s.useTOTPCode(account, code, secret)
+}
+
+// useTOTPCode accepts code if it is the one of secret for the current period,
+// give or take the allowed skew, and wasn't used on the account yet. Codes of
+// periods before the last one accepted are refused too. It returns
+// ErrInvalidCredentials for codes it refuses.
+func (s *APIServer) useTOTPCode(account *Account, code, secret string) error {
+	step, ok := totpStep(code, secret, s.clock.Now())
+	if !ok {
+		return ErrInvalidCredentials
+	}
+
+	used, err := s.store.UseTOTPStep(account.ID, step)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidCredentials
+	}
+	return nil
+}
+
+// totpSecret returns the decrypted secret of an account, or "" if it never
+// started the setup.
+func (s *APIServer) totpSecret(accountID int) (string, bool, error) {
+	encrypted, enabled, err := s.store.GetTOTPSecret(accountID)
+	if err != nil || encrypted == "" {
+		return "", false, err
+	}
+
+	if s.cfg.TOTPEncryptionKey == nil {
+		return "", false, ErrTwoFactorNotConfigured
+	}
+
+	secret, err := decryptSecret(s.cfg.TOTPEncryptionKey, encrypted)
+	return secret, enabled, err
+}
+
+// totpStep returns the number of the period whose code of secret is code,
+// counted from the Unix epoch, trying the periods within the allowed skew of
+// now.
+func totpStep(code, secret string, now time.Time) (int64, bool) {
+	period := int64(totpValidateOpts.Period)
+	skew := int64(totpValidateOpts.Skew)
+
+	current := now.Unix() / period
+	for step := current - skew; step <= current+skew; step++ {
+		want, err := totp.GenerateCodeCustom(secret, time.Unix(step*period, 0).UTC(), totpValidateOpts)
+		if err == nil && subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// encryptSecret seals plaintext with AES-GCM, returning the nonce followed by
+// the ciphertext, base64 encoded.
+func encryptSecret(key []byte, plaintext string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret reverses encryptSecret.
+func decryptSecret(key []byte, encoded string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed encrypted secret")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+// totpStore keeps the two-factor state and login failures of one account.
+type totpStore struct {
+	Storage
+	secret   string
+	enabled  bool
+	lastStep int64
+	failures int
+}
+
+func (s *totpStore) GetTOTPSecret(accountID int) (string, bool, error) {
+	return s.secret, s.enabled, nil
+}
+
+func (s *totpStore) EnableTOTP(accountID int) error {
+	s.enabled = true
+	return nil
+}
+
+func (s *totpStore) UseTOTPStep(accountID int, step int64) (bool, error) {
+	if step <= s.lastStep {
+		return false, nil
+	}
+	s.lastStep = step
+	return true, nil
+}
+
+func (s *totpStore) GetLoginLock(accountID int) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (s *totpStore) RecordLoginFailure(accountID, maxFailures int, lockout time.Duration) (time.Time, error) {
+	s.failures++
+	return time.Time{}, nil
+}
+
+func TestTOTPStep(t *testing.T) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 31, 9, 30, 10, 0, time.UTC)
+	current := now.Unix() / 30
+
+	tests := []struct {
+		name   string
+		at     time.Time
+		step   int64
+		accept bool
+	}{
+		{"current period", now, current, true},
+		{"previous period", now.Add(-30 * time.Second), current - 1, true},
+		{"next period", now.Add(30 * time.Second), current + 1, true},
+		{"two periods ago", now.Add(-60 * time.Second), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, err := totp.GenerateCodeCustom(key.Secret(), tt.at, totpValidateOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			step, ok := totpStep(code, key.Secret(), now)
+			if ok != tt.accept || step != tt.step {
+				t.Errorf("totpStep = %d, %t, want %d, %t", step, ok, tt.step, tt.accept)
+			}
+		})
+	}
+
+	if _, ok := totpStep("000000x", key.Secret(), now); ok {
+		t.Error("a malformed code was accepted")
+	}
+}
+
+func TestTwoFactorCodesCountFailuresAndCantBeReplayed(t *testing.T) {
+	clock := newFakeClock(time.Date(2024, 1, 31, 9, 30, 10, 0, time.UTC))
+	cfg := testConfig(t)
+	cfg.Clock = clock
+	cfg.TOTPEncryptionKey = bytes.Repeat([]byte{7}, 32)
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := encryptSecret(cfg.TOTPEncryptionKey, key.Secret())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &totpStore{secret: encrypted}
+	s := NewAPIServer("", store, cfg)
+	account := &Account{ID: 1, Number: 79927398713}
+
+	verify := func(code string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/account/1/2fa/verify", strings.NewReader(`{"code": "`+code+`"}`))
+		req = req.WithContext(context.WithValue(req.Context(), accountContextKey{}, account))
+		rec := httptest.NewRecorder()
+		s.makeHTTPHandler(s.handleVerifyTwoFactor)(rec, req)
+		return rec
+	}
+
+	code, err := totp.GenerateCodeCustom(key.Secret(), clock.Now(), totpValidateOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := "000000"
+	if wrong == code {
+		wrong = "111111"
+	}
+
+	if rec := verify(wrong); rec.Code != http.StatusUnauthorized || store.failures != 1 {
+		t.Fatalf("wrong code: got %d with %d failures recorded, want 401 and 1", rec.Code, store.failures)
+	}
+	if rec := verify(code); rec.Code != http.StatusOK || !store.enabled {
+		t.Fatalf("right code: got %d %s, want 200 and two-factor enabled", rec.Code, rec.Body)
+	}
+
+	// The code that confirmed the setup can't log in, even a moment later.
+	clock.Advance(5 * time.Second)
+	if err := s.checkTOTP(account, code); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("replayed code: checkTOTP = %v, want ErrInvalidCredentials", err)
+	}
+
+	clock.Advance(30 * time.Second)
+	next, err := totp.GenerateCodeCustom(key.Secret(), clock.Now(), totpValidateOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkTOTP(account, next); err != nil {
+		t.Errorf("code of the next period: checkTOTP = %v, want nil", err)
+	}
+}
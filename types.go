@@ -1,50 +1,624 @@
 package main
 
 import (
+	"fmt"
 	"math/rand"
+	"strconv"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/bcrypt"
 )
 
+// TransferRequest names the destination by either its number or its id.
 type TransferRequest struct {
+	ToAccount   int64 `json:"to_account" validate:"omitempty,account_number"`
+	ToAccountID int   `json:"to_account_id,omitempty"`
+	Amount      Money `json:"amount" validate:"amount"`
+	TransactionLabels
+}
+
+// Validate checks that exactly one destination is given.
+func (req *TransferRequest) Validate() error {
+	if (req.ToAccount == 0) == (req.ToAccountID == 0) {
+		return fmt.Errorf("exactly one of to_account and to_account_id is required")
+	}
+	return nil
+}
+
+// TransferResponse describes an executed transfer.
+type TransferResponse struct {
 	ToAccount int64 `json:"to_account"`
-	Amount    int64 `json:"amount"`
+	Amount    Money `json:"amount"`
+	Fee       Money `json:"fee"` // paid by the sender on top of Amount
+}
+
+// TransferPreview is the outcome a transfer would have, as reported by a dry
+// run. Nothing is moved.
+type TransferPreview struct {
+	DryRun               bool   `json:"dry_run"`
+	ToAccount            int64  `json:"to_account"`
+	Amount               Money  `json:"amount"`
+	Credited             Money  `json:"credited"` // what the destination would receive, in Currency
+	Currency             string `json:"currency"`
+	Fee                  Money  `json:"fee"`
+	FromBalance          Money  `json:"from_balance"`          // balance of the source account afterwards
+	RequiresConfirmation bool   `json:"requires_confirmation"` // the transfer would be held until confirmed
+}
+
+// BatchTransferItem is one transfer of a batch, from the authenticated account.
+type BatchTransferItem struct {
+	ToAccount int64 `json:"to_account" validate:"required,account_number"`
+	Amount    Money `json:"amount" validate:"amount"`
+}
+
+// BatchTransferResult reports an executed transfer of a batch along with the
+// balance of the source account right after it.
+type BatchTransferResult struct {
+	ToAccount int64 `json:"to_account"`
+	Amount    Money `json:"amount"`
+	Fee       Money `json:"fee"`
+	Balance   Money `json:"balance"`
+}
+
+type DepositRequest struct {
+	Amount Money `json:"amount" validate:"amount"`
+}
+
+type WithdrawRequest struct {
+	Amount Money `json:"amount" validate:"amount"`
+	TransactionLabels
+}
+
+// TransactionLabels are what holders file their payments under, set on the
+// ledger entry debiting their account. The category must be one of
+// Config.TransactionCategories. Transfers held for confirmation keep theirs
+// until they are confirmed.
+type TransactionLabels struct {
+	Category string   `json:"category,omitempty" validate:"omitempty,max=50"`
+	Tags     []string `json:"tags,omitempty" validate:"max=10,dive,required,max=30"`
 }
 
+// CategoryTotal sums the ledger entries of an account filed under a category.
+// Debits count negative, like in the ledger.
+type CategoryTotal struct {
+	Category string `json:"category"`
+	Amount   Money  `json:"amount"`
+	Count    int    `json:"count"`
+}
+
+// LoginRequest identifies an account by either its number or its email.
+// TOTPCode is required for accounts with two-factor authentication enabled.
 type LoginRequest struct {
 	Number   int64  `json:"number"`
-	Password string `json:"password"`
+	Email    string `json:"email"`
+	Password string `json:"password" validate:"required"`
+	TOTPCode string `json:"totp_code"`
+}
+
+type LoginResponse struct {
+	Number int64  `json:"number"`
+	Token  string `json:"token"`
 }
 
 type Account struct {
-	ID        int       `json:"id"`
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	Number    int64     `json:"number"`
-	Balance   int64     `json:"balance"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID         int           `json:"id"`
+	CustomerID int           `json:"customer_id"` // the holder, who may have other accounts
+	FirstName  string        `json:"first_name"`
+	LastName   string        `json:"last_name"`
+	Number     int64         `json:"number"`
+	Balance    Money         `json:"balance"`
+	Currency   string        `json:"currency"`
+	Email      string        `json:"email"`
+	Type       AccountType   `json:"account_type"`
+	Status     AccountStatus `json:"status"`
+	IsAdmin    bool          `json:"is_admin"`
+
+	// EmailVerified is set once the holder opened the link emailed to them.
+	// Money can't leave the account before.
+	EmailVerified bool `json:"email_verified"`
+
+	HeldBalance Money `json:"held_balance"` // reserved by pending transfers, part of Balance
+
+	InterestRate float64 `json:"interest_rate"` // annual rate, e.g. 0.02 for 2%
+
+	// Version is incremented by every update of the account's details and
+	// guards UpdateAccount against lost updates.
+	Version int `json:"version"`
+
+	// TokenVersion is embedded in every token issued for the account, and
+	// bumping it invalidates all of them.
+	TokenVersion int `json:"-"`
+
+	EncryptedPassword string    `json:"-"`
+	CreatedAt         Timestamp `json:"created_at"`
+	UpdatedAt         Timestamp `json:"updated_at"`
+}
+
+// AccountResponse is the public representation of an account. Handlers return
+// this instead of Account so internal columns never reach the wire.
+type AccountResponse struct {
+	ID         int           `json:"id"`
+	CustomerID int           `json:"customer_id"`
+	FirstName  string        `json:"first_name"`
+	LastName   string        `json:"last_name"`
+	FullName   string        `json:"full_name"` // first and last name, for display
+	Number     int64         `json:"number"`
+	Balance    Money         `json:"balance"`
+	Currency   string        `json:"currency"`
+	Email      string        `json:"email"`
+	Type       AccountType   `json:"account_type"`
+	Status     AccountStatus `json:"status"`
+	CreatedAt  Timestamp     `json:"created_at"`
+	UpdatedAt  Timestamp     `json:"updated_at"`
+
+	InterestRate float64 `json:"interest_rate"`
+	Version      int     `json:"version"`
+
+	HeldBalance      Money `json:"held_balance"`
+	AvailableBalance Money `json:"available_balance"`
+
+	EmailVerified bool `json:"email_verified"`
+}
+
+func toAccountResponse(account *Account) *AccountResponse {
+	return &AccountResponse{
+		ID:         account.ID,
+		CustomerID: account.CustomerID,
+		FirstName:  account.FirstName,
+		LastName:   account.LastName,
+		FullName:   account.FullName(),
+		Number:     account.Number,
+		Balance:    account.Balance,
+		Currency:   account.Currency,
+		Email:      account.Email,
+		Type:       account.Type,
+		Status:     account.Status,
+		CreatedAt:  account.CreatedAt,
+		UpdatedAt:  account.UpdatedAt,
+
+		InterestRate: account.InterestRate,
+		Version:      account.Version,
+
+		HeldBalance:      account.HeldBalance,
+		AvailableBalance: account.Available(),
+
+		EmailVerified: account.EmailVerified,
+	}
+}
+
+func toAccountResponses(accounts []*Account) []*AccountResponse {
+	resp := make([]*AccountResponse, len(accounts))
+	for i, account := range accounts {
+		resp[i] = toAccountResponse(account)
+	}
+	return resp
+}
+
+// AccountType determines which rules apply to an account.
+type AccountType string
+
+const (
+	AccountTypeChecking AccountType = "checking"
+	AccountTypeSavings  AccountType = "savings"
+)
+
+// AccountStatus tells whether an account may be used.
+type AccountStatus string
+
+const (
+	AccountStatusActive AccountStatus = "active"
+	AccountStatusFrozen AccountStatus = "frozen" // blocked by compliance, may be unfrozen
+	AccountStatusClosed AccountStatus = "closed"
+)
+
+// Valid reports whether t is one of the supported account types.
+func (t AccountType) Valid() bool {
+	return t == AccountTypeChecking || t == AccountTypeSavings
 }
 
 type CreateAccountRequest struct {
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	FirstName string `json:"first_name" validate:"required,max=50"`
+	LastName  string `json:"last_name" validate:"required,max=50"`
+	Email     string `json:"email" validate:"required,email,max=255"`
+	Password  string `json:"password" validate:"required,max=72"`
+	Currency  string `json:"currency" validate:"omitempty,iso4217"` // defaults to DefaultCurrency
+
+	Type AccountType `json:"account_type" validate:"omitempty,oneof=checking savings"` // defaults to checking
+
+	InitialDeposit Money `json:"initial_deposit" validate:"gte=0"` // optional opening balance, admin only
+}
+
+// AccountHolder is what any authenticated user may see of someone else's
+// account, e.g. to confirm the recipient of a transfer.
+type AccountHolder struct {
+	Number    int64  `json:"number"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+// AccountSearchResult is one match of an account search by name.
+type AccountSearchResult struct {
+	ID        int    `json:"id"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Number    int64  `json:"number"`
 }
 
+// CreateAccountResponse logs the new account holder in straight away.
+type CreateAccountResponse struct {
+	Account *AccountResponse `json:"account"`
+	Token   string           `json:"token"`
+}
+
+// UpdateAccountRequest changes the provided fields of an account. Fields left
+// out or null are left alone, while an empty email removes it. Version must
+// be the version of the account as last read by the client: the update is
+// rejected with ErrStaleUpdate if anyone else updated it in the meantime, and
+// the client should then read the account again and reapply its change.
 type UpdateAccountRequest struct {
-	FirstName string    `json:"first_name"`
-	LastName  string    `json:"last_name"`
-	UpdatedAt time.Time `json:"updated_at"`
+	FirstName *string      `json:"first_name" validate:"omitnil,max=50"`
+	LastName  *string      `json:"last_name" validate:"omitnil,max=50"`
+	Email     *string      `json:"email" validate:"omitnil,max=255"`
+	Type      *AccountType `json:"account_type" validate:"omitnil,oneof=checking savings"`
+	Version   int          `json:"version" validate:"required,min=1"`
 }
 
-func NewAccount(firstName, lastName string) *Account {
-	return &Account{
-		FirstName: firstName,
-		LastName:  lastName,
-		Number:    int64(rand.Intn(100000000)),
-		Balance:   0,
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+// Validate rejects emptying the names, which every account must have, and
+// checks the email unless it is being removed.
+func (req *UpdateAccountRequest) Validate() error {
+	verr := &ValidationError{}
+	if req.FirstName != nil && *req.FirstName == "" {
+		verr.Fields = append(verr.Fields, FieldError{Field: "first_name", Message: "must not be empty"})
+	}
+	if req.LastName != nil && *req.LastName == "" {
+		verr.Fields = append(verr.Fields, FieldError{Field: "last_name", Message: "must not be empty"})
+	}
+	if req.Email != nil && *req.Email != "" && validate.Var(*req.Email, "email") != nil {
+		verr.Fields = append(verr.Fields, FieldError{Field: "email", Message: "must be a valid email address"})
 	}
+
+	if len(verr.Fields) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// ReplaceAccountRequest sets every mutable field of an account, unlike
+// UpdateAccountRequest. Version works the same way.
+type ReplaceAccountRequest struct {
+	FirstName string      `json:"first_name" validate:"required,max=50"`
+	LastName  string      `json:"last_name" validate:"required,max=50"`
+	Email     string      `json:"email" validate:"required,email,max=255"`
+	Type      AccountType `json:"account_type" validate:"required,oneof=checking savings"`
+	Version   int         `json:"version" validate:"required,min=1"`
+}
+
+// ChangePasswordRequest replaces the password of the authenticated account.
+type ChangePasswordRequest struct {
+	OldPassword string `json:"old_password" validate:"required"`
+	NewPassword string `json:"new_password" validate:"required,max=72"` // bcrypt ignores anything past 72 bytes
+}
+
+// TransferOwnershipRequest names the new holder of an account and the
+// password they will log in with.
+type TransferOwnershipRequest struct {
+	FirstName string `json:"first_name" validate:"required,max=50"`
+	LastName  string `json:"last_name" validate:"required,max=50"`
+	Email     string `json:"email" validate:"required,email,max=255"`
+	Password  string `json:"password" validate:"required,max=72"`
+}
+
+// TransactionType tells what moved money in or out of an account.
+type TransactionType string
+
+const (
+	TransactionDeposit     TransactionType = "deposit"
+	TransactionWithdrawal  TransactionType = "withdrawal"
+	TransactionTransferIn  TransactionType = "transfer_in"
+	TransactionTransferOut TransactionType = "transfer_out"
+	TransactionInterest    TransactionType = "interest"
+	TransactionReversal    TransactionType = "reversal" // undoes a transfer, on both sides
+	TransactionFee         TransactionType = "fee"      // charged on a transfer, on both the sender and the fee account
+)
+
+// Transaction is one ledger entry. Amount is signed: credits are positive and
+// debits negative, so Balance is the sum of all amounts up to this entry.
+type Transaction struct {
+	ID               int             `json:"id"`
+	AccountID        int             `json:"account_id"`
+	Type             TransactionType `json:"type"`
+	Amount           Money           `json:"amount"`
+	Currency         string          `json:"currency"`
+	Balance          Money           `json:"balance"`
+	Counterparty     int64           `json:"counterparty,omitempty"`      // number of the other account of a transfer
+	CounterpartyName string          `json:"counterparty_name,omitempty"` // its holder, or formerHolderName once it is deleted or closed
+	FX               *FXDetails      `json:"fx,omitempty"`                // set on transfers between currencies
+	ReversalOf       int             `json:"reversal_of,omitempty"`       // id of the transfer_out entry a reversal undoes
+	Reversed         bool            `json:"reversed,omitempty"`          // set on transfer_out entries that were reversed
+	Category         string          `json:"category,omitempty"`
+	Tags             []string        `json:"tags,omitempty"`
+	CreatedAt        Timestamp       `json:"created_at"`
+}
+
+// formerHolderName stands in for the name of the holder of a deleted or
+// closed account in the ledger of others. The account number stays, so that
+// the ledger can still be reconciled.
+const formerHolderName = "Former account holder"
+
+// FXDetails records the other side of a currency conversion: the amount as
+// debited or credited on the counterparty account, and the rate applied.
+type FXDetails struct {
+	Amount   Money   `json:"amount"`
+	Currency string  `json:"currency"`
+	Rate     float64 `json:"rate"`
+}
+
+// TransactionFilter restricts the ledger entries read for an account.
+type TransactionFilter struct {
+	From   time.Time // inclusive, ignored when zero
+	To     time.Time // exclusive, ignored when zero
+	Before int       // only entries with a smaller id, ignored when zero
+
+	Category string // only entries filed under it, ignored when empty
+}
+
+// TransactionPage is one page of an account's history, newest first. Pass
+// NextCursor as the cursor to get the following page; it is nil on the last one.
+type TransactionPage struct {
+	Transactions []*Transaction `json:"transactions"`
+	NextCursor   *int           `json:"next_cursor"`
+}
+
+// LedgerTransfer is a transfer between any two accounts, as seen by admins
+// monitoring the whole ledger. It is read from the sender's transfer_out
+// entry, whose id it bears.
+type LedgerTransfer struct {
+	ID            int       `json:"id"`
+	FromAccountID int       `json:"from_account_id"`
+	FromAccount   int64     `json:"from_account,omitempty"` // omitted once the sender is deleted
+	ToAccount     int64     `json:"to_account"`
+	Amount        Money     `json:"amount"` // debited from the sender, in its currency
+	Currency      string    `json:"currency"`
+	Reversed      bool      `json:"reversed,omitempty"`
+	CreatedAt     Timestamp `json:"created_at"`
+}
+
+// LedgerTransferFilter selects the transfers of the ledger to list.
+type LedgerTransferFilter struct {
+	Since     time.Time // inclusive
+	MinAmount Money     // ignored when zero
+	Before    int       // only transfers with a smaller id, ignored when zero
+}
+
+// LedgerTransferPage is one page of the transfers of the ledger, newest
+// first, paginated like TransactionPage.
+type LedgerTransferPage struct {
+	Transfers  []*LedgerTransfer `json:"transfers"`
+	NextCursor *int              `json:"next_cursor"`
+}
+
+// Frequency is how often a scheduled transfer repeats.
+type Frequency string
+
+const (
+	FrequencyDaily   Frequency = "daily"
+	FrequencyWeekly  Frequency = "weekly"
+	FrequencyMonthly Frequency = "monthly"
+)
+
+func (f Frequency) Valid() bool {
+	return f == FrequencyDaily || f == FrequencyWeekly || f == FrequencyMonthly
+}
+
+// Next returns the occurrence following t.
+func (f Frequency) Next(t time.Time) time.Time {
+	switch f {
+	case FrequencyWeekly:
+		return t.AddDate(0, 0, 7)
+	case FrequencyMonthly:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// ScheduledTransfer is a standing order executed by the scheduler.
+type ScheduledTransfer struct {
+	ID        int        `json:"id"`
+	AccountID int        `json:"account_id"`
+	ToAccount int64      `json:"to_account"`
+	Amount    Money      `json:"amount"`
+	Frequency Frequency  `json:"frequency"`
+	NextRun   Timestamp  `json:"next_run"`
+	RetryAt   *Timestamp `json:"retry_at,omitempty"` // set while a failed occurrence awaits its retry
+	Failures  int        `json:"failures"`           // failed attempts of the current occurrence
+	LastError string     `json:"last_error"`         // error of the latest run, if it failed
+	CreatedAt Timestamp  `json:"created_at"`
+}
+
+// TransferStatus tells where a pending transfer is in its lifecycle.
+type TransferStatus string
+
+const (
+	TransferStatusPending   TransferStatus = "pending"
+	TransferStatusConfirmed TransferStatus = "confirmed"
+	TransferStatusExpired   TransferStatus = "expired"
+)
+
+// PendingTransfer is a transfer above the approval threshold. Its amount and
+// fee are held on the source account until the sender confirms it or it
+// expires.
+type PendingTransfer struct {
+	ID        int   `json:"id"`
+	AccountID int   `json:"account_id"`
+	ToAccount int64 `json:"to_account"`
+	Amount    Money `json:"amount"`
+	Fee       Money `json:"fee"`
+	TransactionLabels
+	Status      TransferStatus `json:"status"`
+	ExpiresAt   Timestamp      `json:"expires_at"`
+	ConfirmedAt *Timestamp     `json:"confirmed_at,omitempty"`
+	CreatedAt   Timestamp      `json:"created_at"`
+}
+
+type CreateScheduledTransferRequest struct {
+	ToAccount int64     `json:"to_account" validate:"required,account_number"`
+	Amount    Money     `json:"amount" validate:"amount"`
+	Frequency Frequency `json:"frequency" validate:"required,oneof=daily weekly monthly"`
+	NextRun   time.Time `json:"next_run" validate:"required"`
+}
+
+// CloseAccountRequest optionally names the account that receives the
+// remaining balance.
+type CloseAccountRequest struct {
+	SweepTo int64 `json:"sweep_to"`
+}
+
+// CloseAccountResponse holds the closed account and its final statement.
+type CloseAccountResponse struct {
+	Account   *AccountResponse `json:"account"`
+	Statement []*Transaction   `json:"statement"`
+}
+
+// CleanupAccountsRequest tunes a cleanup of dormant accounts. Zero dormant
+// days means the configured DORMANT_DAYS.
+type CleanupAccountsRequest struct {
+	DormantDays int  `json:"dormant_days" validate:"gte=0"`
+	DryRun      bool `json:"dry_run"`
+}
+
+// CleanupAccountsResponse tells how many dormant accounts were closed, or
+// would have been for a dry run.
+type CleanupAccountsResponse struct {
+	Closed      int  `json:"closed"`
+	DormantDays int  `json:"dormant_days"`
+	DryRun      bool `json:"dry_run"`
+}
+
+// AccountListOptions narrows and orders the result of listing accounts.
+type AccountListOptions struct {
+	LastName string
+	Sort     string // column to sort by, one of sortableAccountColumns
+	Order    string // "asc" or "desc"
+	Limit    int
+	Offset   int
+}
+
+// FullName joins the first and last name with single spaces, ignoring any
+// extra whitespace around or inside them.
+func (a *Account) FullName() string {
+	return strings.Join(strings.Fields(a.FirstName+" "+a.LastName), " ")
+}
+
+// Available is the part of the balance not held by pending transfers.
+func (a *Account) Available() Money {
+	return a.Balance - a.HeldBalance
+}
+
+// ValidPassword reports whether pw matches the account's stored password hash.
+func (a *Account) ValidPassword(pw string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(a.EncryptedPassword), []byte(pw)) == nil
+}
+
+// AccountNumberFormat describes the numbers of new accounts: Digits long,
+// check digit included, and starting with Prefix, e.g. a routing number.
+type AccountNumberFormat struct {
+	Digits int
+	Prefix string
+}
+
+// maxAccountNumberDigits keeps account numbers within an int64, whose largest
+// value has 19 digits.
+const maxAccountNumberDigits = 18
+
+// Validate checks that numbers of the format fit an int64 and leave at least
+// one random digit besides the prefix and the check digit.
+func (f AccountNumberFormat) Validate() error {
+	if f.Digits < 2 || f.Digits > maxAccountNumberDigits {
+		return fmt.Errorf("account numbers must have between 2 and %d digits", maxAccountNumberDigits)
+	}
+	if strings.Trim(f.Prefix, "0123456789") != "" || strings.HasPrefix(f.Prefix, "0") {
+		return fmt.Errorf("account number prefix must be digits not starting with 0, got %q", f.Prefix)
+	}
+	if len(f.Prefix) > f.Digits-2 {
+		return fmt.Errorf("account number prefix %q leaves no random digits in %d digit numbers", f.Prefix, f.Digits)
+	}
+	return nil
+}
+
+// newNumber returns a random account number of the format ending in its Luhn
+// check digit, so that most typos make it invalid instead of naming another
+// account.
+func (f AccountNumberFormat) newNumber() int64 {
+	random := f.Digits - 1 - len(f.Prefix)
+
+	var span int64 = 1
+	for i := 0; i < random; i++ {
+		span *= 10
+	}
+
+	// Without a prefix, the first digit mustn't be 0 for the length to hold.
+	var payload int64
+	if f.Prefix == "" {
+		payload = span/10 + rand.Int63n(span-span/10)
+	} else {
+		prefix, _ := strconv.ParseInt(f.Prefix, 10, 64)
+		payload = prefix*span + rand.Int63n(span)
+	}
+	return payload*10 + luhnCheckDigit(payload)
+}
+
+// ValidAccountNumber reports whether the last digit of n is the Luhn check
+// digit of the ones before it. Accounts numbered before check digits were
+// introduced may fail it, so failing numbers mustn't be rejected before
+// looking them up.
+func ValidAccountNumber(n int64) bool {
+	return n > 0 && luhnCheckDigit(n/10) == n%10
+}
+
+// luhnCheckDigit returns the digit that appended to payload makes it pass the
+// Luhn check.
+func luhnCheckDigit(payload int64) int64 {
+	var sum int64
+	for double := true; payload > 0; double = !double {
+		d := payload % 10
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		payload /= 10
+	}
+	return (10 - sum%10) % 10
+}
+
+// hashPassword returns the bcrypt hash stored for password, of work factor
+// cost. Existing hashes keep the cost they were created with.
+func hashPassword(password string, cost int) (string, error) {
+	encpw, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	return string(encpw), err
+}
+
+// NewAccount returns a checking account numbered in the configured format,
+// whose password is hashed with the configured cost.
+func NewAccount(firstName, lastName, email, password string, cfg *Config) (*Account, error) {
+	encpw, err := hashPassword(password, cfg.BcryptCost)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Account{
+		FirstName:         firstName,
+		LastName:          lastName,
+		Email:             email,
+		EncryptedPassword: encpw,
+		Number:            cfg.AccountNumberFormat.newNumber(),
+		Balance:           0,
+		Currency:          DefaultCurrency,
+		Type:              AccountTypeChecking,
+		Status:            AccountStatusActive,
+	}, nil
 }
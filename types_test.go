@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidAccountNumber(t *testing.T) {
+	tests := []struct {
+		number int64
+		want   bool
+	}{
+		{79927398713, true}, // the textbook Luhn example
+		{79927398710, false},
+		{79927398714, false},
+		{18, true},
+		{0, false},
+		{-79927398713, false},
+	}
+	for _, tt := range tests {
+		if got := ValidAccountNumber(tt.number); got != tt.want {
+			t.Errorf("ValidAccountNumber(%d) = %t, want %t", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestNewAccountNumbersAreValid(t *testing.T) {
+	formats := []AccountNumberFormat{
+		{Digits: 8},
+		{Digits: 2},
+		{Digits: 12, Prefix: "4021"},
+		{Digits: maxAccountNumberDigits, Prefix: "9"},
+	}
+	for _, f := range formats {
+		for i := 0; i < 1000; i++ {
+			n := f.newNumber()
+			if !ValidAccountNumber(n) {
+				t.Fatalf("%+v: newNumber() = %d, which fails its check digit", f, n)
+			}
+			if s := strconv.FormatInt(n, 10); len(s) != f.Digits || !strings.HasPrefix(s, f.Prefix) {
+				t.Fatalf("%+v: newNumber() = %d, want %d digits starting with %q", f, n, f.Digits, f.Prefix)
+			}
+		}
+	}
+}
+
+func TestAccountNumberFormatValidate(t *testing.T) {
+	tests := []struct {
+		format AccountNumberFormat
+		valid  bool
+	}{
+		{AccountNumberFormat{Digits: 8}, true},
+		{AccountNumberFormat{Digits: 10, Prefix: "12345678"}, true},
+		{AccountNumberFormat{Digits: 1}, false},
+		{AccountNumberFormat{Digits: maxAccountNumberDigits + 1}, false},
+		{AccountNumberFormat{Digits: 10, Prefix: "012"}, false},
+		{AccountNumberFormat{Digits: 10, Prefix: "12a"}, false},
+		{AccountNumberFormat{Digits: 10, Prefix: "123456789"}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.format.Validate(); (err == nil) != tt.valid {
+			t.Errorf("%+v: Validate() = %v, want valid %t", tt.format, err, tt.valid)
+		}
+	}
+}
+
+func TestNewAccountUsesConfiguredFormat(t *testing.T) {
+	t.Setenv("ACCOUNT_NUMBER_DIGITS", "10")
+	t.Setenv("ACCOUNT_NUMBER_PREFIX", "77")
+	cfg := testConfig(t)
+	cfg.BcryptCost = bcrypt.MinCost
+
+	account, err := NewAccount("Ada", "Lovelace", "", "Passw0rd!", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := strconv.FormatInt(account.Number, 10); len(s) != 10 || !strings.HasPrefix(s, "77") {
+		t.Errorf("account number %d, want 10 digits starting with 77", account.Number)
+	}
+}
+
+func TestTransferValidationAcceptsLegacyNumbers(t *testing.T) {
+	// Numbered before check digits, so it fails the check but may exist.
+	const legacy = 79927398710
+
+	reqs := []interface{}{
+		&TransferRequest{ToAccount: legacy, Amount: 1_00},
+		&BatchTransferItem{ToAccount: legacy, Amount: 1_00},
+	}
+	for _, req := range reqs {
+		if err := validateRequest(req); err != nil {
+			t.Errorf("validateRequest(%T) with a legacy number: %v", req, err)
+		}
+	}
+
+	if err := validateRequest(&TransferRequest{ToAccount: -1, Amount: 1_00}); !errors.Is(err, ErrValidation) {
+		t.Errorf("validateRequest with a negative number: err = %v, want a validation error", err)
+	}
+}
+
+func TestAccountNumberNotFound(t *testing.T) {
+	err := accountNumberNotFound(79927398710)
+	if !errors.Is(err, ErrAccountNotFound) || !strings.Contains(err.Error(), "typos") {
+		t.Errorf("a number failing its check digit: err = %v, want ErrAccountNotFound hinting at a typo", err)
+	}
+
+	err = accountNumberNotFound(79927398713)
+	if !errors.Is(err, ErrAccountNotFound) || strings.Contains(err.Error(), "typos") {
+		t.Errorf("a valid number: err = %v, want ErrAccountNotFound without a hint", err)
+	}
+}
+
+func TestNewAccountHashesWithCost(t *testing.T) {
+	cfg := testConfig(t)
+	for _, cost := range []int{bcrypt.MinCost, bcrypt.MinCost + 1} {
+		cfg.BcryptCost = cost
+		account, err := NewAccount("Ada", "Lovelace", "", "Passw0rd!", cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := bcrypt.Cost([]byte(account.EncryptedPassword)); err != nil || got != cost {
+			t.Errorf("hash cost = %d, %v, want %d", got, err, cost)
+		}
+		if !account.ValidPassword("Passw0rd!") {
+			t.Errorf("cost %d: the password doesn't match its hash", cost)
+		}
+	}
+}
+
+// BenchmarkHashPassword shows the time a login takes at each cost worth
+// configuring as BCRYPT_COST:
+//
+//	go test -run - -bench HashPassword
+func BenchmarkHashPassword(b *testing.B) {
+	for _, cost := range []int{bcrypt.MinCost, 8, bcrypt.DefaultCost, 12} {
+		b.Run(fmt.Sprintf("cost=%d", cost), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := hashPassword("Passw0rd!", cost); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrValidation is matched by every ValidationError.
+var ErrValidation = errors.New("invalid request")
+
+// FieldError describes one field of a request that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError lists every field of a request that failed validation.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + " " + f.Message
+	}
+	return "invalid request: " + strings.Join(msgs, "; ")
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrValidation
+}
+
+func (e *ValidationError) Details() map[string]interface{} {
+	return map[string]interface{}{"fields": e.Fields}
+}
+
+// validate checks the `validate` struct tags of request types. Fields are
+// reported by their JSON name.
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	// Account numbers aren't checked against their check digit here, which
+	// accounts numbered before check digits fail: whether the account exists
+	// is up to the store.
+	v.RegisterValidation("account_number", func(fl validator.FieldLevel) bool {
+		return fl.Field().Int() > 0
+	})
+	v.RegisterValidation("amount", func(fl validator.FieldLevel) bool {
+		amount := Money(fl.Field().Int())
+		return amount > 0 && amount <= maxAmount
+	})
+	return v
+}
+
+// requestValidator is implemented by requests with rules the struct tags can't
+// express, such as constraints spanning several fields.
+type requestValidator interface {
+	Validate() error
+}
+
+// validateRequest checks the struct tags of v, reporting all failing fields at
+// once, and then its Validate method if it has one.
+func validateRequest(v interface{}) error {
+	if err := validate.Struct(v); err != nil {
+		var fieldErrs validator.ValidationErrors
+		if !errors.As(err, &fieldErrs) {
+			return err
+		}
+
+		verr := &ValidationError{}
+		for _, fe := range fieldErrs {
+			verr.Fields = append(verr.Fields, FieldError{Field: fe.Field(), Message: fieldErrorMessage(fe)})
+		}
+		return verr
+	}
+
+	if rv, ok := v.(requestValidator); ok {
+		return rv.Validate()
+	}
+	return nil
+}
+
+// decodeAndValidate decodes the JSON body of r into v and validates it.
+func decodeAndValidate(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	if err := decodeJSON(w, r, v); err != nil {
+		return err
+	}
+	return validateRequest(v)
+}
+
+// fieldErrorMessage phrases a failed tag for humans, e.g. "is required".
+func fieldErrorMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "http_url":
+		return "must be an http or https URL"
+	case "iso4217":
+		return "must be an ISO 4217 currency code"
+	case "oneof":
+		return "must be one of " + strings.Join(strings.Fields(fe.Param()), ", ")
+	case "gt":
+		return "must be greater than " + fe.Param()
+	case "gte":
+		return "must be at least " + fe.Param()
+	case "min":
+		switch fe.Kind() {
+		case reflect.String:
+			return fmt.Sprintf("must be at least %s characters", fe.Param())
+		case reflect.Slice:
+			return fmt.Sprintf("must have at least %s items", fe.Param())
+		}
+		return "must be at least " + fe.Param()
+	case "max":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at most %s characters", fe.Param())
+		}
+		return "must be at most " + fe.Param()
+	case "len":
+		return fmt.Sprintf("must be %s characters long", fe.Param())
+	case "numeric":
+		return "must be numeric"
+	case "account_number":
+		return "is not a valid account number"
+	case "amount":
+		return "must be greater than 0 and at most " + maxAmount.decimal()
+	default:
+		return "is invalid (" + fe.Tag() + ")"
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// ErrEmailNotVerified is returned when an account that hasn't verified its
+// email tries to move money out.
+var ErrEmailNotVerified = errors.New("email address not verified")
+
+// ErrEmailAlreadyVerified is returned when asking for a new verification
+// email for an account that is already verified.
+var ErrEmailAlreadyVerified = errors.New("email address already verified")
+
+// ErrInvalidVerificationToken is returned for unknown and expired email
+// verification tokens alike.
+var ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+
+// VerifyEmailResponse confirms that the email of an account is verified.
+type VerifyEmailResponse struct {
+	Number        int64 `json:"number"`
+	EmailVerified bool  `json:"email_verified"`
+}
+
+// requireVerifiedEmail returns ErrEmailNotVerified unless account verified its
+// email.
+func requireVerifiedEmail(account *Account) error {
+	if !account.EmailVerified {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
+
+// sendEmailVerification replaces any pending verification token of account
+// with a new one and emails the link to verify it. Only a hash of the token
+// is stored.
+func (s *APIServer) sendEmailVerification(account *Account) error {
+	token := randomHex(32)
+	expiresAt := s.clock.Now().Add(s.cfg.EmailVerificationTTL)
+	if err := s.store.SetEmailVerificationToken(account.ID, hashVerificationToken(token), expiresAt); err != nil {
+		return err
+	}
+
+	link := s.cfg.PublicURL + "/verify?token=" + url.QueryEscape(token)
+	return s.emails.Send(&Email{
+		To:      account.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nOpen this link to verify your email address before moving money out of account %d:\n\n%s\n\nThe link expires on %s.\n",
+			account.FirstName, account.Number, link, NewTimestamp(expiresAt)),
+	})
+}
+
+// startEmailVerification sends the verification email of a new or changed
+// address. Failing to send it doesn't fail the request, since the holder can
+// ask for another one.
+func (s *APIServer) startEmailVerification(account *Account) {
+	if account.Email == "" || account.EmailVerified {
+		return
+	}
+	if err := s.sendEmailVerification(account); err != nil {
+		log.Printf("sending verification email to account %d: %v", account.Number, err)
+	}
+}
+
+func hashVerificationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleVerifyEmail handles GET requests for the link of a verification email.
+// The token is all it takes, so no login is needed.
+func (s *APIServer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return ErrInvalidVerificationToken
+	}
+
+	account, err := s.store.VerifyEmail(hashVerificationToken(token))
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, VerifyEmailResponse{Number: account.Number, EmailVerified: account.EmailVerified})
+}
+
+// handleResendVerification handles POST requests for another verification
+// email for the authenticated account, invalidating the previous link.
+func (s *APIServer) handleResendVerification(w http.ResponseWriter, r *http.Request) error {
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	if account.EmailVerified {
+		return ErrEmailAlreadyVerified
+	}
+	if account.Email == "" {
+		return errors.New("account has no email address")
+	}
+
+	if err := s.sendEmailVerification(account); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusAccepted, nil)
+}
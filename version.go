@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+)
+
+// Version, Commit and BuildTime describe the build. They are set at link time:
+//
+//	go build -ldflags "-X main.Version=1.2.0 -X main.Commit=$(git rev-parse HEAD) -X main.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// VersionInfo is the body of GET /version.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// handleVersion reports which build is running. It needs no authentication.
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, VersionInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	})
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Webhook is a subscription of an external URL to events of one account.
+type Webhook struct {
+	ID        int               `json:"id"`
+	AccountID int               `json:"account_id"`
+	URL       string            `json:"url"`
+	Events    []TransactionType `json:"events"`
+	Secret    string            `json:"secret,omitempty"` // only returned when the webhook is created
+	CreatedAt Timestamp         `json:"created_at"`
+}
+
+type CreateWebhookRequest struct {
+	URL    string            `json:"url" validate:"required,http_url"`
+	Events []TransactionType `json:"events" validate:"required,min=1"`
+}
+
+func (req *CreateWebhookRequest) Validate() error {
+	// Only addresses can be told apart here; host names are checked once
+	// resolved, on delivery.
+	if u, err := url.Parse(req.URL); err == nil {
+		if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !webhookAddressAllowed(ip) {
+			return fmt.Errorf("%w: %s", ErrWebhookAddressForbidden, ip)
+		}
+	}
+	for _, event := range req.Events {
+		if !webhookEventTypes[event] {
+			return fmt.Errorf("invalid event: %s", event)
+		}
+	}
+	return nil
+}
+
+// ErrWebhookAddressForbidden is returned for webhooks pointing into private
+// networks, such as the server's own or a cloud metadata service, which
+// anyone registering a webhook could otherwise reach through the dispatcher.
+var ErrWebhookAddressForbidden = errors.New("webhook address not allowed")
+
+// forbiddenWebhookPrefixes are the ranges webhooks may not be delivered to on
+// top of those classified by netip.
+var forbiddenWebhookPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),     // this network
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64 of IPv4 addresses
+}
+
+// webhookAddressAllowed reports whether webhooks may be delivered to ip,
+// which must not be loopback, link-local, private or otherwise reserved for
+// local use.
+func webhookAddressAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, prefix := range forbiddenWebhookPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// newWebhookClient returns the client delivering webhooks. It checks the
+// address of every connection it opens, once the host is resolved, rather
+// than the URL beforehand, so that neither DNS answers changing in between
+// nor redirects lead it into private networks. It uses no proxy, whose
+// address would be checked instead.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !webhookAddressAllowed(addr.Addr()) {
+				return fmt.Errorf("%w: %s", ErrWebhookAddressForbidden, addr.Addr())
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConnsPerHost: 2,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// webhookEventTypes are the ledger changes subscribers may be notified of.
+var webhookEventTypes = map[TransactionType]bool{
+	TransactionDeposit:     true,
+	TransactionWithdrawal:  true,
+	TransactionTransferIn:  true,
+	TransactionTransferOut: true,
+}
+
+// WebhookEvent is the JSON payload POSTed to subscribers.
+type WebhookEvent struct {
+	ID            string          `json:"id"`
+	Type          TransactionType `json:"type"`
+	AccountNumber int64           `json:"account_number"`
+	Amount        Money           `json:"amount"`
+	Counterparty  int64           `json:"counterparty,omitempty"`
+	OccurredAt    Timestamp       `json:"occurred_at"`
+}
+
+// WebhookDelivery records one attempt to deliver an event to a webhook.
+type WebhookDelivery struct {
+	WebhookID  int
+	EventID    string
+	EventType  TransactionType
+	Attempt    int
+	StatusCode int    // zero when no response was received
+	Error      string // empty on success
+}
+
+// webhookSignatureHeader carries the hex HMAC-SHA256 of the body, keyed with
+// the webhook's secret, so subscribers can verify the payload came from us.
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+// OutboxEvent is an event of the outbox along with its position there.
+type OutboxEvent struct {
+	ID    int64
+	Event *WebhookEvent
+}
+
+// WebhookDispatcher delivers the events of the outbox in the background.
+// Delivery is at least once: an event is only marked published once every
+// subscriber got it or ran out of attempts, so a crash in between delivers it
+// again, with the same id, on restart. The events of one account are
+// delivered in order, which assumes a single server instance dispatches.
+type WebhookDispatcher struct {
+	store        Storage
+	client       *http.Client
+	pollInterval time.Duration
+	batchSize    int
+	maxAttempts  int
+	retryDelay   time.Duration
+
+	// busy holds the accounts whose events are being delivered. Their later
+	// events wait for the next poll, to keep them in order.
+	mu   sync.Mutex
+	busy map[int64]bool
+	// publishing tracks the goroutines delivering events, for Run to wait
+	// for them before it returns.
+	publishing sync.WaitGroup
+}
+
+func NewWebhookDispatcher(store Storage, cfg *Config) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		store:        store,
+		client:       newWebhookClient(),
+		pollInterval: cfg.WebhookPollInterval,
+		batchSize:    cfg.WebhookBatchSize,
+		maxAttempts:  cfg.WebhookMaxAttempts,
+		retryDelay:   cfg.WebhookRetryDelay,
+		busy:         make(map[int64]bool),
+	}
+}
+
+// Run polls the outbox and delivers new events until ctx is done. It returns
+// once the deliveries under way have finished.
+func (d *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.pollInterval)
+	defer ticker.Stop()
+	defer d.publishing.Wait()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.dispatch(ctx)
+	}
+}
+
+// dispatch reads a batch of unpublished events and delivers those of every
+// account in a goroutine of its own, one event after the other.
+func (d *WebhookDispatcher) dispatch(ctx context.Context) {
+	events, err := d.store.GetOutboxEvents(d.batchSize, d.busyAccounts())
+	if err != nil {
+		log.Println("reading outbox:", err)
+		return
+	}
+
+	var accounts []int64
+	byAccount := make(map[int64][]*OutboxEvent)
+	for _, event := range events {
+		number := event.Event.AccountNumber
+		if _, ok := byAccount[number]; !ok {
+			accounts = append(accounts, number)
+		}
+		byAccount[number] = append(byAccount[number], event)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, number := range accounts {
+		d.busy[number] = true
+		d.publishing.Add(1)
+		go d.publishAll(ctx, number, byAccount[number])
+	}
+}
+
+// publishAll publishes the events of one account in order. It stops at the
+// first failure, leaving the rest for a later poll.
+func (d *WebhookDispatcher) publishAll(ctx context.Context, number int64, events []*OutboxEvent) {
+	defer d.publishing.Done()
+	defer func() {
+		d.mu.Lock()
+		delete(d.busy, number)
+		d.mu.Unlock()
+	}()
+
+	for _, event := range events {
+		if err := d.publish(ctx, event); err != nil {
+			log.Printf("publishing outbox event %d: %v", event.ID, err)
+			return
+		}
+	}
+}
+
+func (d *WebhookDispatcher) busyAccounts() []int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	accounts := make([]int64, 0, len(d.busy))
+	for number := range d.busy {
+		accounts = append(accounts, number)
+	}
+	return accounts
+}
+
+// publish delivers an event to each of its subscribers and marks it published.
+// An event whose retries were cut short by ctx stays unpublished, to be
+// delivered again after a restart.
+func (d *WebhookDispatcher) publish(ctx context.Context, event *OutboxEvent) error {
+	webhooks, err := d.store.GetWebhooksForEvent(event.Event.AccountNumber, event.Event.Type)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(event.Event)
+	if err != nil {
+		return err
+	}
+
+	for _, webhook := range webhooks {
+		d.deliver(ctx, webhook, event.Event, body)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return d.store.MarkOutboxEventPublished(event.ID)
+}
+
+// deliver POSTs an event to a webhook, recording every attempt and retrying
+// failures with exponential backoff until ctx is done.
+func (d *WebhookDispatcher) deliver(ctx context.Context, webhook *Webhook, event *WebhookEvent, body []byte) {
+	for attempt := 1; ; attempt++ {
+		err := d.attempt(webhook, event, body, attempt)
+		if err == nil || attempt >= d.maxAttempts {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(d.retryDelay << (attempt - 1)):
+		}
+	}
+}
+
+// attempt POSTs an event to a webhook once and records the outcome.
+func (d *WebhookDispatcher) attempt(webhook *Webhook, event *WebhookEvent, body []byte, attempt int) error {
+	delivery := &WebhookDelivery{
+		WebhookID: webhook.ID,
+		EventID:   event.ID,
+		EventType: event.Type,
+		Attempt:   attempt,
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookSignatureHeader, signPayload(webhook.Secret, body))
+
+		var resp *http.Response
+		resp, err = d.client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			delivery.StatusCode = resp.StatusCode
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	if err := d.store.RecordWebhookDelivery(delivery); err != nil {
+		log.Println("recording webhook delivery:", err)
+	}
+	return err
+}
+
+// signPayload returns the hex encoded HMAC-SHA256 of body.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// randomHex returns n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func newEventID() string {
+	return randomHex(16)
+}
+
+// handleCreateWebhook handles POST requests for subscribing to the
+// authenticated account's events.
+func (s *APIServer) handleCreateWebhook(w http.ResponseWriter, r *http.Request) error {
+	req := &CreateWebhookRequest{}
+	if err := decodeAndValidate(w, r, req); err != nil {
+		return err
+	}
+
+	account, err := getAccountFromContext(r)
+	if err != nil {
+		return err
+	}
+
+	webhook := &Webhook{
+		AccountID: account.ID,
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    randomHex(32),
+		CreatedAt: NewTimestamp(s.clock.Now()),
+	}
+
+	if err := s.store.CreateWebhook(webhook); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, webhook)
+}
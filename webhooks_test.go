@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWebhookAddressAllowed(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"127.1.2.3", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false}, // IPv4-mapped
+		{"10.0.0.1", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"fd00::1", false},
+		{"169.254.169.254", false}, // cloud metadata
+		{"fe80::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"64:ff9b::a9fe:a9fe", false}, // 169.254.169.254 through NAT64
+		{"172.32.0.1", true},
+	}
+	for _, tt := range tests {
+		if got := webhookAddressAllowed(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("webhookAddressAllowed(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCreateWebhookRequestRejectsPrivateAddresses(t *testing.T) {
+	for _, url := range []string{"http://127.0.0.1/hook", "http://169.254.169.254/latest/meta-data", "https://[::1]:8443/hook", "http://10.1.2.3"} {
+		req := &CreateWebhookRequest{URL: url, Events: []TransactionType{TransactionDeposit}}
+		if err := req.Validate(); !errors.Is(err, ErrWebhookAddressForbidden) {
+			t.Errorf("Validate(%s): err = %v, want ErrWebhookAddressForbidden", url, err)
+		}
+	}
+
+	req := &CreateWebhookRequest{URL: "https://hooks.example.com/bank", Events: []TransactionType{TransactionDeposit}}
+	if err := req.Validate(); err != nil {
+		t.Errorf("Validate of a public host name: %v", err)
+	}
+}
+
+// deliveryStore records webhook deliveries.
+type deliveryStore struct {
+	Storage
+	deliveries []*WebhookDelivery
+}
+
+func (s *deliveryStore) RecordWebhookDelivery(delivery *WebhookDelivery) error {
+	s.deliveries = append(s.deliveries, delivery)
+	return nil
+}
+
+func TestWebhookDeliveryRefusesPrivateAddresses(t *testing.T) {
+	var hits atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+	}))
+	defer server.Close()
+
+	store := &deliveryStore{}
+	d := NewWebhookDispatcher(store, testConfig(t))
+	event := &WebhookEvent{ID: "evt_1", Type: TransactionDeposit}
+
+	urls := []string{
+		server.URL,
+		strings.Replace(server.URL, "127.0.0.1", "localhost", 1), // resolved first
+	}
+	for _, url := range urls {
+		err := d.attempt(&Webhook{ID: 1, URL: url, Secret: "secret"}, event, []byte(`{}`), 1)
+		if !errors.Is(err, ErrWebhookAddressForbidden) {
+			t.Errorf("delivery to %s: err = %v, want ErrWebhookAddressForbidden", url, err)
+		}
+	}
+	if n := hits.Load(); n != 0 {
+		t.Errorf("the private server got %d deliveries", n)
+	}
+	if len(store.deliveries) != len(urls) || store.deliveries[0].Error == "" {
+		t.Errorf("recorded %d deliveries, want %d failed ones", len(store.deliveries), len(urls))
+	}
+}